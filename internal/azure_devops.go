@@ -46,7 +46,7 @@ func AzureDevOps(backupDir string) *ProviderBackupResults {
 		UserName:             adou,
 		PAT:                  pat,
 		Orgs:                 getOrgsListFromEnvVar(envAzureDevOpsOrgs),
-		BackupsToRetain:      getBackupsToRetain(envAzureDevOpsBackups),
+		BackupsToRetain:      providerBackupsToRetain(envAzureDevOpsBackups),
 		LogLevel:             getLogLevel(),
 		BackupLFS:            envTrue(envAzureDevOpsBackupLFS),
 		EncryptionPassphrase: bundlePassphrase,
@@ -61,8 +61,14 @@ func AzureDevOps(backupDir string) *ProviderBackupResults {
 		}
 	}
 
+	results := azureDevOpsHost.Backup()
+
+	if envTrue(envAzureDevOpsBackupWikis) {
+		backupWikis(backupDir, azureDevOpsWikiSource(adou, pat), &results)
+	}
+
 	return &ProviderBackupResults{
 		Provider: providerNameAzureDevOps,
-		Results:  azureDevOpsHost.Backup(),
+		Results:  results,
 	}
 }
@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
@@ -22,9 +23,20 @@ import (
 )
 
 type BackupResults struct {
-	StartedAt  sobaTime                 `json:"started_at"`
-	FinishedAt sobaTime                 `json:"finished_at"`
-	Results    *[]ProviderBackupResults `json:"results,omitempty"`
+	StartedAt       sobaTime                 `json:"started_at"`
+	FinishedAt      sobaTime                 `json:"finished_at"`
+	Results         *[]ProviderBackupResults `json:"results,omitempty"`
+	Destinations    []DestinationResult      `json:"destinations,omitempty"`
+	Mirrors         []MirrorResult           `json:"mirrors,omitempty"`
+	Submodules      *SubmoduleResult         `json:"submodules,omitempty"`
+	Keyring         *KeyringResult           `json:"keyring,omitempty"`
+	Obfuscation     *ObfuscationResult       `json:"obfuscation,omitempty"`
+	Signing         *SigningResult           `json:"signing,omitempty"`
+	Encryption      *EncryptionResult        `json:"encryption,omitempty"`
+	Immutable       *ImmutableResult         `json:"immutable,omitempty"`
+	Retention       *RetentionResult         `json:"retention,omitempty"`
+	Quota           *QuotaResult             `json:"quota,omitempty"`
+	MissingUpstream *MissingUpstreamResult   `json:"missing_upstream,omitempty"`
 }
 
 func execProviderBackups() {
@@ -63,9 +75,49 @@ func runProviderBackups() int {
 		},
 	}
 
-	providerBackupResults := collectProviderBackupResults(backupDir)
+	mirrors := newMirrorSyncer(backupDir, workingDir)
+
+	syncer := newDestinationSyncer(backupDir, workingDir)
+	defer syncer.close()
+
+	local := newLocalStorage(backupDir, workingDir)
+
+	keys := newKeyringManager(backupDir, local)
+	keys.prepare(context.Background())
+
+	paths := newPathObfuscator(backupDir, workingDir, local)
+	paths.prepare(context.Background())
+
+	signer := newChecksumSigner(local)
+
+	submodules := newSubmoduleBackup(backupDir, paths.backupDir())
+
+	providerBackupResults := collectProviderBackupResults(paths.backupDir(), func(run providerRun) {
+		submodules.backup(context.Background(), run)
+		paths.collect(context.Background())
+		keys.record(context.Background(), run.started)
+		applyLocalPolicies(context.Background(), local, run, &backupResults)
+		signer.sign(context.Background(), backupResults.StartedAt.Time,
+			slices.Concat(backupResults.Quota.evictedDirs(), backupResults.MissingUpstream.changedDirs(),
+				backupResults.Retention.changedDirs())...)
+		// plaintext must not leave the host if it could not be encrypted
+		if backupResults.Encryption != nil && backupResults.Encryption.Error != nil {
+			logger.Println("not syncing mirrors and destinations as backups could not be encrypted")
+
+			return
+		}
+
+		mirrors.sync()
+		syncer.sync()
+	})
 
 	backupResults.Results = &providerBackupResults
+	backupResults.Destinations = syncer.results
+	backupResults.Mirrors = mirrors.results
+	backupResults.Submodules = submodules.result
+	backupResults.Keyring = keys.result
+	backupResults.Obfuscation = paths.result
+	backupResults.Signing = signer.result
 	backupResults.FinishedAt = sobaTime{
 		Time: time.Now(),
 		f:    time.RFC3339,
@@ -92,30 +144,48 @@ func runProviderBackups() int {
 	return failed
 }
 
+// providerRun describes a provider backup that has just completed.
+type providerRun struct {
+	backupsEnvVar string
+	started       time.Time
+	results       githosts.ProviderBackupResult
+}
+
 // collectProviderBackupResults runs a backup for each provider with complete
-// credentials and returns the per-provider results.
-func collectProviderBackupResults(backupDir string) []ProviderBackupResults {
+// credentials and returns the per-provider results. afterEach is called once
+// each provider has finished writing to the backup directory.
+func collectProviderBackupResults(backupDir string, afterEach func(providerRun)) []ProviderBackupResults {
 	var results []ProviderBackupResults
 
 	// BitBucket - check for API OAuthToken or OAuth2 authentication
 	if bitbucketAPITokenDefined() || bitbucketOAuthDefined() {
+		started := time.Now()
 		results = append(results, *Bitbucket(backupDir))
+
+		afterEach(providerRun{backupsEnvVar: envBitBucketBackups, started: started, results: results[len(results)-1].Results})
 	}
 
 	tokenProviders := []struct {
-		envVar string
-		run    func(string) *ProviderBackupResults
+		envVar        string
+		backupsEnvVar string
+		run           func(string) *ProviderBackupResults
 	}{
-		{envGiteaToken, Gitea},
-		{envGitHubToken, GitHub},
-		{envGitLabToken, Gitlab},
-		{envAzureDevOpsUserName, AzureDevOps},
-		{envSourcehutToken, Sourcehut},
+		{envGiteaToken, envGiteaBackups, Gitea},
+		{envGitHubToken, envGitHubBackups, GitHub},
+		{envGitLabToken, envGitLabBackups, Gitlab},
+		{envAzureDevOpsUserName, envAzureDevOpsBackups, AzureDevOps},
+		{envSourcehutToken, envSourcehutBackups, Sourcehut},
+		{envGenericRepos, envGenericBackups, Generic},
+		{envLocalRepoDirs, envLocalBackups, Local},
+		{envGerritURL, envGerritBackups, Gerrit},
 	}
 
 	for _, p := range tokenProviders {
 		if val, ok := GetEnvOrFile(p.envVar); ok && val != "" {
+			started := time.Now()
 			results = append(results, *p.run(backupDir))
+
+			afterEach(providerRun{backupsEnvVar: p.backupsEnvVar, started: started, results: results[len(results)-1].Results})
 		}
 	}
 
@@ -192,11 +262,55 @@ func displayStartupConfig() {
 		logger.Printf("root backup directory: %s", backupDIR)
 	}
 
+	if recipients, _ := GetEnvOrFile(envVarBundleRecipients); recipients != "" {
+		logger.Println("encrypting backups to public key recipients")
+	}
+
+	if keyring, _ := GetEnvOrFile(envVarBundleKeyring); keyring != "" {
+		logger.Println("keyring: latest backups opened by older keys are re-encrypted with the current passphrase")
+	}
+
+	if key, _ := GetEnvOrFile(envSobaSigningKey); key != "" {
+		logger.Printf("signing backup checksums with %s", envSobaSigningKey)
+	}
+
+	if obfuscatePaths() {
+		logger.Println("obfuscating repository paths in the backup layout")
+	}
+
+	if quota, err := backupQuota(); err == nil && quota > 0 {
+		logger.Printf("backup quota: %s", formatSize(quota))
+	}
+
+	if maxSize, err := releaseAssetMaxSize(); err == nil && maxSize > 0 {
+		logger.Printf("release asset max size: %s", formatSize(maxSize))
+	}
+
+	if policy, err := missingUpstreamPolicyFromEnv(); err == nil && policy.Action != missingUpstreamKeep {
+		logger.Printf("repositories missing upstream: %s after %s", policy.Action, formatRetentionAge(policy.Grace))
+	}
+
+	if envTrue(envSobaBackupSubmodules) {
+		logger.Println("backing up submodule remotes")
+	}
+
+	if gfsConfigured() {
+		logger.Printf("grandfather-father-son retention: %s", retentionPolicyFor(""))
+	}
+
+	if days := immutableDays(); days > 0 {
+		logger.Printf("immutable mode: new backups are locked for %d days", days)
+	}
+
 	displayGitHubStartupConfig()
 	displayGiteaStartupConfig()
 	displayGitLabStartupConfig()
 	displayBitBucketStartupConfig()
 	displayAzureDevOpsStartupConfig()
+	displayGenericStartupConfig()
+	displayLocalStartupConfig()
+	displayGerritStartupConfig()
+	displayDestinationsStartupConfig()
 }
 
 // logProviderOrgs logs the configured organisations for a provider, if any.
@@ -293,6 +407,81 @@ func displayAzureDevOpsStartupConfig() {
 	logProviderBackupLFS(providerLabelAzureDevOps, envAzureDevOpsBackupLFS)
 }
 
+func displayGenericStartupConfig() {
+	list, _ := GetEnvOrFile(envGenericRepos)
+
+	cloneURLs := genericCloneURLs(list)
+	if len(cloneURLs) == 0 {
+		return
+	}
+
+	logger.Printf("Generic repositories: %d", len(cloneURLs))
+	logProviderBackupsToKeep(providerNameGeneric, envGenericBackups)
+	logProviderBackupLFS(providerNameGeneric, envGenericBackupLFS)
+}
+
+func displayLocalStartupConfig() {
+	dirs := localRepoDirs()
+	if len(dirs) == 0 {
+		return
+	}
+
+	logger.Printf("Local repository directories: %s", strings.Join(dirs, ", "))
+
+	if depth, err := localRepoDepth(); err == nil {
+		logger.Printf("Local repository search depth: %d", depth)
+	}
+
+	logProviderBackupsToKeep(providerNameLocal, envLocalBackups)
+	logProviderBackupLFS(providerNameLocal, envLocalBackupLFS)
+}
+
+func displayGerritStartupConfig() {
+	if gerritURL, exists := GetEnvOrFile(envGerritURL); !exists || gerritURL == "" {
+		return
+	}
+
+	for _, envVar := range []string{envGerritProjects, envGerritExcludeProjects} {
+		if patterns, _ := gerritProjectPatterns(envVar); len(patterns) > 0 {
+			logger.Printf("%s: %s", envVar, strings.Join(patterns, ", "))
+		}
+	}
+
+	if envTrue(envGerritBackupChanges) {
+		logger.Printf("%s backup changes: true", providerNameGerrit)
+	}
+
+	logProviderBackupsToKeep(providerNameGerrit, envGerritBackups)
+	logProviderBackupLFS(providerNameGerrit, envGerritBackupLFS)
+}
+
+func displayDestinationsStartupConfig() {
+	if bucket := os.Getenv(envS3Bucket); bucket != "" {
+		endpoint := os.Getenv(envS3Endpoint)
+		if endpoint == "" {
+			endpoint = defaultS3Endpoint
+		}
+
+		logger.Printf("S3 destination: s3://%s (%s)", bucket, endpoint)
+	}
+
+	if sftpURL := os.Getenv(envSFTPURL); sftpURL != "" {
+		logger.Printf("SFTP destination: %s", sftpURL)
+	}
+
+	if webDAVURL := os.Getenv(envWebDAVURL); webDAVURL != "" {
+		logger.Printf("WebDAV destination: %s", webDAVURL)
+	}
+
+	if selected := os.Getenv(envSobaDestinations); selected != "" {
+		logger.Printf("destinations selected for this run: %s", selected)
+	}
+
+	for _, dir := range getOrgsListFromEnvVar(envSobaMirrorDirs) {
+		logger.Printf("mirror directory: %s", strings.TrimSpace(dir))
+	}
+}
+
 func getBackupInterval() int {
 	backupIntervalEnv := os.Getenv(envGitBackupInterval)
 
@@ -455,8 +644,8 @@ func validateStartupConfig() (string, error) {
 
 	backupDIR = strings.TrimSuffix(backupDIR, "\n")
 
-	if _, statErr := os.Stat(backupDIR); statErr != nil {
-		if os.IsNotExist(statErr) {
+	if _, statErr := newLocalStorage(backupDIR).Stat(context.Background(), ""); statErr != nil {
+		if errors.Is(statErr, fs.ErrNotExist) {
 			return "", errors.Wrap(statErr, fmt.Sprintf("specified backup directory \"%s\" does not exist", backupDIR))
 		}
 
@@ -467,6 +656,42 @@ func validateStartupConfig() (string, error) {
 		return "", errors.Wrap(err, "provider configuration invalid")
 	}
 
+	if err := validateEncryptionConfig(); err != nil {
+		return "", errors.Wrap(err, "encryption configuration invalid")
+	}
+
+	if obfuscatePaths() {
+		if _, err := pathKey(); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := backupQuota(); err != nil {
+		return "", err
+	}
+
+	if _, err := releaseAssetMaxSize(); err != nil {
+		return "", err
+	}
+
+	if _, err := s3PartSize(); err != nil {
+		return "", err
+	}
+
+	if _, err := localRepoDepth(); err != nil {
+		return "", err
+	}
+
+	if gerritURL, _ := GetEnvOrFile(envGerritURL); gerritURL != "" {
+		if _, err := gerritSourceFromEnv(); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := missingUpstreamPolicyFromEnv(); err != nil {
+		return "", err
+	}
+
 	return backupDIR, nil
 }
 
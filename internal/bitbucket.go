@@ -65,7 +65,7 @@ func Bitbucket(backupDir string) *ProviderBackupResults {
 		User:                 bbUser,
 		Key:                  bbKey,
 		Secret:               bbSecret,
-		BackupsToRetain:      getBackupsToRetain(envBitBucketBackups),
+		BackupsToRetain:      providerBackupsToRetain(envBitBucketBackups),
 		LogLevel:             getLogLevel(),
 		BackupLFS:            envTrue(envBitBucketBackupLFS),
 		EncryptionPassphrase: bundlePassphrase,
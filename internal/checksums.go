@@ -0,0 +1,306 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"aead.dev/minisign"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envSobaSigningKey         = "SOBA_SIGNING_KEY"
+	envSobaSigningKeyPassword = "SOBA_SIGNING_KEY_PASSWORD" // nolint:gosec
+	envSobaSigningPublicKey   = "SOBA_SIGNING_PUBLIC_KEY"
+
+	checksumsName   = "SHA256SUMS"
+	signatureSuffix = ".minisig"
+
+	// the directory is included in the signed trusted comment so a signed
+	// checksums file can't be passed off as belonging to another repository
+	trustedCommentDir = "soba-dir:"
+)
+
+// SigningResult reports the repository directories whose checksums were
+// signed during a run.
+type SigningResult struct {
+	Signed int      `json:"signed"`
+	Error  errors.E `json:"error,omitempty"`
+}
+
+// signingKey returns the minisign key in SOBA_SIGNING_KEY, decrypted with
+// SOBA_SIGNING_KEY_PASSWORD, or nil if signing is not in use.
+func signingKey() (*minisign.PrivateKey, error) {
+	value, _ := GetEnvOrFile(envSobaSigningKey)
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	password, _ := GetEnvOrFile(envSobaSigningKeyPassword)
+
+	key, err := minisign.DecryptKey(password, []byte(strings.TrimSpace(value)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt %s", envSobaSigningKey)
+	}
+
+	return &key, nil
+}
+
+// signingPublicKey returns the minisign public key in
+// SOBA_SIGNING_PUBLIC_KEY, given either as the key itself or as the
+// contents of a minisign .pub file.
+func signingPublicKey() (minisign.PublicKey, error) {
+	var key minisign.PublicKey
+
+	value, _ := GetEnvOrFile(envSobaSigningPublicKey)
+
+	lines := strings.Split(strings.TrimSpace(value), "\n")
+	if err := key.UnmarshalText([]byte(strings.TrimSpace(lines[len(lines)-1]))); err != nil {
+		return key, errors.Wrapf(err, "invalid %s", envSobaSigningPublicKey)
+	}
+
+	return key, nil
+}
+
+// repoFiles holds the files in a single repository directory.
+type repoFiles struct {
+	backups   []ObjectInfo
+	others    []string
+	checksums bool
+}
+
+// groupRepoFiles groups the files in storage by directory, skipping soba's
+// state directory. Release assets are grouped, and checksummed, with the
+// releases directory holding them.
+func groupRepoFiles(objects []ObjectInfo) map[string]*repoFiles {
+	dirs := make(map[string]*repoFiles)
+
+	for _, o := range objects {
+		if strings.HasPrefix(o.Key, stateDIRName+"/") {
+			continue
+		}
+
+		dir, asset := releaseAssetDir(o.Key)
+		if !asset {
+			dir = path.Dir(o.Key)
+		}
+
+		if dirs[dir] == nil {
+			dirs[dir] = &repoFiles{}
+		}
+
+		switch name := path.Base(o.Key); {
+		case asset:
+			dirs[dir].backups = append(dirs[dir].backups, o)
+		case name == checksumsName:
+			dirs[dir].checksums = true
+		case name == checksumsName+signatureSuffix || strings.HasSuffix(name, lockSuffix) || strings.HasSuffix(name, holdSuffix):
+		default:
+			if _, ok := parseBackupFile(o.Key); ok {
+				dirs[dir].backups = append(dirs[dir].backups, o)
+			} else {
+				dirs[dir].others = append(dirs[dir].others, o.Key)
+			}
+		}
+	}
+
+	return dirs
+}
+
+// checksumSigner writes a signed SHA256SUMS file to each repository
+// directory listing its bundles, manifests, LFS archives and release assets.
+type checksumSigner struct {
+	storage Storage
+	key     *minisign.PrivateKey
+	result  *SigningResult
+}
+
+// newChecksumSigner does nothing unless SOBA_SIGNING_KEY is set.
+func newChecksumSigner(storage Storage) *checksumSigner {
+	c := &checksumSigner{storage: storage}
+
+	if value, _ := GetEnvOrFile(envSobaSigningKey); value == "" {
+		return c
+	}
+
+	c.result = &SigningResult{}
+
+	key, err := signingKey()
+	if err != nil {
+		c.result.Error = errors.WithStack(err)
+
+		return c
+	}
+
+	c.key = key
+
+	return c
+}
+
+// sign updates the checksums of every repository directory with files
+// written since the given time, of any not yet signed, and of the changed
+// directories soba removed backups from. Entries for older files are carried
+// over from the existing, verified, checksums so a file changed outside
+// soba is never signed.
+func (c *checksumSigner) sign(ctx context.Context, since time.Time, changed ...string) {
+	if c.key == nil {
+		return
+	}
+
+	objects, err := c.storage.List(ctx, "")
+	if err != nil {
+		c.result.Error = errors.Wrap(err, "failed to list backups")
+
+		return
+	}
+
+	dirs := groupRepoFiles(objects)
+
+	names := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+
+	sort.Strings(names)
+
+	for _, dir := range names {
+		files := dirs[dir]
+		if len(files.backups) == 0 {
+			continue
+		}
+
+		if files.checksums && !dirUpdatedSince(files.backups, dir, since) && !slices.Contains(changed, dir) {
+			continue
+		}
+
+		if sErr := c.signDir(ctx, dir, files, since); sErr != nil {
+			c.result.Error = errors.WithMessagef(sErr, "failed to sign checksums for %s", dir)
+
+			continue
+		}
+
+		c.result.Signed++
+	}
+}
+
+func (c *checksumSigner) signDir(ctx context.Context, dir string, files *repoFiles, since time.Time) error {
+	existing := map[string]string{}
+
+	if files.checksums {
+		sums, _, err := readSignedChecksums(ctx, c.storage, dir, c.key.Public().(minisign.PublicKey))
+		if err != nil {
+			return err
+		}
+
+		existing = sums
+	}
+
+	var sums bytes.Buffer
+
+	for _, o := range files.backups {
+		name := strings.TrimPrefix(o.Key, dir+"/")
+
+		sum, ok := existing[name]
+		if !ok || !o.ModTime.Before(since) {
+			b, err := storageChecksum(ctx, c.storage, o.Key, sha256.New())
+			if err != nil {
+				return err
+			}
+
+			sum = hex.EncodeToString(b)
+		}
+
+		// the format of sha256sum, so the file can be checked with
+		// sha256sum -c once its signature has been verified
+		fmt.Fprintf(&sums, "%s  %s\n", sum, name)
+	}
+
+	signature := minisign.SignWithComments(*c.key, sums.Bytes(),
+		trustedCommentDir+dir+" timestamp:"+strconv.FormatInt(time.Now().Unix(), 10),
+		"signature from soba")
+
+	key := path.Join(dir, checksumsName)
+
+	if err := c.storage.Put(ctx, key, bytes.NewReader(sums.Bytes()), int64(sums.Len())); err != nil {
+		return err
+	}
+
+	return c.storage.Put(ctx, key+signatureSuffix, bytes.NewReader(signature), int64(len(signature)))
+}
+
+// readSignedChecksums reads a directory's checksums, returning an error if
+// the signature does not verify or was made for another directory.
+func readSignedChecksums(ctx context.Context, s Storage, dir string, key minisign.PublicKey) (map[string]string, string, error) {
+	checksums, err := readObject(ctx, s, path.Join(dir, checksumsName))
+	if err != nil {
+		return nil, "", err
+	}
+
+	signature, err := readObject(ctx, s, path.Join(dir, checksumsName+signatureSuffix))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var sig minisign.Signature
+
+	if !minisign.Verify(key, checksums, signature) || sig.UnmarshalText(signature) != nil {
+		return nil, "", errors.New("signature does not verify")
+	}
+
+	if !strings.HasPrefix(sig.TrustedComment, trustedCommentDir+dir+" ") {
+		return nil, "", errors.Errorf("signature was made for another directory: %s", sig.TrustedComment)
+	}
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+
+	for scanner.Scan() {
+		sum, name, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			return nil, "", errors.Errorf("malformed line in %s: %q", checksumsName, scanner.Text())
+		}
+
+		sums[name] = sum
+	}
+
+	return sums, sig.TrustedComment, nil
+}
+
+func readObject(ctx context.Context, s Storage, key string) ([]byte, error) {
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return b, nil
+}
+
+// signChecksums re-signs the checksums of directories changed by a command,
+// if a signing key is configured.
+func signChecksums(ctx context.Context, s Storage, since time.Time) error {
+	c := newChecksumSigner(s)
+	c.sign(ctx, since)
+
+	if c.result != nil && c.result.Error != nil {
+		return c.result.Error
+	}
+
+	return nil
+}
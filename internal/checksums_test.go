@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"aead.dev/minisign"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSigner(t *testing.T, s Storage) (*checksumSigner, minisign.PublicKey) {
+	t.Helper()
+
+	public, private, err := minisign.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	return &checksumSigner{storage: s, key: &private, result: &SigningResult{}}, public
+}
+
+func TestSignAndVerifyChecksums(t *testing.T) {
+	backupDir := t.TempDir()
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle", "one")
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.manifest", "{}")
+	writeBackupFile(t, backupDir, "github.com/owner/other/other.20240101000000.bundle", "other")
+	writeBackupFile(t, backupDir, "github.com/owner/other.releases/other.releases.20240101000000.json.gz", "releases")
+	writeBackupFile(t, backupDir, "github.com/owner/other.releases/assets/"+strings.Repeat("ab", 32), "asset")
+
+	local := newLocalStorage(backupDir)
+	signer, public := newTestSigner(t, local)
+
+	signer.sign(t.Context(), time.Now())
+	require.Nil(t, signer.result.Error)
+	require.Equal(t, 3, signer.result.Signed)
+
+	// release assets are listed with the releases archives
+	releaseSums, err := os.ReadFile(filepath.Join(backupDir, "github.com", "owner", "other.releases", checksumsName))
+	require.NoError(t, err)
+	require.Contains(t, string(releaseSums), "  assets/"+strings.Repeat("ab", 32)+"\n")
+
+	dir := filepath.Join(backupDir, "github.com", "owner", "repo")
+
+	sums, err := os.ReadFile(filepath.Join(dir, checksumsName))
+	require.NoError(t, err)
+	require.Contains(t, string(sums), "  repo.20240101000000.bundle\n")
+
+	signature, err := os.ReadFile(filepath.Join(dir, checksumsName+signatureSuffix))
+	require.NoError(t, err)
+	require.True(t, minisign.Verify(public, sums, signature))
+
+	report, err := verifyChecksums(t.Context(), local, public)
+	require.NoError(t, err)
+	require.Equal(t, 5, report.Verified)
+	require.Empty(t, report.Problems)
+
+	// tamper with the backups outside soba
+	past := time.Now().Add(-time.Hour)
+	bundle := filepath.Join(dir, "repo.20240101000000.bundle")
+	require.NoError(t, os.WriteFile(bundle, []byte("changed"), 0o600))
+	require.NoError(t, os.Chtimes(bundle, past, past))
+	require.NoError(t, os.Remove(filepath.Join(dir, "repo.20240101000000.manifest")))
+
+	since := time.Now()
+
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240102000000.bundle", "two")
+	writeBackupFile(t, backupDir, "github.com/owner/repo/notes.txt", "")
+
+	report, err = verifyChecksums(t.Context(), local, public)
+	require.NoError(t, err)
+	require.Equal(t, []ChecksumProblem{
+		{Key: "github.com/owner/repo/repo.20240101000000.bundle", Problem: problemModified},
+		{Key: "github.com/owner/repo/repo.20240102000000.bundle", Problem: problemUnexpected},
+		{Key: "github.com/owner/repo/notes.txt", Problem: problemUnexpected},
+		{Key: "github.com/owner/repo/repo.20240101000000.manifest", Problem: problemMissing},
+	}, report.Problems)
+
+	// signing again covers the new backup but keeps the recorded checksum of
+	// the file changed outside soba
+	signer.sign(t.Context(), since)
+	require.Nil(t, signer.result.Error)
+
+	report, err = verifyChecksums(t.Context(), local, public)
+	require.NoError(t, err)
+	require.Equal(t, []ChecksumProblem{
+		{Key: "github.com/owner/repo/repo.20240101000000.bundle", Problem: problemModified},
+		{Key: "github.com/owner/repo/notes.txt", Problem: problemUnexpected},
+	}, report.Problems)
+}
+
+func TestVerifyChecksumsRejectsMovedSignatures(t *testing.T) {
+	backupDir := t.TempDir()
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle", "one")
+	writeBackupFile(t, backupDir, "github.com/owner/copy/repo.20240101000000.bundle", "one")
+
+	local := newLocalStorage(backupDir)
+	signer, public := newTestSigner(t, local)
+
+	require.NoError(t, os.Remove(filepath.Join(backupDir, "github.com", "owner", "copy", "repo.20240101000000.bundle")))
+
+	signer.sign(t.Context(), time.Now())
+	require.Nil(t, signer.result.Error)
+
+	writeBackupFile(t, backupDir, "github.com/owner/copy/repo.20240101000000.bundle", "one")
+
+	for _, name := range []string{checksumsName, checksumsName + signatureSuffix} {
+		b, err := os.ReadFile(filepath.Join(backupDir, "github.com", "owner", "repo", name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(backupDir, "github.com", "owner", "copy", name), b, 0o600))
+	}
+
+	report, err := verifyChecksums(t.Context(), local, public)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	require.Equal(t, "github.com/owner/copy/"+checksumsName, report.Problems[0].Key)
+	require.Equal(t, problemBadSignature, report.Problems[0].Problem)
+
+	// an unsigned directory is reported
+	writeBackupFile(t, backupDir, "github.com/owner/new/new.20240101000000.bundle", "new")
+
+	report, err = verifyChecksums(t.Context(), local, public)
+	require.NoError(t, err)
+	require.Contains(t, report.Problems, ChecksumProblem{Key: "github.com/owner/new", Problem: problemUnsigned})
+}
+
+func TestSigningPublicKey(t *testing.T) {
+	public, _, err := minisign.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	t.Setenv(envSobaSigningPublicKey, "untrusted comment: minisign public key\n"+public.String()+"\n")
+
+	key, err := signingPublicKey()
+	require.NoError(t, err)
+	require.True(t, public.Equal(key))
+
+	t.Setenv(envSobaSigningPublicKey, "invalid")
+
+	_, err = signingPublicKey()
+	require.Error(t, err)
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const commandUsage = `usage: soba [command] [flags]
+
+Without a command soba runs backups, either once or on the configured schedule.
+
+commands:
+  hold       place backups on hold so they are never removed, or release them
+  index      list or link the real paths of obfuscated backups
+  keyring    show how many backups each key in the keyring opens
+  migrate    encrypt or decrypt all existing backups
+  rekey      re-encrypt existing backups with the current key
+  retention  show which backups the retention policy keeps and why
+  verify     check backups against their signed checksums`
+
+// RunCommand runs a maintenance command given on the command line, such as
+// "rekey". Commands take their configuration from the same environment
+// variables as a backup run.
+func RunCommand(args []string) error {
+	switch args[0] {
+	case "hold":
+		return runHold(args[1:])
+	case "index":
+		return runIndex(args[1:])
+	case "keyring":
+		return runKeyring(args[1:])
+	case "migrate":
+		return runMigrate(args[1:])
+	case "rekey":
+		return runRekey(args[1:])
+	case "retention":
+		return runRetention(args[1:])
+	case "verify":
+		return runVerify(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Println(commandUsage)
+
+		return nil
+	default:
+		return errors.Errorf("unknown command %q\n\n%s", strings.Join(args[:1], ""), commandUsage)
+	}
+}
+
+// commandStorage returns the Storage a read-only command inspects: the
+// location given, e.g. an offsite destination such as s3://bucket/prefix,
+// or else the backup directory.
+func commandStorage(location string) (Storage, error) {
+	if location != "" {
+		return openStorage(location)
+	}
+
+	backupDir, err := commandBackupDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return newLocalStorage(backupDir, resolveWorkingDir(backupDir)), nil
+}
+
+// commandBackupDir returns the backup directory a command operates on.
+func commandBackupDir() (string, error) {
+	backupDir, exists := GetEnvOrFile(envGitBackupDir)
+	if !exists || backupDir == "" {
+		return "", errors.Errorf("environment variable %s must be set", envGitBackupDir)
+	}
+
+	return strings.TrimSuffix(backupDir, "\n"), nil
+}
@@ -12,6 +12,11 @@ const (
 	AppName        = "soba"
 	workingDIRName = ".working"
 	workingDIRMode = 0o700
+	// stateDIRName holds soba's own state and reports within the backup
+	// directory.
+	stateDIRName = ".soba"
+	// timeStampFormat matches the timestamp in backup file names.
+	timeStampFormat = "20060102150405"
 	// maxEnvFileSize caps the bytes read from any *_FILE indirection so a
 	// pathological path (e.g. /dev/zero) cannot OOM the process.
 	maxEnvFileSize                         int64 = 1 << 20
@@ -103,6 +108,9 @@ const (
 	providerNameGitLab            = "GitLab"
 	providerNameGitea             = "Gitea"
 	providerNameSourcehut         = "Sourcehut"
+	providerNameGeneric           = "Generic"
+	providerNameLocal             = "Local"
+	providerNameGerrit            = "Gerrit"
 
 	// provider display labels
 	providerLabelAzureDevOps = "Azure DevOps"
@@ -112,7 +120,12 @@ const (
 	compareTypeClone = "clone"
 
 	// encryption
-	envVarBundlePassphrase = "BUNDLE_PASSPHRASE" // nolint:gosec
+	envVarBundlePassphrase    = "BUNDLE_PASSPHRASE"     // nolint:gosec
+	envVarBundlePassphraseOld = "BUNDLE_PASSPHRASE_OLD" // nolint:gosec
+	envVarBundleRecipients    = "BUNDLE_RECIPIENTS"
+	envVarBundleIdentities    = "BUNDLE_IDENTITIES"
+	envVarBundleKeyring       = "BUNDLE_KEYRING"
+	envVarBundleReencrypt     = "BUNDLE_KEYRING_REENCRYPT"
 )
 
 var (
@@ -148,12 +161,24 @@ var (
 			envSourcehutAPIURL,
 			envSourcehutToken,
 		},
+		providerNameGeneric: {
+			envGenericRepos,
+		},
+		providerNameLocal: {
+			envLocalRepoDirs,
+		},
+		providerNameGerrit: {
+			envGerritURL,
+		},
 	}
 	justTokenProviders = []string{
 		providerNameGitHub,
 		providerNameGitLab,
 		providerNameGitea,
 		providerNameSourcehut,
+		providerNameGeneric,
+		providerNameLocal,
+		providerNameGerrit,
 	}
 	userAndPasswordProviders = []string{
 		providerNameBitBucketAPIToken,
@@ -0,0 +1,390 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envSobaDestinations = "SOBA_DESTINATIONS"
+
+	destinationS3     = "s3"
+	destinationSFTP   = "sftp"
+	destinationWebDAV = "webdav"
+
+	// partialUploadSuffix marks a file that is still being written to a
+	// destination. Leftovers from an interrupted run are deleted by the next
+	// sync.
+	partialUploadSuffix = ".part"
+
+	// syncStateDIRName holds the manifest of each destination and mirror in
+	// the state directory. Manifests are not synced themselves.
+	syncStateDIRName = "sync"
+)
+
+// DestinationResult summarises the changes made to a destination during a
+// backup run.
+type DestinationResult struct {
+	Destination string   `json:"destination"`
+	Uploaded    int      `json:"uploaded"`
+	Deleted     int      `json:"deleted"`
+	Error       errors.E `json:"error,omitempty"`
+}
+
+// destinationSyncer mirrors the local backup tree to each configured
+// destination. It is invoked after every provider completes so new bundles
+// leave the host as soon as possible, and accumulates per-destination totals
+// for the run.
+type destinationSyncer struct {
+	stateDir     string
+	source       Storage
+	destinations []Storage
+	results      []DestinationResult
+}
+
+func newDestinationSyncer(backupDir, workingDir string) *destinationSyncer {
+	s := &destinationSyncer{
+		stateDir: backupDir,
+		source:   newLocalStorage(backupDir, workingDir),
+	}
+
+	configured := []struct {
+		kind   string
+		envVar string
+		create func(string) (Storage, error)
+	}{
+		{destinationS3, envS3Bucket, func(v string) (Storage, error) { return newS3Storage(v, os.Getenv(envS3Prefix)) }},
+		{destinationSFTP, envSFTPURL, func(v string) (Storage, error) { return newSFTPStorage(v) }},
+		{destinationWebDAV, envWebDAVURL, func(v string) (Storage, error) { return newWebDAVStorage(v) }},
+	}
+
+	for _, c := range configured {
+		value := os.Getenv(c.envVar)
+		if value == "" || !destinationSelected(c.kind) {
+			continue
+		}
+
+		d, err := c.create(value)
+		if err != nil {
+			s.results = append(s.results, DestinationResult{
+				Destination: c.kind,
+				Error:       errors.Wrapf(err, "failed to configure %s destination", c.kind),
+			})
+
+			continue
+		}
+
+		s.add(d)
+	}
+
+	return s
+}
+
+// destinationSelected reports whether a configured destination should be
+// used for this run. All configured destinations are used unless
+// SOBA_DESTINATIONS lists a subset.
+func destinationSelected(kind string) bool {
+	selected := getOrgsListFromEnvVar(envSobaDestinations)
+	if len(selected) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(selected, func(s string) bool {
+		return strings.EqualFold(strings.TrimSpace(s), kind)
+	})
+}
+
+func (s *destinationSyncer) add(d Storage) {
+	s.destinations = append(s.destinations, d)
+	s.results = append(s.results, DestinationResult{Destination: d.Name()})
+}
+
+// sync uploads new or changed files to every destination and deletes the
+// remote files soba uploaded that no longer exist locally, so retention
+// applied to the backup directory is mirrored offsite.
+func (s *destinationSyncer) sync() {
+	for _, d := range s.destinations {
+		r := s.result(d.Name())
+
+		uploaded, deleted, err := syncTracked(context.Background(), s.stateDir, s.source, d, copyObject)
+		r.Uploaded += uploaded
+		r.Deleted += deleted
+
+		if err != nil {
+			logger.Printf("failed to sync %s: %s", d.Name(), err)
+
+			r.Error = err
+
+			continue
+		}
+
+		logger.Printf("synced %s: %d uploaded, %d deleted", d.Name(), uploaded, deleted)
+	}
+}
+
+// close releases any connections held by the destinations.
+func (s *destinationSyncer) close() {
+	for _, d := range s.destinations {
+		if err := d.Close(); err != nil {
+			logger.Printf("failed to close %s: %s", d.Name(), err)
+		}
+	}
+}
+
+func (s *destinationSyncer) result(name string) *DestinationResult {
+	for i := range s.results {
+		if s.results[i].Destination == name {
+			return &s.results[i]
+		}
+	}
+
+	s.results = append(s.results, DestinationResult{Destination: name})
+
+	return &s.results[len(s.results)-1]
+}
+
+// syncedFile records the size and modification time of a local file when
+// it was last copied to a destination.
+type syncedFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// syncManifest tracks the files soba has copied to a destination, so only
+// those are ever deleted from it and a file rewritten locally, e.g. when
+// re-encrypted, is copied again even if its size is unchanged.
+type syncManifest struct {
+	Files map[string]syncedFile `json:"files"`
+}
+
+// syncManifestState returns the name of the state file holding the manifest
+// of a destination.
+func syncManifestState(name string) string {
+	sum := sha256.Sum256([]byte(name))
+
+	return syncStateDIRName + "/" + hex.EncodeToString(sum[:8]) + ".json"
+}
+
+// loadSyncManifest reads the manifest of a destination from the state
+// directory, returning an empty one if there is none yet.
+func loadSyncManifest(stateDir, name string) (*syncManifest, error) {
+	m := &syncManifest{}
+
+	if _, err := readStateJSON(stateDir, syncManifestState(name), m); err != nil {
+		return nil, err
+	}
+
+	if m.Files == nil {
+		m.Files = make(map[string]syncedFile)
+	}
+
+	return m, nil
+}
+
+// removable reports whether a file on a destination but not in the source
+// may be deleted: it was copied by soba, or it is a partial upload of a file
+// soba copies.
+func (m *syncManifest) removable(key string, inSource map[string]bool) bool {
+	if _, ok := m.Files[key]; ok {
+		return true
+	}
+
+	partial, ok := strings.CutSuffix(key, partialUploadSuffix)
+	if !ok {
+		return false
+	}
+
+	_, tracked := m.Files[partial]
+
+	return tracked || inSource[partial]
+}
+
+// copyFunc copies a single object from src to dst.
+type copyFunc func(ctx context.Context, src, dst Storage, o ObjectInfo) error
+
+// syncTracked syncs src to dst using the manifest of dst kept in stateDir,
+// saving the manifest again even if the sync fails part way.
+func syncTracked(ctx context.Context, stateDir string, src, dst Storage, copyFn copyFunc) (copied, deleted int, err errors.E) {
+	manifest, mErr := loadSyncManifest(stateDir, dst.Name())
+	if mErr != nil {
+		return 0, 0, errors.WithMessage(mErr, "failed to read sync manifest")
+	}
+
+	copied, deleted, err = syncStorage(ctx, src, dst, manifest, copyFn)
+
+	if wErr := writeStateJSON(stateDir, syncManifestState(dst.Name()), manifest); wErr != nil && err == nil {
+		err = errors.WithMessage(wErr, "failed to write sync manifest")
+	}
+
+	return copied, deleted, err
+}
+
+// changedDirs returns the directories holding a file in local that is not
+// tracked or has changed since it was last copied, or a tracked file that
+// is no longer in local.
+func (m *syncManifest) changedDirs(local []ObjectInfo) map[string]bool {
+	dirs := make(map[string]bool)
+	inSource := make(map[string]bool, len(local))
+
+	for _, o := range local {
+		inSource[o.Key] = true
+
+		if synced, ok := m.Files[o.Key]; !ok || synced.Size != o.Size || !synced.ModTime.Equal(o.ModTime) {
+			dirs[path.Dir(o.Key)] = true
+		}
+	}
+
+	for key := range m.Files {
+		if !inSource[key] {
+			dirs[path.Dir(key)] = true
+		}
+	}
+
+	return dirs
+}
+
+// listChanged lists the files of dst in the directories that changed
+// locally since the last sync, going by the manifest, so a sync costs a
+// listing per changed repository rather than of every file offsite. With
+// an empty manifest, as on the first sync, dst is listed in full.
+func listChanged(ctx context.Context, dst Storage, manifest *syncManifest, local []ObjectInfo) ([]ObjectInfo, func(string) bool, error) {
+	if len(manifest.Files) == 0 {
+		objects, err := dst.List(ctx, "")
+
+		return objects, func(string) bool { return true }, err
+	}
+
+	dirs := manifest.changedDirs(local)
+	changed := func(key string) bool { return dirs[path.Dir(key)] }
+
+	var objects []ObjectInfo
+
+	for dir := range dirs {
+		prefix := dir + "/"
+		if dir == "." {
+			prefix = ""
+		}
+
+		listed, err := dst.List(ctx, prefix)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// a listing includes any subdirectories, which are synced on their
+		// own if they changed
+		for _, o := range listed {
+			if changed(o.Key) {
+				objects = append(objects, o)
+			}
+		}
+	}
+
+	return objects, changed, nil
+}
+
+// syncStorage copies files from src that are missing from dst, differ in
+// size or were modified locally since they were last copied. Files are only
+// deleted from dst if the manifest shows soba copied them there and they
+// have since been removed from src, e.g. by retention, and never if src
+// holds no backups at all, as after losing or failing to mount the disk.
+// Partial uploads of files soba tracks are removed as well. Only the
+// directories that changed locally since the last sync are compared.
+func syncStorage(ctx context.Context, src, dst Storage, manifest *syncManifest, copyFn copyFunc) (copied, deleted int, err errors.E) {
+	all, lErr := src.List(ctx, "")
+	if lErr != nil {
+		return 0, 0, errors.Wrapf(lErr, "failed to list %s", src.Name())
+	}
+
+	local := slices.DeleteFunc(all, func(o ObjectInfo) bool {
+		return strings.HasPrefix(o.Key, stateDIRName+"/"+syncStateDIRName+"/")
+	})
+
+	remoteObjects, changed, lErr := listChanged(ctx, dst, manifest, local)
+	if lErr != nil {
+		return 0, 0, errors.Wrapf(lErr, "failed to list %s", dst.Name())
+	}
+
+	remote := make(map[string]int64, len(remoteObjects))
+	for _, o := range remoteObjects {
+		remote[o.Key] = o.Size
+	}
+
+	inSource := make(map[string]bool, len(local))
+	hasBackups := false
+
+	for _, o := range local {
+		inSource[o.Key] = true
+
+		if !strings.HasPrefix(o.Key, stateDIRName+"/") {
+			hasBackups = true
+		}
+
+		if !changed(o.Key) {
+			continue
+		}
+
+		remoteSize, onRemote := remote[o.Key]
+		synced, tracked := manifest.Files[o.Key]
+
+		// files already present before soba tracked them are adopted
+		if onRemote && remoteSize == o.Size && (!tracked || (synced.Size == o.Size && synced.ModTime.Equal(o.ModTime))) {
+			manifest.Files[o.Key] = syncedFile{Size: o.Size, ModTime: o.ModTime}
+
+			continue
+		}
+
+		if cErr := copyFn(ctx, src, dst, o); cErr != nil {
+			return copied, deleted, errors.WithMessagef(cErr, "failed to copy %s", o.Key)
+		}
+
+		manifest.Files[o.Key] = syncedFile{Size: o.Size, ModTime: o.ModTime}
+		copied++
+	}
+
+	for key := range manifest.Files {
+		if _, ok := remote[key]; !ok && !inSource[key] && changed(key) {
+			delete(manifest.Files, key)
+		}
+	}
+
+	if !hasBackups {
+		return copied, deleted, nil
+	}
+
+	for _, o := range remoteObjects {
+		if inSource[o.Key] {
+			continue
+		}
+
+		if !manifest.removable(o.Key, inSource) {
+			continue
+		}
+
+		if dErr := dst.Delete(ctx, o.Key); dErr != nil {
+			return copied, deleted, errors.WithMessagef(dErr, "failed to delete %s", o.Key)
+		}
+
+		delete(manifest.Files, o.Key)
+		deleted++
+	}
+
+	return copied, deleted, nil
+}
+
+func copyObject(ctx context.Context, src, dst Storage, o ObjectInfo) error {
+	r, err := src.Get(ctx, o.Key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+
+	return dst.Put(ctx, o.Key, r, o.Size)
+}
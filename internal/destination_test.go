@@ -0,0 +1,394 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// memoryStorage is an in-memory Storage used to exercise the sync logic
+// without a remote service.
+type memoryStorage struct {
+	objects map[string][]byte
+	// listed records the prefix of each listing
+	listed []string
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{objects: make(map[string][]byte)}
+}
+
+func (m *memoryStorage) Name() string { return "memory" }
+
+func (m *memoryStorage) List(_ context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	m.listed = append(m.listed, prefix)
+
+	for k, v := range m.objects {
+		if strings.HasPrefix(k, prefix) {
+			objects = append(objects, ObjectInfo{Key: k, Size: int64(len(v))})
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	return objects, nil
+}
+
+func (m *memoryStorage) Put(_ context.Context, key string, r io.Reader, _ int64) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.objects[key] = b
+
+	return nil
+}
+
+func (m *memoryStorage) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	b, ok := m.objects[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *memoryStorage) Delete(_ context.Context, key string) error {
+	delete(m.objects, key)
+
+	return nil
+}
+
+func (m *memoryStorage) Stat(_ context.Context, key string) (ObjectInfo, error) {
+	b, ok := m.objects[key]
+	if !ok {
+		return ObjectInfo{}, fs.ErrNotExist
+	}
+
+	return ObjectInfo{Key: key, Size: int64(len(b))}, nil
+}
+
+func (m *memoryStorage) Close() error { return nil }
+
+func writeBackupFile(t *testing.T, backupDir, rel, content string) {
+	t.Helper()
+
+	p := filepath.Join(backupDir, filepath.FromSlash(rel))
+	require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o700))
+	require.NoError(t, os.WriteFile(p, []byte(content), 0o600))
+}
+
+func TestDestinationSyncUploadsAndMirrorsDeletions(t *testing.T) {
+	backupDir := t.TempDir()
+	workingDir := filepath.Join(backupDir, workingDIRName)
+
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle", "one")
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240102000000.bundle", "two")
+	writeBackupFile(t, backupDir, workingDIRName+"/clone/HEAD", "transient")
+
+	dest := newMemoryStorage()
+	syncer := &destinationSyncer{stateDir: backupDir, source: newLocalStorage(backupDir, workingDir)}
+	syncer.add(dest)
+
+	syncer.sync()
+	require.Len(t, dest.objects, 2)
+	require.Equal(t, "one", string(dest.objects["github.com/owner/repo/repo.20240101000000.bundle"]))
+	require.NotContains(t, dest.objects, workingDIRName+"/clone/HEAD")
+
+	// retention removes the oldest bundle locally and a new one is written
+	require.NoError(t, os.Remove(filepath.Join(backupDir, "github.com/owner/repo/repo.20240101000000.bundle")))
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240103000000.bundle", "three")
+
+	syncer.sync()
+	require.Len(t, dest.objects, 2)
+	require.NotContains(t, dest.objects, "github.com/owner/repo/repo.20240101000000.bundle")
+	require.Contains(t, dest.objects, "github.com/owner/repo/repo.20240103000000.bundle")
+
+	require.Len(t, syncer.results, 1)
+	require.Nil(t, syncer.results[0].Error)
+	require.Equal(t, 3, syncer.results[0].Uploaded)
+	require.Equal(t, 1, syncer.results[0].Deleted)
+}
+
+func TestSyncStorageOnlyDeletesTrackedFiles(t *testing.T) {
+	backupDir := t.TempDir()
+	bundle := "github.com/owner/repo/repo.20240101000000.bundle"
+	writeBackupFile(t, backupDir, bundle, "one")
+
+	dest := newMemoryStorage()
+	dest.objects["other/unrelated.txt"] = []byte("keep")
+	dest.objects["github.com/owner/repo/repo.20231201000000.bundle"] = []byte("old")
+	dest.objects[bundle+partialUploadSuffix] = []byte("o")
+
+	manifest := &syncManifest{Files: make(map[string]syncedFile)}
+
+	copied, deleted, err := syncStorage(t.Context(), newLocalStorage(backupDir), dest, manifest, copyObject)
+	require.NoError(t, err)
+	require.Equal(t, 1, copied)
+	require.Equal(t, 1, deleted)
+	require.Contains(t, dest.objects, "other/unrelated.txt")
+	require.Contains(t, dest.objects, "github.com/owner/repo/repo.20231201000000.bundle")
+	require.NotContains(t, dest.objects, bundle+partialUploadSuffix)
+
+	// a file rewritten with the same size is copied again
+	writeBackupFile(t, backupDir, bundle, "two")
+	require.NoError(t, os.Chtimes(filepath.Join(backupDir, bundle), time.Now(), time.Now().Add(time.Hour)))
+
+	copied, _, err = syncStorage(t.Context(), newLocalStorage(backupDir), dest, manifest, copyObject)
+	require.NoError(t, err)
+	require.Equal(t, 1, copied)
+	require.Equal(t, "two", string(dest.objects[bundle]))
+
+	// nothing is deleted when the backup directory is empty
+	require.NoError(t, os.RemoveAll(filepath.Join(backupDir, "github.com")))
+
+	copied, deleted, err = syncStorage(t.Context(), newLocalStorage(backupDir), dest, manifest, copyObject)
+	require.NoError(t, err)
+	require.Zero(t, copied)
+	require.Zero(t, deleted)
+	require.Contains(t, dest.objects, bundle)
+
+	// tracked files removed locally are deleted once other backups exist
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240102000000.bundle", "three")
+
+	copied, deleted, err = syncStorage(t.Context(), newLocalStorage(backupDir), dest, manifest, copyObject)
+	require.NoError(t, err)
+	require.Equal(t, 1, copied)
+	require.Equal(t, 1, deleted)
+	require.NotContains(t, dest.objects, bundle)
+	require.Contains(t, dest.objects, "other/unrelated.txt")
+}
+
+func TestSyncStorageListsChangedDirs(t *testing.T) {
+	backupDir := t.TempDir()
+	writeBackupFile(t, backupDir, "github.com/owner/a/a.20240101000000.bundle", "a")
+	writeBackupFile(t, backupDir, "github.com/owner/b/b.20240101000000.bundle", "b")
+
+	dest := newMemoryStorage()
+	manifest := &syncManifest{Files: make(map[string]syncedFile)}
+
+	// the first sync lists the destination in full
+	copied, _, err := syncStorage(t.Context(), newLocalStorage(backupDir), dest, manifest, copyObject)
+	require.NoError(t, err)
+	require.Equal(t, 2, copied)
+	require.Equal(t, []string{""}, dest.listed)
+
+	// later syncs only list the directories that changed
+	dest.listed = nil
+
+	writeBackupFile(t, backupDir, "github.com/owner/a/a.20240102000000.bundle", "a2")
+	require.NoError(t, os.Remove(filepath.Join(backupDir, "github.com/owner/a/a.20240101000000.bundle")))
+
+	copied, deleted, err := syncStorage(t.Context(), newLocalStorage(backupDir), dest, manifest, copyObject)
+	require.NoError(t, err)
+	require.Equal(t, 1, copied)
+	require.Equal(t, 1, deleted)
+	require.Equal(t, []string{"github.com/owner/a/"}, dest.listed)
+	require.Contains(t, dest.objects, "github.com/owner/b/b.20240101000000.bundle")
+
+	dest.listed = nil
+
+	copied, deleted, err = syncStorage(t.Context(), newLocalStorage(backupDir), dest, manifest, copyObject)
+	require.NoError(t, err)
+	require.Zero(t, copied)
+	require.Zero(t, deleted)
+	require.Empty(t, dest.listed)
+}
+
+func TestDestinationSelected(t *testing.T) {
+	t.Setenv(envSobaDestinations, "")
+	require.True(t, destinationSelected(destinationS3))
+	require.True(t, destinationSelected(destinationSFTP))
+
+	t.Setenv(envSobaDestinations, "sftp, WebDAV")
+	require.False(t, destinationSelected(destinationS3))
+	require.True(t, destinationSelected(destinationSFTP))
+	require.True(t, destinationSelected(destinationWebDAV))
+}
+
+func TestListRemoteTree(t *testing.T) {
+	root := t.TempDir()
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101000000.bundle", "bundle")
+	writeBackupFile(t, root, "gitlab.com/group/project/project.20240101000000.manifest", "manifest!")
+
+	readDir := func(dir string) ([]os.FileInfo, error) {
+		entries, err := os.ReadDir(filepath.FromSlash(dir))
+		if err != nil {
+			return nil, err
+		}
+
+		infos := make([]os.FileInfo, 0, len(entries))
+
+		for _, e := range entries {
+			info, iErr := e.Info()
+			if iErr != nil {
+				return nil, iErr
+			}
+
+			infos = append(infos, info)
+		}
+
+		return infos, nil
+	}
+
+	files, err := listRemoteTree(filepath.ToSlash(root), "", readDir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	require.Equal(t, "github.com/owner/repo/repo.20240101000000.bundle", files[0].Key)
+	require.EqualValues(t, 6, files[0].Size)
+	require.Equal(t, "gitlab.com/group/project/project.20240101000000.manifest", files[1].Key)
+	require.EqualValues(t, 9, files[1].Size)
+
+	files, err = listRemoteTree(filepath.ToSlash(root), "gitlab.com/gr", readDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, "gitlab.com/group/project/project.20240101000000.manifest", files[0].Key)
+}
+
+func TestWebDAVStorageWithHTTPTest(t *testing.T) {
+	root := t.TempDir()
+	srv := httptest.NewServer(&webdav.Handler{
+		FileSystem: webdav.Dir(root),
+		LockSystem: webdav.NewMemLS(),
+	})
+	t.Cleanup(srv.Close)
+
+	d, err := newWebDAVStorage(srv.URL + "/")
+	require.NoError(t, err)
+
+	backupDir := t.TempDir()
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle", "bundle")
+
+	writeBackupFile(t, backupDir, "github.com/owner/other/other.20240101000000.bundle", "other")
+
+	uploaded, deleted, sErr := syncTracked(t.Context(), backupDir, newLocalStorage(backupDir), d, copyObject)
+	require.Nil(t, sErr)
+	require.Equal(t, 2, uploaded)
+	require.Zero(t, deleted)
+	require.FileExists(t, filepath.Join(root, "github.com/owner/repo/repo.20240101000000.bundle"))
+	require.NoFileExists(t, filepath.Join(root, "github.com/owner/repo/repo.20240101000000.bundle"+partialUploadSuffix))
+
+	info, err := d.Stat(t.Context(), "github.com/owner/repo/repo.20240101000000.bundle")
+	require.NoError(t, err)
+	require.EqualValues(t, 6, info.Size)
+
+	_, err = d.Stat(t.Context(), "github.com/owner/repo/missing.bundle")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, os.RemoveAll(filepath.Join(backupDir, "github.com/owner/repo")))
+
+	uploaded, deleted, sErr = syncTracked(t.Context(), backupDir, newLocalStorage(backupDir), d, copyObject)
+	require.Nil(t, sErr)
+	require.Zero(t, uploaded)
+	require.Equal(t, 1, deleted)
+	require.NoFileExists(t, filepath.Join(root, "github.com/owner/repo/repo.20240101000000.bundle"))
+}
+
+func TestS3ServerSideEncryption(t *testing.T) {
+	t.Setenv(envS3SSE, "")
+
+	sse, err := s3ServerSideEncryption()
+	require.NoError(t, err)
+	require.Nil(t, sse)
+
+	t.Setenv(envS3SSE, "aes256")
+
+	sse, err = s3ServerSideEncryption()
+	require.NoError(t, err)
+	require.NotNil(t, sse)
+
+	t.Setenv(envS3SSE, "invalid")
+
+	_, err = s3ServerSideEncryption()
+	require.Error(t, err)
+}
+
+func TestS3PartSize(t *testing.T) {
+	t.Setenv(envS3PartSize, "")
+
+	size, err := s3PartSize()
+	require.NoError(t, err)
+	require.Zero(t, size)
+
+	t.Setenv(envS3PartSize, "16")
+
+	size, err = s3PartSize()
+	require.NoError(t, err)
+	require.Equal(t, uint64(16<<20), size)
+
+	for _, value := range []string{"4", "0", "-1", "large", "6000"} {
+		t.Setenv(envS3PartSize, value)
+
+		_, err = s3PartSize()
+		require.ErrorContains(t, err, envS3PartSize)
+	}
+}
+
+// TestS3DestinationWithMinIO runs the S3 destination against a real S3
+// compatible endpoint, e.g. a local MinIO started with:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//
+// It is skipped unless SOBA_S3_TEST_ENDPOINT is set.
+func TestS3DestinationWithMinIO(t *testing.T) {
+	endpoint := os.Getenv("SOBA_S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("skipping S3 test; set SOBA_S3_TEST_ENDPOINT, SOBA_S3_ACCESS_KEY_ID, SOBA_S3_SECRET_ACCESS_KEY and SOBA_S3_BUCKET to run")
+	}
+
+	t.Setenv(envS3Endpoint, endpoint)
+	t.Setenv(envS3Insecure, "true")
+	t.Setenv(envS3PathStyle, "true")
+	t.Setenv(envS3Prefix, "soba-test")
+
+	backupDir := t.TempDir()
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle", "bundle")
+
+	syncer := newDestinationSyncer(backupDir, filepath.Join(backupDir, workingDIRName))
+	require.Len(t, syncer.destinations, 1)
+
+	syncer.sync()
+	require.Nil(t, syncer.results[0].Error)
+	require.Equal(t, 1, syncer.results[0].Uploaded)
+
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240102000000.bundle", "bundle")
+	require.NoError(t, os.Remove(filepath.Join(backupDir, "github.com/owner/repo/repo.20240101000000.bundle")))
+
+	syncer.sync()
+	require.Nil(t, syncer.results[0].Error)
+	require.Equal(t, 1, syncer.results[0].Deleted)
+}
+
+func TestNewSFTPStorageValidation(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(knownHosts, nil, 0o600))
+	t.Setenv(envSFTPKnownHosts, knownHosts)
+	t.Setenv(envSFTPPrivateKey, "")
+	t.Setenv(envSFTPPassword, "")
+
+	_, err := newSFTPStorage("https://backup.example.com/soba")
+	require.Error(t, err)
+
+	_, err = newSFTPStorage("sftp://soba@backup.example.com/soba")
+	require.ErrorContains(t, err, envSFTPPassword)
+
+	t.Setenv(envSFTPPassword, "secret")
+
+	d, err := newSFTPStorage("sftp://soba@backup.example.com:2222/soba")
+	require.NoError(t, err)
+	require.Equal(t, "sftp://soba@backup.example.com:2222/soba", d.Name())
+}
@@ -7,6 +7,9 @@ import (
 	"strings"
 )
 
+// envFileSuffix is appended to a variable's name to read its value from a file.
+const envFileSuffix = "_FILE"
+
 // GetEnvOrFile returns the value of the environment variable if set, otherwise
 // if a corresponding _FILE variable is set, reads the value from the file at
 // that path. Files larger than maxEnvFileSize are rejected to prevent
@@ -21,7 +24,7 @@ func GetEnvOrFile(envVar string) (string, bool) {
 		return "", exists
 	}
 
-	fileEnv := envVar + "_FILE"
+	fileEnv := envVar + envFileSuffix
 
 	filePath := os.Getenv(fileEnv)
 	if filePath == "" {
@@ -0,0 +1,492 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/jonhadfield/githosts-utils/v2"
+	"github.com/peterhellberg/link"
+	"gitlab.com/tozd/go/errors"
+)
+
+// exportExtension is the extension of the gzipped JSON archives holding the
+// data soba exports from a provider's API, such as issues, which are not
+// part of a repository's git history.
+const exportExtension = ".json.gz"
+
+// exportSuffixes are the suffixes of the directories exported data is
+// stored in next to a repository's own, e.g. owner/repo.issues.
+var exportSuffixes = []string{wikiSuffix, issuesSuffix, snippetsSuffix, releasesSuffix, metadataSuffix}
+
+// errAPIUnavailable is returned for a 404 or 410 response, which providers
+// send for a feature disabled in a repository, e.g. GitHub issues.
+var errAPIUnavailable = errors.Base("not available")
+
+// errAPIForbidden is returned for a 403 response other than for exceeding a
+// rate limit, which providers send when the token lacks a permission.
+var errAPIForbidden = errors.Base("forbidden")
+
+// apiClient makes authenticated requests to a provider's REST API.
+type apiClient struct {
+	baseURL string
+	header  http.Header
+}
+
+// get decodes the response to a GET of the path, relative to the API's
+// base URL, into v, or if v is a *[]byte reads it unaltered.
+func (c apiClient) get(ctx context.Context, p string, query url.Values, v any) error {
+	_, err := c.do(ctx, c.url(p, query), v)
+
+	return err
+}
+
+// getPages decodes each page of a paginated list into a slice passed to
+// each, following the Link header's next page until there are no more or
+// each returns false.
+func (c apiClient) getPages(ctx context.Context, p string, query url.Values, each func([]json.RawMessage) bool) error {
+	next := c.url(p, query)
+
+	for next != "" {
+		var page []json.RawMessage
+
+		resp, err := c.do(ctx, next, &page)
+		if err != nil {
+			return err
+		}
+
+		if !each(page) {
+			return nil
+		}
+
+		next = ""
+		if l, ok := link.ParseResponse(resp)["next"]; ok {
+			next = l.URI
+		}
+	}
+
+	return nil
+}
+
+// appendPage returns a page callback for apiClient.getPages collecting
+// every object into objects.
+func appendPage(objects *[]json.RawMessage) func([]json.RawMessage) bool {
+	return func(page []json.RawMessage) bool {
+		*objects = append(*objects, page...)
+
+		return true
+	}
+}
+
+func (c apiClient) url(p string, query url.Values) string {
+	u := strings.TrimSuffix(c.baseURL, "/") + "/" + strings.TrimPrefix(p, "/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	return u
+}
+
+func (c apiClient) do(ctx context.Context, u string, v any) (*http.Response, error) {
+	if httpClient == nil {
+		httpClient = getHTTPClient(os.Getenv(envSobaLogLevel))
+	}
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for k, values := range c.header {
+		for _, value := range values {
+			req.Header.Add(k, value)
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, errors.WithMessagef(errAPIUnavailable, "GET %s returned %s", req.URL.Path, resp.Status)
+	}
+
+	if resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-Ratelimit-Remaining") != "0" {
+		return nil, errors.WithMessagef(errAPIForbidden, "GET %s returned %s", req.URL.Path, resp.Status)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512)) //nolint:mnd
+
+		return nil, errors.Errorf("GET %s returned %s: %s", req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// raw content, e.g. a snippet, is returned as is
+	if b, ok := v.(*[]byte); ok {
+		if *b, err = io.ReadAll(resp.Body); err != nil {
+			return nil, errors.Wrapf(err, "failed to read response from %s", req.URL.Path)
+		}
+
+		return resp, nil
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode response from %s", req.URL.Path)
+	}
+
+	return resp, nil
+}
+
+// mergeByKey adds the objects in updated to existing, replacing any with the
+// same value of the given key, e.g. id, and returns them ordered by it.
+func mergeByKey(existing, updated []json.RawMessage, key string) []json.RawMessage {
+	byKey := make(map[string]json.RawMessage, len(existing)+len(updated))
+
+	for _, objects := range [][]json.RawMessage{existing, updated} {
+		for _, o := range objects {
+			var fields map[string]json.RawMessage
+			if json.Unmarshal(o, &fields) != nil {
+				continue
+			}
+
+			byKey[string(fields[key])] = o
+		}
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+
+	// numeric keys sort by length first so 10 follows 9
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) < len(keys[j])
+		}
+
+		return keys[i] < keys[j]
+	})
+
+	merged := make([]json.RawMessage, 0, len(keys))
+	for _, k := range keys {
+		merged = append(merged, byKey[k])
+	}
+
+	return merged
+}
+
+// existingBackups returns the storage and directory holding the earlier
+// backups of a repository directory. Providers write to the staging
+// directory when paths are obfuscated, which links only the latest
+// backups' files, so earlier backups are read from their obfuscated
+// directory instead.
+func existingBackups(backupDir, dir string) (*localStorage, string) {
+	if !obfuscatePaths() {
+		return newLocalStorage(backupDir, resolveWorkingDir(backupDir)), dir
+	}
+
+	root, err := commandBackupDir()
+	if err != nil {
+		return newLocalStorage(backupDir, resolveWorkingDir(backupDir)), dir
+	}
+
+	key, err := pathKey()
+	if err != nil {
+		return newLocalStorage(backupDir, resolveWorkingDir(backupDir)), dir
+	}
+
+	return newLocalStorage(root, resolveWorkingDir(root)), obfuscateDir(key, dir)
+}
+
+// exportRepos calls export for each repository backed up successfully,
+// adding a result for each named after the directory its archives are
+// stored in, e.g. owner/repo.issues, so they are listed, and checked for
+// missing upstream, like any other backup.
+func exportRepos(results *githosts.ProviderBackupResult, domain, suffix string, export func(ctx context.Context, repo string) error) {
+	ctx := context.Background()
+
+	var exported []githosts.RepoBackupResults
+
+	for _, r := range results.BackupResults {
+		repo := strings.TrimPrefix(listedRepoPath(r.Repo), domain+"/")
+		if r.Error != nil || repo == "" || slices.ContainsFunc(exportSuffixes, func(s string) bool {
+			return strings.HasSuffix(repo, s)
+		}) {
+			continue
+		}
+
+		if err := export(ctx, repo); err != nil {
+			logger.Printf("failed to export %s%s: %s", repo, suffix, err)
+
+			exported = append(exported, githosts.RepoBackupResults{Repo: repo + suffix, Status: repoStatusFailed, Error: errors.WithStack(err)})
+
+			continue
+		}
+
+		exported = append(exported, githosts.RepoBackupResults{Repo: repo + suffix, Status: repoStatusOK})
+	}
+
+	results.BackupResults = append(results.BackupResults, exported...)
+}
+
+// exportHeader identifies an exported archive and when its data was
+// fetched.
+type exportHeader struct {
+	Version    int       `json:"version"`
+	Repository string    `json:"repository"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+func (h *exportHeader) header() *exportHeader {
+	return h
+}
+
+// exportArchive is the data exported for a repository, embedding its
+// exportHeader.
+type exportArchive interface {
+	header() *exportHeader
+}
+
+// exportsState records the digest of the latest archive in each export
+// directory, so a change can be detected without reading the archive back,
+// which is not possible once it is encrypted to BUNDLE_RECIPIENTS.
+const exportsState = "exports.json"
+
+// exportState is the latest archive stored in an export directory.
+type exportState struct {
+	Timestamp  string    `json:"timestamp"`
+	SHA256     string    `json:"sha256"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// updateExport reads the latest archive in a repository directory into
+// archive and calls fetch with the time it was exported, or the zero time
+// if there is no readable archive of the same version, to merge in what
+// has changed since. A new archive is stored only if its digest differs
+// from that of the latest archive, as recorded in the state directory. The
+// timestamp of the latest archive, new or not, is returned.
+func updateExport(ctx context.Context, s *localStorage, dir, backupsEnvVar string, archive exportArchive,
+	fetch func(since time.Time) error,
+) (string, error) {
+	h := archive.header()
+	version, repository := h.Version, h.Repository
+
+	existing, existingDir := existingBackups(s.root, dir)
+
+	objects, err := existing.List(ctx, existingDir+"/")
+	if err != nil {
+		return "", err
+	}
+
+	sets := groupBackupSets(objects)[existingDir]
+
+	states := map[string]exportState{}
+
+	if _, err = readStateJSON(existing.root, exportsState, &states); err != nil {
+		return "", err
+	}
+
+	var (
+		since    time.Time
+		previous string
+	)
+
+	if len(sets) > 0 {
+		if state, ok := states[existingDir]; ok && state.Timestamp == sets[0].timestamp {
+			previous = state.SHA256
+		}
+
+		found, rErr := readExport(ctx, existing, sets[0], archive)
+		if rErr != nil {
+			logger.Printf("%s, exporting everything", rErr)
+		}
+
+		if found && rErr == nil && h.Version == version {
+			since = h.ExportedAt
+
+			if previous == "" {
+				if previous, err = exportDigest(archive); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+
+	started := time.Now().UTC()
+
+	if err = fetch(since); err != nil {
+		return "", err
+	}
+
+	h.Version, h.Repository = version, repository
+
+	digest, err := exportDigest(archive)
+	if err != nil {
+		return "", err
+	}
+
+	if digest == previous {
+		return sets[0].timestamp, nil
+	}
+
+	h.ExportedAt = started
+
+	timestamp, err := writeExport(ctx, s, dir, archive)
+	if err != nil {
+		return "", err
+	}
+
+	states[existingDir] = exportState{Timestamp: timestamp, SHA256: digest, ExportedAt: started}
+
+	if err = writeStateJSON(existing.root, exportsState, states); err != nil {
+		return "", err
+	}
+
+	return timestamp, rotateBackups(ctx, existing, sets, backupsEnvVar)
+}
+
+// exportDigest returns the SHA-256 of an archive, ignoring when it was
+// exported.
+func exportDigest(archive exportArchive) (string, error) {
+	h := archive.header()
+
+	exportedAt := h.ExportedAt
+	h.ExportedAt = time.Time{}
+
+	b, err := json.Marshal(archive)
+
+	h.ExportedAt = exportedAt
+
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readExport decodes the archive in a backup set into v, returning false if
+// the set has none or it is encrypted to a key soba does not hold.
+func readExport(ctx context.Context, s Storage, set *backupSet, v any) (bool, error) {
+	key := set.key(exportExtension)
+	if !slices.Contains(set.keys, key) {
+		key += ageSuffix
+	}
+
+	if !slices.Contains(set.keys, key) {
+		return false, nil
+	}
+
+	f, err := s.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var r io.Reader = f
+
+	if strings.HasSuffix(key, ageSuffix) {
+		ring, kErr := loadKeyring(envVarBundlePassphrase)
+		if kErr != nil {
+			return false, nil //nolint:nilerr
+		}
+
+		if r, _, err = ring.decrypt(f); err != nil {
+			return false, errors.WithMessagef(err, "can not decrypt %s", key)
+		}
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return false, errors.WithMessagef(err, "failed to read %s", key)
+	}
+
+	if err = json.NewDecoder(gz).Decode(v); err != nil {
+		return false, errors.WithMessagef(err, "failed to read %s", key)
+	}
+
+	return true, nil
+}
+
+// writeExport stores v as a new gzipped JSON archive in a repository
+// directory, encrypted with BUNDLE_PASSPHRASE if set, returning its
+// timestamp.
+func writeExport(ctx context.Context, s *localStorage, dir string, v any) (string, error) {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+
+	enc := json.NewEncoder(gz)
+	enc.SetIndent("", " ")
+
+	if err := enc.Encode(v); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if err := gz.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	timestamp := time.Now().UTC().Format(timeStampFormat)
+	key := path.Join(dir, path.Base(dir)+"."+timestamp+exportExtension)
+
+	return timestamp, storeBackupFile(ctx, s, &buf, key)
+}
+
+// rotateBackups removes the oldest of a repository's previous backup sets,
+// newest first, once a new backup has been stored, keeping as many as the
+// provider is configured to. githosts only rotates the repositories it
+// backs up itself.
+func rotateBackups(ctx context.Context, s Storage, previous []*backupSet, backupsEnvVar string) error {
+	keep := providerBackupsToRetain(backupsEnvVar)
+	if len(previous)+1 <= keep {
+		return nil
+	}
+
+	for _, set := range previous[max(keep-1, 0):] {
+		for _, k := range set.keys {
+			if err := removeBackupFile(ctx, s, k); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// storeBackupFile writes a backup file, encrypting it with
+// BUNDLE_PASSPHRASE as githosts does for repositories. Encryption to
+// BUNDLE_RECIPIENTS is applied later along with every other new backup.
+func storeBackupFile(ctx context.Context, s *localStorage, r io.Reader, key string) error {
+	passphrase, _ := GetEnvOrFile(envVarBundlePassphrase)
+	if passphrase == "" {
+		return s.Put(ctx, key, r, -1)
+	}
+
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	encrypted := encryptingReader(r, recipient)
+	defer func() { _ = encrypted.Close() }()
+
+	return s.Put(ctx, key+ageSuffix, encrypted, -1)
+}
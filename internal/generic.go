@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envGenericRepos     = "GENERIC_REPOS"
+	envGenericUsername  = "GENERIC_USERNAME"
+	envGenericPassword  = "GENERIC_PASSWORD" // nolint:gosec
+	envGenericSSHKey    = "GENERIC_SSH_KEY"
+	envGenericBackups   = "GENERIC_BACKUPS"
+	envGenericBackupLFS = "GENERIC_BACKUP_LFS"
+)
+
+// Generic backs up each repository listed in GENERIC_REPOS from its clone
+// URL, for git servers without an API soba supports. Each is stored at
+// <host>/<path> and, with no API to list them, is cloned on every run and
+// compared with the latest backup by its refs.
+func Generic(backupDir string) *ProviderBackupResults {
+	logger.Println("backing up generic repos")
+
+	list, exists := GetEnvOrFile(envGenericRepos)
+
+	cloneURLs := genericCloneURLs(list)
+	if !exists || len(cloneURLs) == 0 {
+		logger.Println("Skipping generic backup as", envGenericRepos, "is missing")
+
+		return &ProviderBackupResults{
+			Provider: providerNameGeneric,
+			Results: githosts.ProviderBackupResult{
+				BackupResults: []githosts.RepoBackupResults{},
+				Error:         errors.New("generic repositories are not set"),
+			},
+		}
+	}
+
+	username, _ := GetEnvOrFile(envGenericUsername)
+	password, _ := GetEnvOrFile(envGenericPassword)
+	sshKey, _ := GetEnvOrFile(envGenericSSHKey)
+
+	remote := gitRemote{username: username, password: password, sshKey: sshKey, lfs: envTrue(envGenericBackupLFS)}
+
+	return &ProviderBackupResults{
+		Provider: providerNameGeneric,
+		Results:  backupGenericRepos(backupDir, remote, cloneURLs),
+	}
+}
+
+// backupGenericRepos backs up each clone URL, adding a result for each
+// under its <host>/<path>.
+func backupGenericRepos(backupDir string, remote gitRemote, cloneURLs []string) githosts.ProviderBackupResult {
+	ctx := context.Background()
+	storage := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+	results := githosts.ProviderBackupResult{BackupResults: []githosts.RepoBackupResults{}}
+	seen := make(map[string]bool)
+
+	for _, cloneURL := range cloneURLs {
+		repo, err := genericRepoPath(cloneURL)
+		if err != nil {
+			logger.Printf("skipping generic repo %s: %s", redactURL(cloneURL), err)
+
+			results.BackupResults = append(results.BackupResults,
+				githosts.RepoBackupResults{Repo: redactURL(cloneURL), Status: repoStatusFailed, Error: errors.WithStack(err)})
+
+			continue
+		}
+
+		if seen[repo] {
+			continue
+		}
+
+		seen[repo] = true
+
+		found, err := backupGitRepo(ctx, storage, remote, cloneURL, repo, envGenericBackups)
+
+		switch {
+		case err != nil:
+			logger.Printf("failed to back up %s: %s", repo, err)
+
+			results.BackupResults = append(results.BackupResults,
+				githosts.RepoBackupResults{Repo: repo, Status: repoStatusFailed, Error: errors.WithStack(err)})
+		case found:
+			results.BackupResults = append(results.BackupResults, githosts.RepoBackupResults{Repo: repo, Status: repoStatusOK})
+		default:
+			logger.Printf("skipping empty repository %s", repo)
+		}
+	}
+
+	return results
+}
+
+// genericCloneURLs splits a list of clone URLs separated by commas or
+// whitespace, such as one per line in a file.
+func genericCloneURLs(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+}
+
+// genericRepoPath returns the <host>/<path> a clone URL is backed up to,
+// accepting URLs such as https://host/path.git and ssh://git@host:22/path
+// as well as the scp-like git@host:path. Ports, credentials and a trailing
+// .git are dropped.
+func genericRepoPath(cloneURL string) (string, error) {
+	var host, p string
+
+	if u, err := url.Parse(cloneURL); err == nil && u.Scheme != "" && u.Host != "" {
+		host, p = u.Hostname(), u.Path
+	} else if at, rest, ok := strings.Cut(cloneURL, ":"); ok && !strings.Contains(at, "/") && !strings.HasPrefix(rest, "//") {
+		// scp-like syntax, user@host:path
+		host, p = at[strings.LastIndex(at, "@")+1:], rest
+	}
+
+	p = strings.TrimSuffix(strings.Trim(path.Clean("/"+p), "/"), ".git")
+	if host == "" || p == "" || p == "." {
+		return "", errors.New("unsupported clone URL")
+	}
+
+	return path.Join(strings.ToLower(host), p), nil
+}
+
+// redactURL removes any password from a URL so it can be logged.
+func redactURL(s string) string {
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+
+	return s
+}
@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envGerritURL             = "GERRIT_URL"
+	envGerritUsername        = "GERRIT_USERNAME"
+	envGerritPassword        = "GERRIT_PASSWORD" // nolint:gosec
+	envGerritProjects        = "GERRIT_PROJECTS"
+	envGerritExcludeProjects = "GERRIT_EXCLUDE_PROJECTS"
+	envGerritBackupChanges   = "GERRIT_BACKUP_CHANGES"
+	envGerritBackups         = "GERRIT_BACKUPS"
+	envGerritBackupLFS       = "GERRIT_BACKUP_LFS"
+
+	// gerritPageSize is the number of projects requested at a time.
+	gerritPageSize = 500
+)
+
+// gerritXSSIPrefix precedes every JSON response from Gerrit's REST API.
+var gerritXSSIPrefix = []byte(")]}'")
+
+// gerritChangeRefspecs exclude the refs holding each change's patch sets
+// and review metadata, which are only fetched with GERRIT_BACKUP_CHANGES.
+var gerritChangeRefspecs = []string{"+refs/*:refs/*", "^refs/changes/*"}
+
+// gerritSource is a Gerrit server and how its projects are backed up.
+type gerritSource struct {
+	client  apiClient
+	remote  gitRemote
+	baseURL string
+	domain  string
+	include []string
+	exclude []string
+}
+
+// Gerrit backs up the projects of the Gerrit server at GERRIT_URL, filtered
+// by GERRIT_PROJECTS and GERRIT_EXCLUDE_PROJECTS. Each is stored at
+// <host>/<project>, without its review changes unless GERRIT_BACKUP_CHANGES
+// is set.
+func Gerrit(backupDir string) *ProviderBackupResults {
+	logger.Println("backing up Gerrit repos")
+
+	source, err := gerritSourceFromEnv()
+	if err != nil {
+		logger.Println("Skipping Gerrit backup:", err)
+
+		return &ProviderBackupResults{
+			Provider: providerNameGerrit,
+			Results: githosts.ProviderBackupResult{
+				BackupResults: []githosts.RepoBackupResults{},
+				Error:         errors.WithStack(err),
+			},
+		}
+	}
+
+	return &ProviderBackupResults{
+		Provider: providerNameGerrit,
+		Results:  backupGerritProjects(backupDir, source),
+	}
+}
+
+// gerritSourceFromEnv reads the Gerrit server and credentials to back up
+// from the environment. Without credentials only anonymously readable
+// projects are backed up.
+func gerritSourceFromEnv() (gerritSource, error) {
+	baseURL, _ := GetEnvOrFile(envGerritURL)
+	baseURL = strings.TrimSuffix(strings.TrimSpace(baseURL), "/")
+
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return gerritSource{}, errors.Errorf("%s must be the URL of the Gerrit server", envGerritURL)
+	}
+
+	include, err := gerritProjectPatterns(envGerritProjects)
+	if err != nil {
+		return gerritSource{}, err
+	}
+
+	exclude, err := gerritProjectPatterns(envGerritExcludeProjects)
+	if err != nil {
+		return gerritSource{}, err
+	}
+
+	username, _ := GetEnvOrFile(envGerritUsername)
+	password, _ := GetEnvOrFile(envGerritPassword)
+
+	source := gerritSource{
+		client:  apiClient{baseURL: baseURL},
+		remote:  gitRemote{username: username, password: password, lfs: envTrue(envGerritBackupLFS)},
+		baseURL: baseURL,
+		domain:  strings.ToLower(u.Hostname()),
+		include: include,
+		exclude: exclude,
+	}
+
+	// authenticated requests are made to the /a/ endpoints
+	if password != "" {
+		source.baseURL += "/a"
+		source.client = apiClient{
+			baseURL: source.baseURL,
+			header: http.Header{"Authorization": {
+				"Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)),
+			}},
+		}
+	}
+
+	if !envTrue(envGerritBackupChanges) {
+		source.remote.refspecs = gerritChangeRefspecs
+	}
+
+	return source, nil
+}
+
+// gerritProjectPatterns returns the project name patterns in envVar,
+// separated by commas or whitespace, checking each is a valid pattern.
+func gerritProjectPatterns(envVar string) ([]string, error) {
+	list, _ := GetEnvOrFile(envVar)
+
+	patterns := strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Errorf("%s has an invalid pattern %q", envVar, pattern)
+		}
+	}
+
+	return patterns, nil
+}
+
+// backupGerritProjects backs up each project on the server matching the
+// source's filters, adding a result for each.
+func backupGerritProjects(backupDir string, source gerritSource) githosts.ProviderBackupResult {
+	ctx := context.Background()
+	results := githosts.ProviderBackupResult{BackupResults: []githosts.RepoBackupResults{}}
+
+	projects, err := listGerritProjects(ctx, source.client)
+	if err != nil {
+		logger.Printf("failed to list Gerrit projects: %s", err)
+
+		results.Error = errors.WithStack(err)
+
+		return results
+	}
+
+	storage := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+
+	for _, project := range projects {
+		if !source.matches(project) {
+			continue
+		}
+
+		repo := path.Join(source.domain, project)
+
+		found, bErr := backupGitRepo(ctx, storage, source.remote, source.cloneURL(project), repo, envGerritBackups)
+
+		switch {
+		case bErr != nil:
+			logger.Printf("failed to back up %s: %s", repo, bErr)
+
+			results.BackupResults = append(results.BackupResults,
+				githosts.RepoBackupResults{Repo: repo, Status: repoStatusFailed, Error: errors.WithStack(bErr)})
+		case found:
+			results.BackupResults = append(results.BackupResults, githosts.RepoBackupResults{Repo: repo, Status: repoStatusOK})
+		}
+	}
+
+	return results
+}
+
+// matches reports whether a project is to be backed up: it matches an
+// include pattern, or there are none, and no exclude pattern.
+func (s gerritSource) matches(project string) bool {
+	match := func(pattern string) bool {
+		ok, _ := path.Match(pattern, project)
+
+		return ok
+	}
+
+	return (len(s.include) == 0 || slices.ContainsFunc(s.include, match)) && !slices.ContainsFunc(s.exclude, match)
+}
+
+// cloneURL returns the git URL of a project, which Gerrit serves at the
+// same path as its REST API.
+func (s gerritSource) cloneURL(project string) string {
+	segments := strings.Split(project, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return s.baseURL + "/" + strings.Join(segments, "/")
+}
+
+// listGerritProjects returns the names of every project the client can
+// read, in order.
+func listGerritProjects(ctx context.Context, c apiClient) ([]string, error) {
+	var names []string
+
+	for {
+		var body []byte
+
+		query := url.Values{"n": {strconv.Itoa(gerritPageSize)}, "S": {strconv.Itoa(len(names))}}
+		if err := c.get(ctx, "projects/", query, &body); err != nil {
+			return nil, err
+		}
+
+		var page map[string]struct {
+			MoreProjects bool `json:"_more_projects"`
+		}
+
+		if err := json.Unmarshal(bytes.TrimPrefix(body, gerritXSSIPrefix), &page); err != nil {
+			return nil, errors.WithMessage(err, "failed to decode Gerrit projects")
+		}
+
+		more := false
+
+		for name, project := range page {
+			names = append(names, name)
+			more = more || project.MoreProjects
+		}
+
+		if !more || len(page) == 0 {
+			break
+		}
+	}
+
+	slices.Sort(names)
+
+	return names, nil
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// newGerritServer serves a list of projects and their repositories over
+// dumb HTTP under /a/, as an authenticated Gerrit server would. Projects
+// are listed one per page to exercise paging, and each repository has a
+// branch and a change ref.
+func newGerritServer(t *testing.T, projects []string) string {
+	t.Helper()
+
+	root := t.TempDir()
+
+	for _, project := range projects {
+		work := filepath.Join(t.TempDir(), "work")
+
+		runGit(t, "", "init", "-q", work)
+		gitCommit(t, work, "init")
+		runGit(t, "", "clone", "-q", "--bare", work, filepath.Join(root, project))
+		runGit(t, filepath.Join(root, project), "update-ref", "refs/changes/01/1/1", "HEAD")
+		runGit(t, filepath.Join(root, project), "update-server-info")
+	}
+
+	files := http.StripPrefix("/a", http.FileServer(http.Dir(root)))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "backup" || password != "secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+
+		if r.URL.Path != "/a/projects/" {
+			files.ServeHTTP(w, r)
+
+			return
+		}
+
+		skip, _ := strconv.Atoi(r.URL.Query().Get("S"))
+
+		_, _ = w.Write([]byte(")]}'\n"))
+
+		switch {
+		case skip >= len(projects):
+			_, _ = w.Write([]byte(`{}`))
+		case skip == len(projects)-1:
+			_, _ = w.Write([]byte(`{"` + projects[skip] + `":{"state":"ACTIVE"}}`))
+		default:
+			_, _ = w.Write([]byte(`{"` + projects[skip] + `":{"state":"ACTIVE","_more_projects":true}}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+// bundleHeads returns the refs in the latest bundle of a repository.
+func bundleHeads(t *testing.T, backupDir, dir string) string {
+	t.Helper()
+
+	objects, err := newLocalStorage(backupDir, resolveWorkingDir(backupDir)).List(t.Context(), dir+"/")
+	require.NoError(t, err)
+
+	sets := groupBackupSets(objects)[dir]
+	require.NotEmpty(t, sets)
+
+	out, err := exec.CommandContext(t.Context(), "git", "bundle", "list-heads",
+		filepath.Join(backupDir, sets[0].key(bundleExtension))).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	return string(out)
+}
+
+func TestBackupGerritProjects(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	serverURL := newGerritServer(t, []string{"platform/build", "platform/manifest", "tools/repo"})
+
+	t.Setenv(envGerritURL, serverURL+"/")
+	t.Setenv(envGerritUsername, "backup")
+	t.Setenv(envGerritPassword, "secret")
+	t.Setenv(envGerritProjects, "platform/*")
+	t.Setenv(envGerritExcludeProjects, "*/manifest")
+	t.Setenv(envGerritBackupChanges, "")
+
+	source, err := gerritSourceFromEnv()
+	require.NoError(t, err)
+
+	backupDir := t.TempDir()
+
+	results := backupGerritProjects(backupDir, source)
+	require.NoError(t, results.Error)
+	require.Equal(t, []githosts.RepoBackupResults{{Repo: "127.0.0.1/platform/build", Status: repoStatusOK}}, results.BackupResults)
+	require.NotContains(t, bundleHeads(t, backupDir, "127.0.0.1/platform/build"), "refs/changes/")
+
+	// review changes are kept when enabled
+	t.Setenv(envGerritProjects, "tools/*")
+	t.Setenv(envGerritBackupChanges, "true")
+
+	source, err = gerritSourceFromEnv()
+	require.NoError(t, err)
+
+	results = backupGerritProjects(backupDir, source)
+	require.Equal(t, []githosts.RepoBackupResults{{Repo: "127.0.0.1/tools/repo", Status: repoStatusOK}}, results.BackupResults)
+	require.Contains(t, bundleHeads(t, backupDir, "127.0.0.1/tools/repo"), "refs/changes/01/1/1")
+
+	// listing fails without credentials
+	t.Setenv(envGerritPassword, "")
+
+	source, err = gerritSourceFromEnv()
+	require.NoError(t, err)
+	require.Error(t, backupGerritProjects(backupDir, source).Error)
+}
+
+func TestGerritSourceFromEnv(t *testing.T) {
+	t.Setenv(envGerritURL, "review.example.com")
+
+	_, err := gerritSourceFromEnv()
+	require.Error(t, err)
+
+	t.Setenv(envGerritURL, "https://review.example.com:8443/gerrit")
+	t.Setenv(envGerritProjects, "[")
+
+	_, err = gerritSourceFromEnv()
+	require.Error(t, err)
+
+	t.Setenv(envGerritProjects, "")
+	t.Setenv(envGerritPassword, "")
+
+	source, err := gerritSourceFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, "review.example.com", source.domain)
+	require.Equal(t, "https://review.example.com:8443/gerrit/platform/my%20project", source.cloneURL("platform/my project"))
+	require.Equal(t, gerritChangeRefspecs, source.remote.refspecs)
+	require.True(t, source.matches("anything"))
+
+	t.Setenv(envGerritUsername, "backup")
+	t.Setenv(envGerritPassword, "secret")
+
+	source, err = gerritSourceFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, "https://review.example.com:8443/gerrit/a/platform/build", source.cloneURL("platform/build"))
+}
@@ -0,0 +1,339 @@
+package internal
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	// retention variables are named <prefix>_RETENTION_KEEP_<period>, where
+	// the prefix is SOBA for the global policy or the provider's prefix, e.g.
+	// GITHUB, to override it for one provider.
+	globalRetentionPrefix = "SOBA"
+	retentionKeepInfix    = "_RETENTION_KEEP_"
+	backupsEnvVarSuffix   = "_BACKUPS"
+
+	retentionLast    = "LAST"
+	retentionDaily   = "DAILY"
+	retentionWeekly  = "WEEKLY"
+	retentionMonthly = "MONTHLY"
+	retentionYearly  = "YEARLY"
+	retentionWithin  = "WITHIN"
+
+	hoursPerWeek = 7 * hoursPerDay
+)
+
+// retentionPolicy is a grandfather-father-son policy: the newest Last
+// backups are kept, along with the newest backup in each of the most recent
+// Daily days, Weekly ISO weeks, Monthly months and Yearly years, and every
+// backup made within the Within period.
+type retentionPolicy struct {
+	Last    int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	Within  time.Duration
+}
+
+// gfsConfigured reports whether any grandfather-father-son retention
+// variable is set, globally or for a provider, directly or with _FILE.
+func gfsConfigured() bool {
+	for _, e := range os.Environ() {
+		name, _, _ := strings.Cut(e, "=")
+		if !strings.Contains(name, retentionKeepInfix) {
+			continue
+		}
+
+		if value, _ := GetEnvOrFile(strings.TrimSuffix(name, envFileSuffix)); value != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retentionPolicyFor returns the policy for the provider whose backup count
+// is set by backupsEnvVar, e.g. GITHUB_BACKUPS. Each provider variable
+// overrides the global one. Without a keep last setting the provider's
+// backup count is used.
+func retentionPolicyFor(backupsEnvVar string) retentionPolicy {
+	prefixes := []string{globalRetentionPrefix}
+
+	if backupsEnvVar != "" {
+		prefixes = []string{strings.TrimSuffix(backupsEnvVar, backupsEnvVarSuffix), globalRetentionPrefix}
+	}
+
+	lookupValue := func(period string, parse func(string) (int64, error)) (int64, bool) {
+		for _, prefix := range prefixes {
+			name := prefix + retentionKeepInfix + period
+
+			value, _ := GetEnvOrFile(name)
+			if value == "" {
+				continue
+			}
+
+			n, err := parse(value)
+			if err != nil || n < 0 {
+				logger.Printf("ignoring invalid value %q for %s", value, name)
+
+				continue
+			}
+
+			return n, true
+		}
+
+		return 0, false
+	}
+
+	lookup := func(period string) (int, bool) {
+		n, ok := lookupValue(period, func(v string) (int64, error) { return strconv.ParseInt(v, 10, 32) })
+
+		return int(n), ok
+	}
+
+	var p retentionPolicy
+
+	within, _ := lookupValue(retentionWithin, func(v string) (int64, error) {
+		d, err := parseRetentionAge(v)
+
+		return int64(d), err
+	})
+	p.Within = time.Duration(within)
+
+	p.Daily, _ = lookup(retentionDaily)
+	p.Weekly, _ = lookup(retentionWeekly)
+	p.Monthly, _ = lookup(retentionMonthly)
+	p.Yearly, _ = lookup(retentionYearly)
+
+	last, ok := lookup(retentionLast)
+
+	switch {
+	case ok:
+		p.Last = last
+	case backupsEnvVar != "":
+		p.Last = getBackupsToRetain(backupsEnvVar)
+	default:
+		p.Last = defaultBackupsToRetain
+	}
+
+	return p
+}
+
+// parseRetentionAge parses an age given in days, e.g. 90 or 90d, in weeks,
+// e.g. 12w, or as a Go duration, e.g. 36h.
+func parseRetentionAge(value string) (time.Duration, error) {
+	if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil {
+		return time.Duration(days) * hoursPerDay * time.Hour, nil
+	}
+
+	if weeks, err := strconv.Atoi(strings.TrimSuffix(value, "w")); err == nil {
+		return time.Duration(weeks) * hoursPerWeek * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	return d, nil
+}
+
+func formatRetentionAge(d time.Duration) string {
+	if day := hoursPerDay * time.Hour; d%day == 0 {
+		return strconv.Itoa(int(d/day)) + "d"
+	}
+
+	return d.String()
+}
+
+func (p retentionPolicy) String() string {
+	s := fmt.Sprintf("last %d, daily %d, weekly %d, monthly %d, yearly %d",
+		p.Last, p.Daily, p.Weekly, p.Monthly, p.Yearly)
+
+	if p.Within > 0 {
+		s += ", within " + formatRetentionAge(p.Within)
+	}
+
+	return s
+}
+
+// explain returns, for each backup set, ordered newest first, the reasons
+// it is kept. A set with no reasons is removed. With an age limit, the
+// newest backup is always kept, even if older than the limit.
+func (p retentionPolicy) explain(sets []*backupSet, now time.Time) [][]string {
+	reasons := make([][]string, len(sets))
+	times := make([]time.Time, len(sets))
+
+	for i, set := range sets {
+		if i < p.Last {
+			reasons[i] = append(reasons[i], "last")
+		}
+
+		t, err := time.Parse(timeStampFormat, set.timestamp)
+		if err != nil {
+			// never remove a backup whose age is unknown
+			reasons[i] = append(reasons[i], "unreadable timestamp")
+		}
+
+		times[i] = t
+
+		if p.Within > 0 && err == nil && now.Sub(t) <= p.Within {
+			reasons[i] = append(reasons[i], "within "+formatRetentionAge(p.Within))
+		}
+	}
+
+	if p.Within > 0 && len(sets) > 0 && len(reasons[0]) == 0 {
+		reasons[0] = []string{"latest"}
+	}
+
+	periods := []struct {
+		name   string
+		keep   int
+		bucket func(time.Time) string
+	}{
+		{"daily", p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", p.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	for _, period := range periods {
+		seen := make(map[string]bool)
+
+		for i := range sets {
+			if len(seen) >= period.keep {
+				break
+			}
+
+			if times[i].IsZero() {
+				continue
+			}
+
+			if bucket := period.bucket(times[i]); !seen[bucket] {
+				seen[bucket] = true
+				reasons[i] = append(reasons[i], period.name+" "+bucket)
+			}
+		}
+	}
+
+	return reasons
+}
+
+// runRetention explains, without removing anything, which backups the
+// retention policy keeps and why.
+func runRetention(args []string) error {
+	flags := flag.NewFlagSet("retention", flag.ContinueOnError)
+	provider := flags.String("provider", "", "apply the overrides of a provider, e.g. GITHUB")
+	location := flags.String("storage", "", "inspect a copy elsewhere, e.g. s3://bucket/prefix, instead of "+envGitBackupDir)
+
+	flags.Usage = func() {
+		_, _ = io.WriteString(flags.Output(), "usage: soba retention [-provider PREFIX] [-storage LOCATION] [path prefix]\n\n"+
+			"Shows which backups under "+envGitBackupDir+" the retention policy keeps and why, without\n"+
+			"removing anything.\n\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+
+		return errors.WithStack(err)
+	}
+
+	s, err := commandStorage(*location)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = s.Close() }()
+
+	backupsEnvVar := ""
+	if *provider != "" {
+		backupsEnvVar = strings.ToUpper(*provider) + backupsEnvVarSuffix
+	}
+
+	policy := retentionPolicyFor(backupsEnvVar)
+
+	prefix := flags.Arg(0)
+
+	// the path index is only kept in the backup directory
+	if obfuscatePaths() {
+		backupDir, bErr := commandBackupDir()
+		if bErr != nil {
+			return bErr
+		}
+
+		if prefix, err = storagePath(backupDir, prefix); err != nil {
+			return err
+		}
+	}
+
+	objects, err := s.List(context.Background(), prefix)
+	if err != nil {
+		return errors.Wrap(err, "failed to list backups")
+	}
+
+	fmt.Printf("policy: %s\n", policy)
+
+	return explainRetention(context.Background(), os.Stdout, s, objects, policy, time.Now())
+}
+
+// explainRetention writes the decision for each backup in objects.
+func explainRetention(ctx context.Context, w io.Writer, s Storage, objects []ObjectInfo, policy retentionPolicy, now time.Time) error {
+	byDir := groupBackupSets(objects)
+	held := readHolds(ctx, s, objects)
+
+	dirs := make([]string, 0, len(byDir))
+	for dir := range byDir {
+		dirs = append(dirs, dir)
+	}
+
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		sets := byDir[dir]
+		reasons := policy.explain(sets, now)
+
+		if _, err := fmt.Fprintf(w, "\n%s\n", dir); err != nil {
+			return errors.WithStack(err)
+		}
+
+		for i, set := range sets {
+			action := "keep  "
+
+			if info, ok := held.held(set, now); ok {
+				reasons[i] = append(reasons[i], info.String())
+			}
+
+			switch {
+			case len(reasons[i]) > 0:
+			case len(lockedKeys(ctx, s, set.keys, now)) > 0:
+				reasons[i] = []string{"locked"}
+			default:
+				action = "remove"
+			}
+
+			line := strings.TrimRight(fmt.Sprintf("  %s  %s  %s", action, set.timestamp, strings.Join(reasons[i], ", ")), " ")
+
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionPolicyExplain(t *testing.T) {
+	var sets []*backupSet
+
+	// hourly backups over three days, newest first
+	start := time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)
+	for i := range 72 {
+		sets = append(sets, &backupSet{timestamp: start.Add(-time.Duration(i) * time.Hour).Format(timeStampFormat)})
+	}
+
+	reasons := retentionPolicy{Last: 2, Daily: 3, Monthly: 2}.explain(sets, start)
+
+	require.Equal(t, []string{"last", "daily 2024-01-31", "monthly 2024-01"}, reasons[0])
+	require.Equal(t, []string{"last"}, reasons[1])
+	require.Empty(t, reasons[2])
+	require.Equal(t, []string{"daily 2024-01-30"}, reasons[24])
+	require.Equal(t, []string{"daily 2024-01-29"}, reasons[48])
+
+	kept := 0
+
+	for _, r := range reasons {
+		if len(r) > 0 {
+			kept++
+		}
+	}
+
+	// the monthly backup for January is already the newest daily one, and
+	// there is no backup from another month
+	require.Equal(t, 4, kept)
+}
+
+func TestRetentionPolicyFor(t *testing.T) {
+	t.Setenv(envGitHubBackups, "5")
+	t.Setenv("SOBA_RETENTION_KEEP_DAILY", "7")
+	t.Setenv("SOBA_RETENTION_KEEP_WEEKLY", "4")
+	t.Setenv("GITHUB_RETENTION_KEEP_WEEKLY", "8")
+	t.Setenv("SOBA_RETENTION_KEEP_MONTHLY", "invalid")
+
+	require.True(t, gfsConfigured())
+	require.Equal(t, retentionPolicy{Last: 5, Daily: 7, Weekly: 8}, retentionPolicyFor(envGitHubBackups))
+	require.Equal(t, retentionPolicy{Last: defaultBackupsToRetain, Daily: 7, Weekly: 4}, retentionPolicyFor(""))
+
+	t.Setenv("SOBA_RETENTION_KEEP_LAST", "1")
+	require.Equal(t, 1, retentionPolicyFor(envGitHubBackups).Last)
+	require.Equal(t, unlimitedBackupsToRetain, providerBackupsToRetain(envGitHubBackups))
+}
+
+func TestRetentionPolicyFromFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "daily")
+	require.NoError(t, os.WriteFile(file, []byte("3\n"), 0o600))
+
+	t.Setenv("GITHUB_RETENTION_KEEP_DAILY_FILE", file)
+
+	require.True(t, gfsConfigured())
+	require.Equal(t, 3, retentionPolicyFor(envGitHubBackups).Daily)
+}
+
+func TestApplyRetentionWithPolicy(t *testing.T) {
+	root := t.TempDir()
+	s := newLocalStorage(root)
+
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20231231120000.bundle", "1")
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101090000.bundle", "2")
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101100000.bundle", "3")
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101110000.bundle", "4")
+
+	policy := retentionPolicy{Last: 1, Yearly: 2}
+
+	objects, err := s.List(t.Context(), "")
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+
+	require.NoError(t, explainRetention(t.Context(), &out, s, objects, policy, time.Now()))
+	require.Equal(t, `
+github.com/owner/repo
+  keep    20240101110000  last, yearly 2024
+  remove  20240101100000
+  remove  20240101090000
+  keep    20231231120000  yearly 2023
+`, out.String())
+
+	var result RetentionResult
+
+	applyRetention(t.Context(), s, policy, time.Time{}, nil, time.Now(), &result)
+	require.Nil(t, result.Error)
+	require.Equal(t, 2, result.Deleted)
+	require.FileExists(t, filepath.Join(root, "github.com/owner/repo/repo.20231231120000.bundle"))
+	require.NoFileExists(t, filepath.Join(root, "github.com/owner/repo/repo.20240101090000.bundle"))
+}
+
+func TestRetentionPolicyWithin(t *testing.T) {
+	t.Setenv("SOBA_RETENTION_KEEP_WITHIN", "90d")
+	t.Setenv("GITHUB_RETENTION_KEEP_WITHIN", "2w")
+	t.Setenv("SOBA_RETENTION_KEEP_LAST", "0")
+
+	require.Equal(t, retentionPolicy{Within: 90 * 24 * time.Hour}, retentionPolicyFor(""))
+	require.Equal(t, retentionPolicy{Within: 14 * 24 * time.Hour}, retentionPolicyFor(envGitHubBackups))
+
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	sets := []*backupSet{
+		{timestamp: "20240530000000"},
+		{timestamp: "20240401000000"},
+		{timestamp: "20240101000000"},
+	}
+
+	reasons := retentionPolicy{Within: 90 * 24 * time.Hour}.explain(sets, now)
+	require.Equal(t, [][]string{{"within 90d"}, {"within 90d"}, nil}, reasons)
+
+	// the newest backup is kept even when older than the limit
+	reasons = retentionPolicy{Within: 24 * time.Hour}.explain(sets, now)
+	require.Equal(t, [][]string{{"latest"}, nil, nil}, reasons)
+}
+
+func TestParseRetentionAge(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"90":  90 * 24 * time.Hour,
+		"90d": 90 * 24 * time.Hour,
+		"12w": 12 * 7 * 24 * time.Hour,
+		"36h": 36 * time.Hour,
+	} {
+		got, err := parseRetentionAge(value)
+		require.NoError(t, err, value)
+		require.Equal(t, want, got, value)
+	}
+
+	_, err := parseRetentionAge("soon")
+	require.Error(t, err)
+}
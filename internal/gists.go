@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"path"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envGitHubBackupGists        = "GITHUB_BACKUP_GISTS"
+	envGitHubBackupStarredGists = "GITHUB_BACKUP_STARRED_GISTS"
+
+	gistsDIRName = "gists"
+)
+
+// gist holds the fields of a gist needed to back it up.
+type gist struct {
+	ID         string `json:"id"`
+	GitPullURL string `json:"git_pull_url"`
+	Owner      struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+}
+
+// backupGitHubGists backs up the gists of the token's user, and the gists
+// they have starred if enabled, adding a result for each and failing the
+// provider if they can not be listed. A gist is stored
+// as a repository at <owner>/gists/<id>, so it is encrypted, compared and
+// rotated like any other backup.
+func backupGitHubGists(backupDir, token string, starred bool, results *githosts.ProviderBackupResult) {
+	ctx := context.Background()
+	client, domain := gitHubAPIClient(token)
+	storage := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+	remote := gitRemote{username: "x-access-token", password: token}
+
+	lists := []string{gistsDIRName}
+	if starred {
+		lists = append(lists, gistsDIRName+"/starred")
+	}
+
+	var (
+		gists  []gist
+		backed []githosts.RepoBackupResults
+		ok     int
+	)
+
+	seen := make(map[string]bool)
+
+	for _, list := range lists {
+		err := client.getPages(ctx, list, url.Values{"per_page": {gitHubPageSize}}, func(page []json.RawMessage) bool {
+			for _, o := range page {
+				var g gist
+				if json.Unmarshal(o, &g) != nil || g.ID == "" || g.GitPullURL == "" || g.Owner.Login == "" || seen[g.ID] {
+					continue
+				}
+
+				seen[g.ID] = true
+				gists = append(gists, g)
+			}
+
+			return true
+		})
+		if err != nil {
+			logger.Printf("failed to list %s: %s", list, err)
+
+			// the provider's listing is incomplete, so its repositories must
+			// not be checked for missing upstream
+			if results.Error == nil {
+				results.Error = errors.WithMessagef(err, "failed to list %s", list)
+			}
+		}
+	}
+
+	for _, g := range gists {
+		repo := path.Join(g.Owner.Login, gistsDIRName, g.ID)
+
+		found, err := backupGitRepo(ctx, storage, remote, g.GitPullURL, path.Join(domain, repo), envGitHubBackups)
+
+		switch {
+		case errors.Is(err, errRepoNotFound):
+		case err != nil:
+			logger.Printf("failed to back up gist %s: %s", repo, err)
+
+			backed = append(backed, githosts.RepoBackupResults{Repo: repo, Status: repoStatusFailed, Error: errors.WithStack(err)})
+		case found:
+			backed = append(backed, githosts.RepoBackupResults{Repo: repo, Status: repoStatusOK})
+			ok++
+		}
+	}
+
+	if ok > 0 {
+		logger.Printf("backed up %d gists", ok)
+	}
+
+	results.BackupResults = append(results.BackupResults, backed...)
+}
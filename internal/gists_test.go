@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupGitHubGists(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	remote := t.TempDir()
+
+	for _, id := range []string{"aaa", "bbb"} {
+		dir := filepath.Join(remote, id+".git")
+
+		out, err := exec.CommandContext(t.Context(), "git", "init", "-q", dir).CombinedOutput()
+		require.NoError(t, err, string(out))
+		gitCommit(t, dir, "gist "+id)
+	}
+
+	gist := func(id, owner string) string {
+		return `{"id":"` + id + `","git_pull_url":"file://` + filepath.Join(remote, id+".git") + `","owner":{"login":"` + owner + `"}}`
+	}
+
+	forbidden := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case forbidden:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		case r.URL.Path == "/gists":
+			_, _ = w.Write([]byte("[" + gist("aaa", "jane") + "]"))
+		case r.URL.Path == "/gists/starred":
+			_, _ = w.Write([]byte("[" + gist("aaa", "jane") + "," + gist("bbb", "joe") + "]"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv(envGitHubAPIURL, server.URL)
+	t.Setenv(envGitHubBackups, "2")
+
+	backupDir := t.TempDir()
+
+	var results githosts.ProviderBackupResult
+
+	backupGitHubGists(backupDir, "token", false, &results)
+	require.Equal(t, []githosts.RepoBackupResults{{Repo: "jane/gists/aaa", Status: repoStatusOK}}, results.BackupResults)
+
+	results = githosts.ProviderBackupResult{}
+
+	backupGitHubGists(backupDir, "token", true, &results)
+	require.Equal(t, []githosts.RepoBackupResults{
+		{Repo: "jane/gists/aaa", Status: repoStatusOK},
+		{Repo: "joe/gists/bbb", Status: repoStatusOK},
+	}, results.BackupResults)
+
+	objects, err := newLocalStorage(backupDir, resolveWorkingDir(backupDir)).List(t.Context(), "")
+	require.NoError(t, err)
+
+	sets := groupBackupSets(objects)
+	require.Len(t, sets["127.0.0.1/jane/gists/aaa"], 1)
+	require.Len(t, sets["127.0.0.1/joe/gists/bbb"], 1)
+
+	// a failed listing fails the provider
+	forbidden = true
+
+	results = githosts.ProviderBackupResult{}
+
+	backupGitHubGists(backupDir, "token", false, &results)
+	require.Error(t, results.Error)
+	require.Empty(t, results.BackupResults)
+}
@@ -33,7 +33,7 @@ func Gitea(backupDir string) *ProviderBackupResults {
 		DiffRemoteMethod:     os.Getenv(envGiteaCompare),
 		Token:                giteaToken,
 		Orgs:                 getOrgsListFromEnvVar(envGiteaOrgs),
-		BackupsToRetain:      getBackupsToRetain(envGiteaBackups),
+		BackupsToRetain:      providerBackupsToRetain(envGiteaBackups),
 		LogLevel:             getLogLevel(),
 		BackupLFS:            envTrue(envGiteaBackupLFS),
 		EncryptionPassphrase: bundlePassphrase,
@@ -48,8 +48,22 @@ func Gitea(backupDir string) *ProviderBackupResults {
 		}
 	}
 
+	results := giteaHost.Backup()
+
+	if envTrue(envGiteaBackupWikis) {
+		backupWikis(backupDir, giteaWikiSource(giteaToken), &results)
+	}
+
+	if envTrue(envGiteaBackupReleases) {
+		exportReleases(backupDir, giteaReleaseSource(giteaToken), &results)
+	}
+
+	if envTrue(envGiteaBackupMetadata) {
+		exportMetadata(backupDir, giteaMetadataSource(giteaToken), &results)
+	}
+
 	return &ProviderBackupResults{
 		Provider: providerNameGitea,
-		Results:  giteaHost.Backup(),
+		Results:  results,
 	}
 }
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"net/http"
 	"os"
 
 	"github.com/jonhadfield/githosts-utils/v2"
@@ -34,7 +35,7 @@ func GitHub(backupDir string) *ProviderBackupResults {
 		DiffRemoteMethod:     os.Getenv(envGitHubCompare),
 		Token:                ghToken,
 		Orgs:                 getOrgsListFromEnvVar(envGitHubOrgs),
-		BackupsToRetain:      getBackupsToRetain(envGitHubBackups),
+		BackupsToRetain:      providerBackupsToRetain(envGitHubBackups),
 		SkipUserRepos:        envTrue(envGitHubSkipUserRepos),
 		LimitUserOwned:       envTrue(envGitHubLimitUserOwned),
 		LogLevel:             getLogLevel(),
@@ -51,8 +52,51 @@ func GitHub(backupDir string) *ProviderBackupResults {
 		}
 	}
 
+	results := githubHost.Backup()
+
+	if envTrue(envGitHubBackupWikis) {
+		backupWikis(backupDir, gitHubWikiSource(ghToken), &results)
+	}
+
+	if envTrue(envGitHubBackupIssues) {
+		exportGitHubIssues(backupDir, ghToken, &results)
+	}
+
+	if envTrue(envGitHubBackupReleases) {
+		exportReleases(backupDir, gitHubReleaseSource(ghToken), &results)
+	}
+
+	if envTrue(envGitHubBackupMetadata) {
+		exportMetadata(backupDir, gitHubMetadataSource(ghToken), &results)
+	}
+
+	// gists are backed up last as they have no wiki or issues of their own
+	if envTrue(envGitHubBackupGists) {
+		backupGitHubGists(backupDir, ghToken, envTrue(envGitHubBackupStarredGists), &results)
+	}
+
 	return &ProviderBackupResults{
 		Provider: providerNameGitHub,
-		Results:  githubHost.Backup(),
+		Results:  results,
+	}
+}
+
+// gitHubAPIClient returns a client for the GitHub REST API and the domain
+// GitHub's backups are stored under.
+func gitHubAPIClient(token string) (apiClient, string) {
+	apiURL := os.Getenv(envGitHubAPIURL)
+	if apiURL == "" {
+		apiURL = "https://api.github.com"
 	}
+
+	_, domain := wikiBaseURL(apiURL, "https://api.github.com")
+
+	return apiClient{
+		baseURL: apiURL,
+		header: http.Header{
+			"Authorization":        {"Bearer " + token},
+			"Accept":               {"application/vnd.github+json"},
+			"X-Github-Api-Version": {"2022-11-28"},
+		},
+	}, domain
 }
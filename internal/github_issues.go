@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envGitHubBackupIssues = "GITHUB_BACKUP_ISSUES"
+
+	issuesSuffix = ".issues"
+
+	// gitHubIssuesVersion is incremented when the archive's content changes,
+	// so the next export fetches everything again.
+	gitHubIssuesVersion = 1
+
+	gitHubPageSize = "100"
+)
+
+// gitHubIssuesArchive is everything exported for a GitHub repository besides
+// its git history. Each object is kept as returned by the API.
+type gitHubIssuesArchive struct {
+	exportHeader
+
+	Issues         []json.RawMessage `json:"issues"`
+	PullRequests   []json.RawMessage `json:"pull_requests"`
+	IssueComments  []json.RawMessage `json:"issue_comments"`
+	ReviewComments []json.RawMessage `json:"review_comments"`
+	Reviews        []json.RawMessage `json:"reviews"`
+	Labels         []json.RawMessage `json:"labels"`
+	Milestones     []json.RawMessage `json:"milestones"`
+}
+
+// exportGitHubIssues exports the issues, pull requests, comments, reviews,
+// labels and milestones of each repository backed up successfully to
+// <repo>.issues next to the repository's bundles.
+func exportGitHubIssues(backupDir, token string, results *githosts.ProviderBackupResult) {
+	client, domain := gitHubAPIClient(token)
+	storage := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+
+	exportRepos(results, domain, issuesSuffix, func(ctx context.Context, repo string) error {
+		archive := &gitHubIssuesArchive{exportHeader: exportHeader{Version: gitHubIssuesVersion, Repository: repo}}
+
+		_, err := updateExport(ctx, storage, path.Join(domain, repo+issuesSuffix), envGitHubBackups, archive,
+			func(since time.Time) error {
+				return archive.fetch(ctx, client, repo, since)
+			})
+
+		return err
+	})
+}
+
+// fetch merges the objects updated since the given time into the archive,
+// or every object if it is zero. Labels and milestones are always fetched
+// in full so those deleted upstream are dropped.
+func (a *gitHubIssuesArchive) fetch(ctx context.Context, c apiClient, repo string, since time.Time) error {
+	p := "repos/" + repo
+
+	query := func(params ...string) url.Values {
+		q := url.Values{"per_page": {gitHubPageSize}}
+		for i := 0; i+1 < len(params); i += 2 {
+			q.Set(params[i], params[i+1])
+		}
+
+		if !since.IsZero() {
+			q.Set("since", since.UTC().Format(time.RFC3339))
+		}
+
+		return q
+	}
+
+	var issues, issueComments []json.RawMessage
+
+	err := c.getPages(ctx, p+"/issues", query("state", "all"), func(page []json.RawMessage) bool {
+		for _, issue := range page {
+			// pull requests are listed as issues too, but exported in full
+			// below
+			var fields map[string]json.RawMessage
+			if json.Unmarshal(issue, &fields) == nil && fields["pull_request"] == nil {
+				issues = append(issues, issue)
+			}
+		}
+
+		return true
+	})
+
+	// a repository with issues disabled still has pull requests
+	if err == nil {
+		err = c.getPages(ctx, p+"/issues/comments", query(), appendPage(&issueComments))
+	}
+
+	if err != nil && !errors.Is(err, errAPIUnavailable) {
+		return err
+	}
+
+	a.Issues = mergeByKey(a.Issues, issues, "id")
+	a.IssueComments = mergeByKey(a.IssueComments, issueComments, "id")
+
+	pulls, err := a.fetchPullRequests(ctx, c, p, since)
+	if err != nil {
+		return err
+	}
+
+	var reviewComments, labels, milestones []json.RawMessage
+
+	if err = c.getPages(ctx, p+"/pulls/comments", query(), appendPage(&reviewComments)); err != nil {
+		return err
+	}
+
+	a.ReviewComments = mergeByKey(a.ReviewComments, reviewComments, "id")
+
+	for _, number := range pulls {
+		var reviews []json.RawMessage
+
+		if err = c.getPages(ctx, p+"/pulls/"+number+"/reviews", url.Values{"per_page": {gitHubPageSize}},
+			appendPage(&reviews)); err != nil {
+			return err
+		}
+
+		a.Reviews = mergeByKey(a.Reviews, reviews, "id")
+	}
+
+	if err = c.getPages(ctx, p+"/labels", url.Values{"per_page": {gitHubPageSize}}, appendPage(&labels)); err != nil {
+		return err
+	}
+
+	if err = c.getPages(ctx, p+"/milestones", url.Values{"per_page": {gitHubPageSize}, "state": {"all"}},
+		appendPage(&milestones)); err != nil {
+		return err
+	}
+
+	a.Labels = mergeByKey(nil, labels, "id")
+	a.Milestones = mergeByKey(nil, milestones, "id")
+
+	return nil
+}
+
+// fetchPullRequests merges the pull requests updated since the given time
+// into the archive, returning their numbers. The pulls API has no since
+// parameter, so they are listed most recently updated first until an older
+// one is reached.
+func (a *gitHubIssuesArchive) fetchPullRequests(ctx context.Context, c apiClient, p string, since time.Time) ([]string, error) {
+	var (
+		pulls   []json.RawMessage
+		numbers []string
+	)
+
+	query := url.Values{"per_page": {gitHubPageSize}, "state": {"all"}, "sort": {"updated"}, "direction": {"desc"}}
+
+	err := c.getPages(ctx, p+"/pulls", query, func(page []json.RawMessage) bool {
+		for _, pull := range page {
+			var fields struct {
+				Number    int       `json:"number"`
+				UpdatedAt time.Time `json:"updated_at"`
+			}
+
+			if json.Unmarshal(pull, &fields) != nil {
+				continue
+			}
+
+			if !since.IsZero() && fields.UpdatedAt.Before(since) {
+				return false
+			}
+
+			pulls = append(pulls, pull)
+			numbers = append(numbers, strconv.Itoa(fields.Number))
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.PullRequests = mergeByKey(a.PullRequests, pulls, "id")
+
+	return numbers, nil
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGitHubIssuesAPI serves the issues API of owner/repo, recording the
+// since parameter of each request.
+type fakeGitHubIssuesAPI struct {
+	mu       sync.Mutex
+	comments []string
+	since    []string
+}
+
+func (f *fakeGitHubIssuesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if s := r.URL.Query().Get("since"); s != "" {
+		f.since = append(f.since, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.URL.Path {
+	case "/repos/owner/repo/issues":
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", `<http://`+r.Host+r.URL.Path+`?page=2>; rel="next"`)
+			_, _ = w.Write([]byte(`[{"id":1,"number":1,"title":"bug"},{"id":3,"number":3,"pull_request":{}}]`))
+
+			return
+		}
+
+		_, _ = w.Write([]byte(`[{"id":2,"number":2,"title":"feature"}]`))
+	case "/repos/owner/repo/issues/comments":
+		_, _ = w.Write([]byte("[" + strings.Join(f.comments, ",") + "]"))
+	case "/repos/owner/repo/pulls":
+		_, _ = w.Write([]byte(`[{"id":3,"number":3,"updated_at":"2024-01-01T00:00:00Z"}]`))
+	case "/repos/owner/repo/pulls/3/reviews":
+		_, _ = w.Write([]byte(`[{"id":30,"state":"APPROVED"}]`))
+	case "/repos/owner/repo/labels":
+		_, _ = w.Write([]byte(`[{"id":10,"name":"bug"}]`))
+	case "/repos/owner/repo/pulls/comments", "/repos/owner/repo/milestones":
+		_, _ = w.Write([]byte(`[]`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestExportGitHubIssues(t *testing.T) {
+	api := &fakeGitHubIssuesAPI{comments: []string{`{"id":100,"body":"first"}`}}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	t.Setenv(envGitHubAPIURL, server.URL)
+	t.Setenv(envGitHubBackups, "1")
+	t.Setenv(envVarBundlePassphrase, "")
+	_ = os.Unsetenv(envVarBundlePassphrase)
+
+	backupDir := t.TempDir()
+	s := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+	dir := path.Join("127.0.0.1", "owner/repo"+issuesSuffix)
+
+	export := func() {
+		t.Helper()
+
+		results := githosts.ProviderBackupResult{BackupResults: []githosts.RepoBackupResults{
+			{Repo: "owner/repo", Status: repoStatusOK},
+		}}
+
+		exportGitHubIssues(backupDir, "token", &results)
+		require.Len(t, results.BackupResults, 2)
+		require.Equal(t, githosts.RepoBackupResults{Repo: "owner/repo.issues", Status: repoStatusOK}, results.BackupResults[1])
+	}
+
+	latest := func() (*backupSet, gitHubIssuesArchive) {
+		t.Helper()
+
+		objects, err := s.List(t.Context(), "")
+		require.NoError(t, err)
+
+		sets := groupBackupSets(objects)[dir]
+		require.Len(t, sets, 1)
+
+		var archive gitHubIssuesArchive
+
+		found, err := readExport(t.Context(), s, sets[0], &archive)
+		require.NoError(t, err)
+		require.True(t, found)
+
+		return sets[0], archive
+	}
+
+	export()
+
+	first, archive := latest()
+	require.Equal(t, gitHubIssuesVersion, archive.Version)
+	require.Equal(t, "owner/repo", archive.Repository)
+	require.Len(t, archive.Issues, 2)
+	require.Len(t, archive.PullRequests, 1)
+	require.Len(t, archive.Reviews, 1)
+	require.Len(t, archive.Labels, 1)
+	require.JSONEq(t, `{"id":100,"body":"first"}`, string(archive.IssueComments[0]))
+	require.Empty(t, api.since)
+
+	// nothing changed, so no new archive is written, but only what changed
+	// since the first export is fetched
+	time.Sleep(time.Second)
+	export()
+
+	unchanged, _ := latest()
+	require.Equal(t, first.timestamp, unchanged.timestamp)
+	require.Contains(t, api.since, archive.ExportedAt.Format(time.RFC3339))
+
+	// a new comment is merged into the previous export, which replaces it
+	api.comments = []string{`{"id":101,"body":"second"}`}
+
+	export()
+
+	second, archive := latest()
+	require.NotEqual(t, first.timestamp, second.timestamp)
+	require.Len(t, archive.IssueComments, 2)
+
+	var comment struct {
+		Body string `json:"body"`
+	}
+
+	require.NoError(t, json.Unmarshal(archive.IssueComments[1], &comment))
+	require.Equal(t, "second", comment.Body)
+}
+
+func TestMergeByKey(t *testing.T) {
+	merged := mergeByKey(
+		[]json.RawMessage{[]byte(`{"id":10,"v":"a"}`), []byte(`{"id":9,"v":"b"}`)},
+		[]json.RawMessage{[]byte(`{"id":10,"v":"c"}`)},
+		"id")
+
+	require.Len(t, merged, 2)
+	require.JSONEq(t, `{"id":9,"v":"b"}`, string(merged[0]))
+	require.JSONEq(t, `{"id":10,"v":"c"}`, string(merged[1]))
+}
@@ -33,7 +33,7 @@ func Gitlab(backupDir string) *ProviderBackupResults {
 		DiffRemoteMethod:      os.Getenv(envGitLabCompare),
 		Token:                 glToken,
 		BackupDir:             backupDir,
-		BackupsToRetain:       getBackupsToRetain(envGitLabBackups),
+		BackupsToRetain:       providerBackupsToRetain(envGitLabBackups),
 		ProjectMinAccessLevel: getProjectMinimumAccessLevel(),
 		LogLevel:              getLogLevel(),
 		BackupLFS:             envTrue(envGitLabBackupLFS),
@@ -49,8 +49,30 @@ func Gitlab(backupDir string) *ProviderBackupResults {
 		}
 	}
 
+	results := gitlabHost.Backup()
+
+	if envTrue(envGitLabBackupWikis) {
+		backupWikis(backupDir, gitLabWikiSource(glToken), &results)
+	}
+
+	if envTrue(envGitLabBackupIssues) {
+		exportGitLabIssues(backupDir, glToken, &results)
+	}
+
+	if envTrue(envGitLabBackupReleases) {
+		exportReleases(backupDir, gitLabReleaseSource(glToken), &results)
+	}
+
+	if envTrue(envGitLabBackupMetadata) {
+		exportMetadata(backupDir, gitLabMetadataSource(glToken), &results)
+	}
+
+	if envTrue(envGitLabBackupSnippets) {
+		exportGitLabSnippets(backupDir, glToken, &results)
+	}
+
 	return &ProviderBackupResults{
 		Provider: providerNameGitLab,
-		Results:  gitlabHost.Backup(),
+		Results:  results,
 	}
 }
@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envGitLabBackupIssues   = "GITLAB_BACKUP_ISSUES"
+	envGitLabBackupSnippets = "GITLAB_BACKUP_SNIPPETS"
+
+	snippetsSuffix = ".snippets"
+
+	// gitLabIssuesVersion is incremented when the archive's content changes,
+	// so the next export fetches everything again.
+	gitLabIssuesVersion = 1
+
+	gitLabPageSize = "100"
+)
+
+// gitLabIssuesArchive is everything exported for a GitLab project besides
+// its git history. Each object is kept as returned by the API.
+type gitLabIssuesArchive struct {
+	exportHeader
+
+	Issues            []json.RawMessage `json:"issues"`
+	IssueNotes        []json.RawMessage `json:"issue_notes"`
+	MergeRequests     []json.RawMessage `json:"merge_requests"`
+	MergeRequestNotes []json.RawMessage `json:"merge_request_notes"`
+	Snippets          []gitLabSnippet   `json:"snippets"`
+}
+
+// gitLabSnippetsArchive holds the personal snippets of the token's user.
+type gitLabSnippetsArchive struct {
+	exportHeader
+
+	Snippets []gitLabSnippet `json:"snippets"`
+}
+
+// gitLabSnippet is a snippet as returned by the API along with its content,
+// which the API lists separately.
+type gitLabSnippet struct {
+	Snippet json.RawMessage `json:"snippet"`
+	Content string          `json:"content"`
+}
+
+// gitLabObject holds the fields used to follow up on an issue, merge request
+// or snippet.
+type gitLabObject struct {
+	ID        int       `json:"id"`
+	IID       int       `json:"iid"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func gitLabAPIClient(token string) (apiClient, string) {
+	apiURL := os.Getenv(envGitLabAPIURL)
+	if apiURL == "" {
+		apiURL = "https://gitlab.com/api/v4"
+	}
+
+	_, domain := wikiBaseURL(apiURL, "https://gitlab.com/api/v4")
+
+	return apiClient{baseURL: apiURL, header: http.Header{"Private-Token": {token}}}, domain
+}
+
+// exportGitLabIssues exports the issues and merge requests, with their
+// notes, and the snippets of each project backed up successfully to
+// <project>.issues next to the project's bundles. The projects are those
+// githosts backed up, so GITLAB_PROJECT_MIN_ACCESS_LEVEL applies.
+func exportGitLabIssues(backupDir, token string, results *githosts.ProviderBackupResult) {
+	client, domain := gitLabAPIClient(token)
+	storage := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+
+	exportRepos(results, domain, issuesSuffix, func(ctx context.Context, repo string) error {
+		archive := &gitLabIssuesArchive{exportHeader: exportHeader{Version: gitLabIssuesVersion, Repository: repo}}
+
+		_, err := updateExport(ctx, storage, path.Join(domain, repo+issuesSuffix), envGitLabBackups, archive,
+			func(since time.Time) error {
+				return archive.fetch(ctx, client, repo, since)
+			})
+
+		return err
+	})
+}
+
+// exportGitLabSnippets exports the personal snippets of the token's user to
+// <username>.snippets, adding a result for them.
+func exportGitLabSnippets(backupDir, token string, results *githosts.ProviderBackupResult) {
+	ctx := context.Background()
+	client, domain := gitLabAPIClient(token)
+	storage := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+
+	var user struct {
+		Username string `json:"username"`
+	}
+
+	err := client.get(ctx, "user", nil, &user)
+	if err == nil && user.Username == "" {
+		err = errors.New("GitLab did not return the token's user")
+	}
+
+	if err != nil {
+		logger.Printf("failed to export GitLab snippets: %s", err)
+
+		results.BackupResults = append(results.BackupResults, githosts.RepoBackupResults{
+			Repo: "personal snippets", Status: repoStatusFailed, Error: errors.WithStack(err),
+		})
+
+		return
+	}
+
+	name := user.Username + snippetsSuffix
+	archive := &gitLabSnippetsArchive{exportHeader: exportHeader{Version: gitLabIssuesVersion, Repository: user.Username}}
+
+	_, err = updateExport(ctx, storage, path.Join(domain, name), envGitLabBackups, archive, func(time.Time) error {
+		var fErr error
+
+		archive.Snippets, fErr = fetchGitLabSnippets(ctx, client, "snippets", archive.Snippets)
+
+		return fErr
+	})
+	if err != nil {
+		logger.Printf("failed to export %s: %s", name, err)
+
+		results.BackupResults = append(results.BackupResults, githosts.RepoBackupResults{
+			Repo: name, Status: repoStatusFailed, Error: errors.WithStack(err),
+		})
+
+		return
+	}
+
+	results.BackupResults = append(results.BackupResults, githosts.RepoBackupResults{Repo: name, Status: repoStatusOK})
+}
+
+// fetch merges the issues and merge requests updated since the given time,
+// or all of them if it is zero, into the archive along with their notes.
+// Snippets are always fetched in full so those deleted upstream are
+// dropped. A feature disabled in the project is skipped.
+func (a *gitLabIssuesArchive) fetch(ctx context.Context, c apiClient, repo string, since time.Time) error {
+	p := "projects/" + url.PathEscape(repo)
+
+	var err error
+
+	query := url.Values{"per_page": {gitLabPageSize}, "scope": {"all"}}
+	if !since.IsZero() {
+		query.Set("updated_after", since.UTC().Format(time.RFC3339))
+	}
+
+	// issues of every state are listed unless one is given
+	if a.Issues, a.IssueNotes, err = fetchGitLabNoteables(ctx, c, p+"/issues", query, a.Issues, a.IssueNotes); err != nil {
+		return err
+	}
+
+	query.Set("state", "all")
+
+	if a.MergeRequests, a.MergeRequestNotes, err = fetchGitLabNoteables(ctx, c, p+"/merge_requests", query,
+		a.MergeRequests, a.MergeRequestNotes); err != nil {
+		return err
+	}
+
+	snippets, err := fetchGitLabSnippets(ctx, c, p+"/snippets", a.Snippets)
+	if errors.Is(err, errAPIUnavailable) {
+		return nil
+	}
+
+	a.Snippets = snippets
+
+	return err
+}
+
+// fetchGitLabNoteables merges the issues or merge requests listed at p with
+// the given query into objects, and their notes into notes.
+func fetchGitLabNoteables(ctx context.Context, c apiClient, p string, query url.Values,
+	objects, notes []json.RawMessage,
+) ([]json.RawMessage, []json.RawMessage, error) {
+	var updated []json.RawMessage
+
+	if err := c.getPages(ctx, p, query, appendPage(&updated)); err != nil {
+		if errors.Is(err, errAPIUnavailable) {
+			return objects, notes, nil
+		}
+
+		return nil, nil, err
+	}
+
+	for _, o := range updated {
+		var fields gitLabObject
+		if json.Unmarshal(o, &fields) != nil {
+			continue
+		}
+
+		var objectNotes []json.RawMessage
+
+		if err := c.getPages(ctx, p+"/"+strconv.Itoa(fields.IID)+"/notes", url.Values{"per_page": {gitLabPageSize}},
+			appendPage(&objectNotes)); err != nil {
+			return nil, nil, err
+		}
+
+		notes = mergeByKey(notes, objectNotes, "id")
+	}
+
+	return mergeByKey(objects, updated, "id"), notes, nil
+}
+
+// fetchGitLabSnippets lists the snippets at p with their content, which is
+// only fetched again for snippets updated since the previous export.
+func fetchGitLabSnippets(ctx context.Context, c apiClient, p string, previous []gitLabSnippet) ([]gitLabSnippet, error) {
+	known := make(map[int]gitLabSnippet, len(previous))
+	updatedAt := make(map[int]time.Time, len(previous))
+
+	for _, s := range previous {
+		var fields gitLabObject
+		if json.Unmarshal(s.Snippet, &fields) == nil {
+			known[fields.ID] = s
+			updatedAt[fields.ID] = fields.UpdatedAt
+		}
+	}
+
+	var listed []json.RawMessage
+
+	if err := c.getPages(ctx, p, url.Values{"per_page": {gitLabPageSize}}, appendPage(&listed)); err != nil {
+		return nil, err
+	}
+
+	snippets := make([]gitLabSnippet, 0, len(listed))
+
+	for _, o := range mergeByKey(nil, listed, "id") {
+		var fields gitLabObject
+		if json.Unmarshal(o, &fields) != nil {
+			continue
+		}
+
+		var snippet gitLabSnippet
+
+		if s, ok := known[fields.ID]; ok && updatedAt[fields.ID].Equal(fields.UpdatedAt) {
+			snippet.Content = s.Content
+		} else {
+			var content []byte
+
+			if err := c.get(ctx, p+"/"+strconv.Itoa(fields.ID)+"/raw", nil, &content); err != nil {
+				return nil, err
+			}
+
+			snippet.Content = string(content)
+		}
+
+		snippet.Snippet = o
+		snippets = append(snippets, snippet)
+	}
+
+	return snippets, nil
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGitLabAPI serves the issues, merge requests and snippets of
+// group/project and the token user's snippets, counting the requests for
+// snippet content.
+type fakeGitLabAPI struct {
+	mu           sync.Mutex
+	updatedAfter []string
+	raw          int
+}
+
+func (f *fakeGitLabAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Private-Token") != "token" {
+		http.Error(w, `{"message":"401 Unauthorized"}`, http.StatusUnauthorized)
+
+		return
+	}
+
+	if s := r.URL.Query().Get("updated_after"); s != "" {
+		f.updatedAfter = append(f.updatedAfter, s)
+	}
+
+	project := "/api/v4/projects/group%2Fproject"
+
+	switch r.URL.EscapedPath() {
+	case project + "/issues":
+		_, _ = w.Write([]byte(`[{"id":11,"iid":1,"title":"bug"}]`))
+	case project + "/issues/1/notes":
+		_, _ = w.Write([]byte(`[{"id":111,"body":"confirmed"}]`))
+	case project + "/merge_requests":
+		_, _ = w.Write([]byte(`[{"id":21,"iid":2,"title":"fix"}]`))
+	case project + "/merge_requests/2/notes":
+		_, _ = w.Write([]byte(`[{"id":222,"body":"lgtm"}]`))
+	case project + "/snippets", "/api/v4/snippets":
+		_, _ = w.Write([]byte(`[{"id":5,"title":"notes","updated_at":"2024-01-01T00:00:00Z"}]`))
+	case project + "/snippets/5/raw", "/api/v4/snippets/5/raw":
+		f.raw++
+		_, _ = w.Write([]byte("echo hello\n"))
+	case "/api/v4/user":
+		_, _ = w.Write([]byte(`{"id":1,"username":"jane"}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestExportGitLabIssues(t *testing.T) {
+	api := &fakeGitLabAPI{}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	t.Setenv(envGitLabAPIURL, server.URL+"/api/v4")
+	t.Setenv(envVarBundlePassphrase, "")
+	_ = os.Unsetenv(envVarBundlePassphrase)
+
+	backupDir := t.TempDir()
+	s := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+
+	export := func() githosts.ProviderBackupResult {
+		t.Helper()
+
+		results := githosts.ProviderBackupResult{BackupResults: []githosts.RepoBackupResults{
+			{Repo: "group/project", Status: repoStatusOK},
+		}}
+
+		exportGitLabIssues(backupDir, "token", &results)
+		exportGitLabSnippets(backupDir, "token", &results)
+
+		return results
+	}
+
+	latest := func(dir string, v exportArchive) *backupSet {
+		t.Helper()
+
+		objects, err := s.List(t.Context(), "")
+		require.NoError(t, err)
+
+		sets := groupBackupSets(objects)[dir]
+		require.Len(t, sets, 1)
+
+		found, err := readExport(t.Context(), s, sets[0], v)
+		require.NoError(t, err)
+		require.True(t, found)
+
+		return sets[0]
+	}
+
+	results := export()
+	require.Equal(t, []githosts.RepoBackupResults{
+		{Repo: "group/project", Status: repoStatusOK},
+		{Repo: "group/project.issues", Status: repoStatusOK},
+		{Repo: "jane.snippets", Status: repoStatusOK},
+	}, results.BackupResults)
+
+	var archive gitLabIssuesArchive
+
+	first := latest(path.Join("127.0.0.1", "group/project.issues"), &archive)
+	require.Equal(t, "group/project", archive.Repository)
+	require.Len(t, archive.Issues, 1)
+	require.Len(t, archive.IssueNotes, 1)
+	require.Len(t, archive.MergeRequests, 1)
+	require.Len(t, archive.MergeRequestNotes, 1)
+	require.Len(t, archive.Snippets, 1)
+	require.Equal(t, "echo hello\n", archive.Snippets[0].Content)
+
+	var personal gitLabSnippetsArchive
+
+	latest(path.Join("127.0.0.1", "jane.snippets"), &personal)
+	require.Equal(t, "jane", personal.Repository)
+	require.Len(t, personal.Snippets, 1)
+	require.Equal(t, 2, api.raw)
+
+	// unchanged data is fetched incrementally and not written again, and
+	// snippets not updated are not downloaded again
+	time.Sleep(time.Second)
+	export()
+
+	var unchanged gitLabIssuesArchive
+
+	require.Equal(t, first.timestamp, latest(path.Join("127.0.0.1", "group/project.issues"), &unchanged).timestamp)
+	require.Contains(t, api.updatedAfter, archive.ExportedAt.Format(time.RFC3339))
+	require.Equal(t, 2, api.raw)
+}
@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// repoNotFound matches git's output when a repository does not exist, which
+// for most providers' wikis is the case until the first page is written.
+var repoNotFound = []string{"not found", "does not appear to be a git repository", "does not exist", "404"}
+
+// gitRemote is where repositories are cloned from and the credentials to
+// clone them with.
+type gitRemote struct {
+	// baseURL is the git URL repository paths are relative to, e.g.
+	// https://github.com
+	baseURL  string
+	username string
+	password string
+	// sshKey is the path of the private key to clone over SSH with
+	sshKey string
+	// lfs is set to store the repository's LFS objects with its bundle
+	lfs bool
+	// refspecs, if set, limit the refs fetched, which are otherwise all of
+	// them as with git clone --mirror
+	refspecs []string
+}
+
+// errRepoNotFound is returned when the repository to clone does not exist.
+var errRepoNotFound = errors.Base("repository not found")
+
+// backupGitRepo clones a repository that githosts does not back up, such as
+// a wiki, and stores it as a bundle in dir unless its refs match the latest
+// backup, returning false if the repository is empty and errRepoNotFound if
+// it does not exist.
+func backupGitRepo(ctx context.Context, s *localStorage, remote gitRemote, cloneURL, dir, backupsEnvVar string) (bool, error) {
+	workingDir := resolveWorkingDir(s.root)
+
+	if err := os.MkdirAll(workingDir, workingDIRMode); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	tmp, err := os.MkdirTemp(workingDir, "clone-")
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer func() { _ = os.RemoveAll(tmp) }()
+
+	clone := filepath.Join(tmp, "clone")
+
+	if out, cErr := cloneGitRepo(ctx, remote, cloneURL, clone); cErr != nil {
+		for _, msg := range repoNotFound {
+			if strings.Contains(strings.ToLower(out), msg) {
+				return false, errors.WithStack(errRepoNotFound)
+			}
+		}
+
+		return false, errors.Errorf("git clone failed: %s", strings.TrimSpace(out))
+	}
+
+	// a wiki repository can exist before its first page is written
+	if _, sErr := runRemoteGit(ctx, remote, "-C", clone, "show-ref", "--quiet"); sErr != nil {
+		return false, nil
+	}
+
+	timestamp := time.Now().UTC().Format(timeStampFormat)
+	name := path.Base(dir) + "." + timestamp + bundleExtension
+
+	if out, bErr := runRemoteGit(ctx, remote, "-C", clone, "bundle", "create", "--quiet", filepath.Join(tmp, name), "--all"); bErr != nil {
+		return false, errors.Errorf("git bundle failed: %s", strings.TrimSpace(out))
+	}
+
+	digest, err := bundleRefsDigest(ctx, newLocalStorage(tmp), name)
+	if err != nil {
+		return false, err
+	}
+
+	existing, existingDir := existingBackups(s.root, dir)
+
+	objects, err := existing.List(ctx, existingDir+"/")
+	if err != nil {
+		return false, err
+	}
+
+	sets := groupBackupSets(objects)[existingDir]
+	if len(sets) > 0 && (digest == latestRefsDigest(ctx, existing, sets[0]) || sets[0].timestamp == timestamp) {
+		return true, nil
+	}
+
+	if err = storeGitRepoBundle(ctx, s, filepath.Join(tmp, name), path.Join(dir, name)); err != nil {
+		return false, err
+	}
+
+	key := strings.TrimSuffix(path.Join(dir, name), bundleExtension)
+
+	if err = s.Put(ctx, key+refsSuffix, strings.NewReader(digest), int64(len(digest))); err != nil {
+		return false, err
+	}
+
+	if remote.lfs {
+		if err = storeLFSObjects(ctx, s, remote, clone, key+lfsExtension); err != nil {
+			return false, err
+		}
+	}
+
+	return true, rotateBackups(ctx, existing, sets, backupsEnvVar)
+}
+
+// cloneGitRepo makes a bare clone of a repository holding every ref, or
+// those matching the remote's refspecs.
+func cloneGitRepo(ctx context.Context, remote gitRemote, cloneURL, clone string) (string, error) {
+	if len(remote.refspecs) == 0 {
+		return runRemoteGit(ctx, remote, "clone", "--mirror", "--quiet", cloneURL, clone)
+	}
+
+	if out, err := runRemoteGit(ctx, remote, "init", "--bare", "--quiet", clone); err != nil {
+		return out, err
+	}
+
+	if out, err := runRemoteGit(ctx, remote, "-C", clone, "config", "remote.origin.url", cloneURL); err != nil {
+		return out, err
+	}
+
+	for _, refspec := range remote.refspecs {
+		if out, err := runRemoteGit(ctx, remote, "-C", clone, "config", "--add", "remote.origin.fetch", refspec); err != nil {
+			return out, err
+		}
+	}
+
+	return runRemoteGit(ctx, remote, "-C", clone, "fetch", "--quiet", "origin")
+}
+
+// storeLFSObjects fetches every LFS object referenced by a mirror clone and
+// stores them as a gzipped tar at key. A repository without LFS objects,
+// or a host without git-lfs, stores nothing.
+func storeLFSObjects(ctx context.Context, s *localStorage, remote gitRemote, clone, key string) error {
+	if _, err := exec.LookPath("git-lfs"); err != nil {
+		logger.Printf("git-lfs not found, not backing up LFS objects for %s", path.Dir(key))
+
+		return nil
+	}
+
+	if out, err := runRemoteGit(ctx, remote, "-C", clone, "lfs", "fetch", "--all"); err != nil {
+		return errors.Errorf("git lfs fetch failed: %s", strings.TrimSpace(out))
+	}
+
+	objects := filepath.Join(clone, "lfs", "objects")
+	if entries, err := os.ReadDir(objects); err != nil || len(entries) == 0 {
+		return nil
+	}
+
+	r, w := io.Pipe()
+
+	go func() {
+		w.CloseWithError(writeTarGz(w, filepath.Join(clone, "lfs"), "objects"))
+	}()
+
+	err := storeBackupFile(ctx, s, r, key)
+	_ = r.CloseWithError(err)
+
+	return err
+}
+
+// writeTarGz writes the files under dir/name to w as a gzipped tar, with
+// paths relative to dir.
+func writeTarGz(w io.Writer, dir, name string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.WalkDir(filepath.Join(dir, name), func(p string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = filepath.ToSlash(rel)
+
+		if err = tw.WriteHeader(hdr); err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+
+		_, err = io.Copy(tw, f)
+
+		return err
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = tw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(gz.Close())
+}
+
+// latestRefsDigest returns the refs digest of a backup, from its refs file
+// or, for a plaintext bundle, the bundle itself.
+func latestRefsDigest(ctx context.Context, s Storage, set *backupSet) string {
+	if digest := readRefsDigest(ctx, s, set); digest != "" {
+		return digest
+	}
+
+	if key := set.key(bundleExtension); key != "" {
+		digest, _ := bundleRefsDigest(ctx, s, key)
+
+		return digest
+	}
+
+	return ""
+}
+
+// storeGitRepoBundle copies a bundle into the backup directory.
+func storeGitRepoBundle(ctx context.Context, s *localStorage, src, key string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	return storeBackupFile(ctx, s, f, key)
+}
+
+// runRemoteGit runs git with the remote's credentials passed as an HTTP header
+// through the environment, keeping them out of the command line and of any
+// URL git might print.
+func runRemoteGit(ctx context.Context, remote gitRemote, args ...string) (string, error) {
+	gitPath := gitInstallPath()
+	if gitPath == "" {
+		return "", errors.New("git not found")
+	}
+
+	cmd := exec.CommandContext(ctx, gitPath, args...) // nolint:gosec
+
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	if remote.sshKey != "" {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND=ssh -i '"+strings.ReplaceAll(remote.sshKey, "'", `'\''`)+
+			"' -o IdentitiesOnly=yes -o BatchMode=yes")
+	}
+
+	if remote.password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(remote.username + ":" + remote.password))
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			fmt.Sprintf("GIT_CONFIG_VALUE_0=Authorization: Basic %s", auth))
+	}
+
+	var out bytes.Buffer
+
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := cmd.Run()
+
+	return out.String(), errors.WithStack(err)
+}
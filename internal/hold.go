@@ -0,0 +1,368 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// holdSuffix names the sidecar placing a backup, or every backup of a
+// repository, on hold. A held backup is never removed by soba, whatever
+// the retention policy, quota or missing upstream policy.
+const holdSuffix = ".hold"
+
+// setHoldRegex matches the sidecar holding a single backup:
+// <repo>.<timestamp>.hold. Any other sidecar holds the whole repository.
+var setHoldRegex = regexp.MustCompile(`^(.+)\.(\d{14})\` + holdSuffix + `$`)
+
+// holdInfo is the content of a hold sidecar.
+type holdInfo struct {
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+	Until     time.Time `json:"until,omitzero"`
+}
+
+func (h holdInfo) active(now time.Time) bool {
+	return h.Until.IsZero() || now.Before(h.Until)
+}
+
+func (h holdInfo) String() string {
+	if h.Until.IsZero() {
+		return "held: " + h.Reason
+	}
+
+	return fmt.Sprintf("held until %s: %s", h.Until.Format(time.DateOnly), h.Reason)
+}
+
+// setHoldKey returns the key of the sidecar holding a backup set. The
+// timestamp rather than a file name is used so the hold survives the
+// backup being encrypted or re-keyed.
+func setHoldKey(set *backupSet) string {
+	return path.Join(set.dir, set.repo+"."+set.timestamp+holdSuffix)
+}
+
+// repoHoldKey returns the key of the sidecar holding every backup of the
+// repository in dir.
+func repoHoldKey(dir string) string {
+	return path.Join(dir, path.Base(dir)+holdSuffix)
+}
+
+// holds are the hold sidecars in a backup directory, keyed by sidecar key.
+type holds map[string]holdInfo
+
+// readHolds reads the hold sidecars among objects. An unreadable sidecar is
+// treated as a hold that never expires, as with locks.
+func readHolds(ctx context.Context, s Storage, objects []ObjectInfo) holds {
+	h := make(holds)
+
+	for _, o := range objects {
+		if !strings.HasSuffix(o.Key, holdSuffix) {
+			continue
+		}
+
+		var info holdInfo
+
+		b, err := readObject(ctx, s, o.Key)
+		if err == nil {
+			err = json.Unmarshal(b, &info)
+		}
+
+		if err != nil {
+			logger.Printf("failed to read hold %s, treating it as held: %s", o.Key, err)
+
+			info = holdInfo{Reason: "unreadable hold"}
+		}
+
+		h[o.Key] = info
+	}
+
+	return h
+}
+
+// held returns the active hold on a backup set, either on the set itself or
+// on its repository.
+func (h holds) held(set *backupSet, now time.Time) (holdInfo, bool) {
+	for _, key := range []string{setHoldKey(set), repoHoldKey(set.dir)} {
+		if info, ok := h[key]; ok && info.active(now) {
+			return info, true
+		}
+	}
+
+	return holdInfo{}, false
+}
+
+// removeExpiredHold removes the sidecar of an expired hold on a backup set
+// once the set itself has been removed.
+func removeExpiredHold(ctx context.Context, s Storage, set *backupSet) error {
+	key := setHoldKey(set)
+
+	if _, err := s.Stat(ctx, key); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return s.Delete(ctx, key)
+}
+
+// holdsInUse reports whether any backup in the backup directory is on hold,
+// in which case soba must apply retention itself so githosts never removes
+// a held backup. The answer is kept in the state directory by soba hold, so
+// the backup directory is only searched for holds the first time.
+func holdsInUse() bool {
+	backupDir, err := commandBackupDir()
+	if err != nil {
+		return false
+	}
+
+	var state holdsMarker
+
+	if found, rErr := readStateJSON(backupDir, holdsState, &state); rErr == nil && found {
+		return state.InUse
+	}
+
+	inUse, err := findHolds(backupDir)
+	if err != nil {
+		return false
+	}
+
+	if err = writeStateJSON(backupDir, holdsState, holdsMarker{InUse: inUse}); err != nil {
+		logger.Printf("failed to record holds: %s", err)
+	}
+
+	return inUse
+}
+
+// holdsState records whether any backup is on hold.
+const holdsState = "holds.json"
+
+type holdsMarker struct {
+	InUse bool `json:"in_use"`
+}
+
+// findHolds searches the backup directory for hold sidecars.
+func findHolds(backupDir string) (bool, error) {
+	found := false
+
+	err := filepath.WalkDir(backupDir, func(_ string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+
+		if !d.IsDir() && strings.HasSuffix(d.Name(), holdSuffix) {
+			found = true
+
+			return fs.SkipAll
+		}
+
+		return nil
+	})
+
+	return found, errors.WithStack(err)
+}
+
+// recordHolds updates the state kept for holdsInUse after a hold is added
+// or removed.
+func recordHolds(backupDir string) error {
+	inUse, err := findHolds(backupDir)
+	if err != nil {
+		return err
+	}
+
+	return writeStateJSON(backupDir, holdsState, holdsMarker{InUse: inUse})
+}
+
+// runHold adds, removes and lists holds.
+func runHold(args []string) error {
+	flags := flag.NewFlagSet("hold", flag.ContinueOnError)
+	reason := flags.String("reason", "", "why the backups are held, required when adding a hold")
+	until := flags.String("until", "", "release the hold on this date, e.g. 2025-06-30")
+	holdFor := flags.String("for", "", "release the hold after this long, e.g. 90d or 12w")
+
+	flags.Usage = func() {
+		_, _ = io.WriteString(flags.Output(), "usage: soba hold add -reason text [-until date|-for age] path\n"+
+			"       soba hold remove path\n"+
+			"       soba hold list [path prefix]\n\n"+
+			"Places a backup, or with the path of a repository directory every backup of it, on hold so\n"+
+			"soba never removes it. Paths are relative to "+envGitBackupDir+".\n\n")
+		flags.PrintDefaults()
+	}
+
+	if len(args) == 0 || !slices.Contains([]string{"add", "remove", "list"}, args[0]) {
+		flags.Usage()
+
+		return errors.New("expected add, remove or list")
+	}
+
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+
+		return errors.WithStack(err)
+	}
+
+	backupDir, err := commandBackupDir()
+	if err != nil {
+		return err
+	}
+
+	s := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+
+	if args[0] == "list" {
+		prefix, pErr := storagePath(backupDir, flags.Arg(0))
+		if pErr != nil {
+			return pErr
+		}
+
+		return listHolds(context.Background(), os.Stdout, s, prefix, time.Now())
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+
+		return errors.New("expected the path of a backup or repository")
+	}
+
+	key, err := holdKeyFor(context.Background(), s, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "remove" {
+		if err = s.Delete(context.Background(), key); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return errors.Errorf("%s is not on hold", flags.Arg(0))
+			}
+
+			return err
+		}
+
+		fmt.Printf("released %s\n", strings.TrimSuffix(key, holdSuffix))
+
+		return recordHolds(backupDir)
+	}
+
+	info := holdInfo{Reason: strings.TrimSpace(*reason), CreatedAt: time.Now().UTC()}
+	if info.Reason == "" {
+		return errors.New("a reason is required to add a hold")
+	}
+
+	switch {
+	case *until != "" && *holdFor != "":
+		return errors.New("only one of -until and -for may be given")
+	case *until != "":
+		if info.Until, err = time.Parse(time.DateOnly, *until); err != nil {
+			return errors.Errorf("invalid date %q, expected e.g. 2025-06-30", *until)
+		}
+	case *holdFor != "":
+		d, pErr := parseRetentionAge(*holdFor)
+		if pErr != nil || d <= 0 {
+			return errors.Errorf("invalid age %q, expected e.g. 90d", *holdFor)
+		}
+
+		info.Until = info.CreatedAt.Add(d)
+	}
+
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = s.Put(context.Background(), key, strings.NewReader(string(b)), int64(len(b))); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s %s\n", strings.TrimSuffix(key, holdSuffix), info)
+
+	return recordHolds(backupDir)
+}
+
+// holdKeyFor returns the key of the hold sidecar for the backup file or
+// repository directory at p, relative to the backup directory or absolute.
+// With obfuscated paths p may be given by its real path.
+func holdKeyFor(ctx context.Context, s *localStorage, p string) (string, error) {
+	if filepath.IsAbs(p) {
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return "", errors.Errorf("%s is not within %s", p, s.root)
+		}
+
+		p = rel
+	}
+
+	p, err := storagePath(s.root, strings.Trim(filepath.ToSlash(p), "/"))
+	if err != nil {
+		return "", err
+	}
+
+	if f, ok := parseBackupFile(p); ok {
+		if _, err = s.Stat(ctx, p); err != nil {
+			return "", err
+		}
+
+		return setHoldKey(&backupSet{dir: path.Dir(p), repo: f.repo, timestamp: f.timestamp}), nil
+	}
+
+	objects, err := s.List(ctx, p+"/")
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := groupBackupSets(objects)[p]; !ok {
+		return "", errors.Errorf("no backups found at %s", p)
+	}
+
+	return repoHoldKey(p), nil
+}
+
+// listHolds writes each hold under prefix with its expiry and reason.
+func listHolds(ctx context.Context, w io.Writer, s Storage, prefix string, now time.Time) error {
+	objects, err := s.List(ctx, prefix)
+	if err != nil {
+		return errors.Wrap(err, "failed to list backups")
+	}
+
+	h := readHolds(ctx, s, objects)
+
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		info := h[key]
+
+		target := path.Dir(key)
+		if m := setHoldRegex.FindStringSubmatch(path.Base(key)); m != nil {
+			target = path.Join(target, m[2])
+		}
+
+		expiry := "indefinite"
+
+		switch {
+		case !info.active(now):
+			expiry = "expired " + info.Until.Format(time.DateOnly)
+		case !info.Until.IsZero():
+			expiry = "until " + info.Until.Format(time.DateOnly)
+		}
+
+		if _, err = fmt.Fprintf(w, "%s\t%s\t%s\n", target, expiry, info.Reason); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
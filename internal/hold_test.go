@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"bytes"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeHold(t *testing.T, s *localStorage, key, content string) {
+	t.Helper()
+
+	require.NoError(t, s.Put(t.Context(), key, strings.NewReader(content), int64(len(content))))
+}
+
+func TestHoldKeyFor(t *testing.T) {
+	root := t.TempDir()
+	s := newLocalStorage(root)
+
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101000000.bundle.age", "1")
+
+	key, err := holdKeyFor(t.Context(), s, "github.com/owner/repo/repo.20240101000000.bundle.age")
+	require.NoError(t, err)
+	require.Equal(t, "github.com/owner/repo/repo.20240101000000.hold", key)
+
+	key, err = holdKeyFor(t.Context(), s, filepath.Join(root, "github.com", "owner", "repo")+"/")
+	require.NoError(t, err)
+	require.Equal(t, "github.com/owner/repo/repo.hold", key)
+
+	_, err = holdKeyFor(t.Context(), s, "github.com/owner")
+	require.ErrorContains(t, err, "no backups found")
+
+	_, err = holdKeyFor(t.Context(), s, "github.com/owner/repo/repo.20240102000000.bundle")
+	require.Error(t, err)
+}
+
+func TestHoldKeyForObfuscatedPaths(t *testing.T) {
+	root := t.TempDir()
+	s := newLocalStorage(root)
+
+	t.Setenv(envSobaObfuscatePaths, "true")
+	t.Setenv(envSobaPathKey, "secret")
+
+	dir := obfuscateDir("secret", "github.com/owner/repo")
+	name := obfuscateName("github.com/owner/repo", dir, "repo.20240101000000.bundle.age")
+
+	writeBackupFile(t, root, path.Join(dir, name), "1")
+	require.NoError(t, writePathIndex(t.Context(), root, "secret", &pathIndex{Paths: map[string]string{dir: "github.com/owner/repo"}}))
+
+	// real paths are resolved through the index
+	key, err := holdKeyFor(t.Context(), s, "github.com/owner/repo/repo.20240101000000.bundle.age")
+	require.NoError(t, err)
+	require.Equal(t, path.Join(dir, path.Base(dir)+".20240101000000"+holdSuffix), key)
+
+	key, err = holdKeyFor(t.Context(), s, "github.com/owner/repo")
+	require.NoError(t, err)
+	require.Equal(t, path.Join(dir, path.Base(dir)+holdSuffix), key)
+
+	// as are obfuscated ones
+	key, err = holdKeyFor(t.Context(), s, dir)
+	require.NoError(t, err)
+	require.Equal(t, path.Join(dir, path.Base(dir)+holdSuffix), key)
+
+	_, err = holdKeyFor(t.Context(), s, "github.com/owner/other")
+	require.ErrorContains(t, err, "no backups found")
+
+	// holds are listed under a real parent directory
+	t.Setenv(envGitBackupDir, root)
+	require.NoError(t, RunCommand([]string{"hold", "add", "-reason", "legal", "github.com/owner/repo"}))
+	require.FileExists(t, filepath.Join(root, dir, path.Base(dir)+holdSuffix))
+
+	prefix, err := storagePath(root, "github.com/owner")
+	require.NoError(t, err)
+	require.Equal(t, obfuscateDir("secret", "github.com/owner"), prefix)
+
+	var out bytes.Buffer
+
+	require.NoError(t, listHolds(t.Context(), &out, s, prefix, time.Now()))
+	require.Contains(t, out.String(), dir+"\tindefinite\tlegal")
+}
+
+func TestHoldsInUse(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv(envGitBackupDir, root)
+
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101000000.bundle", "1")
+	writeBackupFile(t, root, "github.com/owner/repo/repo.hold", `{"reason":"legal"}`)
+
+	// an existing backup directory is searched once and the answer kept
+	require.True(t, holdsInUse())
+	require.FileExists(t, statePath(root, holdsState))
+
+	require.NoError(t, RunCommand([]string{"hold", "remove", "github.com/owner/repo"}))
+	require.False(t, holdsInUse())
+
+	require.NoError(t, RunCommand([]string{"hold", "add", "-reason", "audit", "github.com/owner/repo"}))
+	require.True(t, holdsInUse())
+}
+
+func TestRetentionSkipsHeldBackups(t *testing.T) {
+	root := t.TempDir()
+	s := newLocalStorage(root)
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101000000.bundle", "1")
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240102000000.bundle", "2")
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240103000000.bundle", "3")
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240104000000.bundle", "4")
+
+	writeHold(t, s, "github.com/owner/repo/repo.20240101000000.hold", `{"reason":"incident 42"}`)
+	writeHold(t, s, "github.com/owner/repo/repo.20240102000000.hold", `{"reason":"audit","until":"2024-07-01T00:00:00Z"}`)
+	writeHold(t, s, "github.com/owner/repo/repo.20240103000000.hold", `{"reason":"done","until":"2024-05-01T00:00:00Z"}`)
+
+	objects, err := s.List(t.Context(), "")
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+
+	require.NoError(t, explainRetention(t.Context(), &out, s, objects, retentionPolicy{Last: 1}, now))
+	require.Equal(t, `
+github.com/owner/repo
+  keep    20240104000000  last
+  remove  20240103000000
+  keep    20240102000000  held until 2024-07-01: audit
+  keep    20240101000000  held: incident 42
+`, out.String())
+
+	out.Reset()
+
+	require.NoError(t, listHolds(t.Context(), &out, s, "", now))
+	require.Equal(t, "github.com/owner/repo/20240101000000\tindefinite\tincident 42\n"+
+		"github.com/owner/repo/20240102000000\tuntil 2024-07-01\taudit\n"+
+		"github.com/owner/repo/20240103000000\texpired 2024-05-01\tdone\n", out.String())
+
+	var result RetentionResult
+
+	applyRetention(t.Context(), s, retentionPolicy{Last: 1}, time.Time{}, nil, now, &result)
+	require.Nil(t, result.Error)
+	require.Equal(t, 1, result.Deleted)
+	require.Equal(t, []string{"github.com/owner/repo/20240102000000", "github.com/owner/repo/20240101000000"}, result.Held)
+	require.NoFileExists(t, filepath.Join(root, "github.com/owner/repo/repo.20240103000000.hold"))
+
+	// a hold on the repository covers every backup, and the quota can not
+	// evict them either
+	writeHold(t, s, "github.com/owner/repo/repo.hold", "not json")
+
+	var quota QuotaResult
+
+	enforceQuota(t.Context(), s, 1, now, &quota)
+	require.Empty(t, quota.Evicted)
+	require.Error(t, quota.Error)
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envSobaImmutableDays = "SOBA_IMMUTABLE_DAYS"
+
+	// lockSuffix names the sidecar recording until when a backup file must
+	// not be removed.
+	lockSuffix = ".lock"
+
+	readOnlyFileMode = 0o444
+	writableFileMode = 0o600
+	hoursPerDay      = 24
+)
+
+// ImmutableResult reports the backup files locked during a run.
+type ImmutableResult struct {
+	Locked int      `json:"locked"`
+	Error  errors.E `json:"error,omitempty"`
+}
+
+var maxLockTime = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// lockInfo is the content of a lock sidecar.
+type lockInfo struct {
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// immutableDays returns the number of days newly written backups are locked
+// for, or zero if immutable mode is disabled.
+func immutableDays() int {
+	value, _ := GetEnvOrFile(envSobaImmutableDays)
+
+	days, ok := isInt(value)
+	if !ok || days < 0 {
+		return 0
+	}
+
+	return days
+}
+
+// lockNewBackups protects backup files written since the given time: each
+// is made read-only, marked immutable where the filesystem and privileges
+// allow, and given a sidecar recording when the lock expires.
+func lockNewBackups(ctx context.Context, s *localStorage, since time.Time, days int, result *ImmutableResult) {
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		result.Error = errors.Wrap(err, "failed to list backups to lock")
+
+		return
+	}
+
+	lockedUntil := since.Add(time.Duration(days) * hoursPerDay * time.Hour).UTC()
+
+	for _, o := range objects {
+		if _, ok := parseBackupFile(o.Key); !ok || o.ModTime.Before(since) {
+			continue
+		}
+
+		if _, sErr := s.Stat(ctx, o.Key+lockSuffix); sErr == nil {
+			continue
+		}
+
+		if lErr := lockBackupFile(ctx, s, o.Key, lockedUntil); lErr != nil {
+			result.Error = errors.WithMessagef(lErr, "failed to lock %s", o.Key)
+
+			return
+		}
+
+		result.Locked++
+	}
+}
+
+func lockBackupFile(ctx context.Context, s *localStorage, key string, lockedUntil time.Time) error {
+	b, err := json.Marshal(lockInfo{LockedUntil: lockedUntil})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = s.Put(ctx, key+lockSuffix, strings.NewReader(string(b)), int64(len(b))); err != nil {
+		return err
+	}
+
+	for _, k := range []string{key, key + lockSuffix} {
+		if err = os.Chmod(s.path(k), readOnlyFileMode); err != nil {
+			return errors.WithStack(err)
+		}
+
+		setImmutable(s.path(k))
+	}
+
+	return nil
+}
+
+// lockedKeys returns those keys whose lock sidecar has not yet expired.
+func lockedKeys(ctx context.Context, s Storage, keys []string, now time.Time) []string {
+	var locked []string
+
+	for _, key := range keys {
+		until, ok := readLock(ctx, s, key)
+		if ok && now.Before(until) {
+			locked = append(locked, key)
+		}
+	}
+
+	return locked
+}
+
+// readLock returns the expiry recorded in the sidecar for key. An unreadable
+// sidecar is treated as a lock that never expires so a damaged sidecar can
+// not be used to remove a backup early.
+func readLock(ctx context.Context, s Storage, key string) (time.Time, bool) {
+	var info lockInfo
+
+	r, err := s.Get(ctx, key+lockSuffix)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, false
+	}
+
+	if err == nil {
+		defer func() { _ = r.Close() }()
+
+		var b []byte
+
+		if b, err = io.ReadAll(r); err == nil {
+			err = json.Unmarshal(b, &info)
+		}
+	}
+
+	if err != nil {
+		logger.Printf("failed to read lock for %s, treating it as locked: %s", key, err)
+
+		return maxLockTime, true
+	}
+
+	return info.LockedUntil, true
+}
+
+// removeBackupFile deletes a backup file and its lock sidecar, first
+// clearing the read-only and immutable protection applied when it was
+// locked.
+func removeBackupFile(ctx context.Context, s Storage, key string) error {
+	for _, k := range []string{key, key + lockSuffix} {
+		if _, err := s.Stat(ctx, k); err != nil && k != key {
+			continue
+		}
+
+		if l, ok := s.(*localStorage); ok {
+			clearImmutable(l.path(k))
+
+			if err := os.Chmod(l.path(k), writableFileMode); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		if err := s.Delete(ctx, k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsImmutableFlag is FS_IMMUTABLE_FL from linux/fs.h.
+const fsImmutableFlag = 0x00000010
+
+var immutableUnsupported sync.Once
+
+// setImmutable sets the immutable attribute (chattr +i) on a file. This
+// requires CAP_LINUX_IMMUTABLE and a supporting filesystem, so failure is
+// logged once and otherwise ignored; the file remains read-only regardless.
+func setImmutable(path string) {
+	if err := updateFileFlags(path, func(flags uint32) uint32 { return flags | fsImmutableFlag }); err != nil {
+		immutableUnsupported.Do(func() {
+			logger.Printf("unable to set immutable attribute, files will only be made read-only: %s", err)
+		})
+	}
+}
+
+// clearImmutable removes the immutable attribute so a file can be deleted.
+// Any failure surfaces when the file is removed.
+func clearImmutable(path string) {
+	_ = updateFileFlags(path, func(flags uint32) uint32 { return flags &^ fsImmutableFlag })
+}
+
+func updateFileFlags(path string, update func(uint32) uint32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+
+	if updated := update(flags); updated != flags {
+		return unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(updated))
+	}
+
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package internal
+
+// setImmutable is a no-op on platforms without a Linux style immutable
+// attribute; locked files are still made read-only.
+func setImmutable(string) {}
+
+func clearImmutable(string) {}
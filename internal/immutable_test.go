@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImmutableRetentionSkipsLockedBackups(t *testing.T) {
+	root := t.TempDir()
+	s := newLocalStorage(root)
+
+	// the immutable attribute is set when running with CAP_LINUX_IMMUTABLE
+	// and would otherwise prevent the temporary directory being removed
+	t.Cleanup(func() {
+		_ = filepath.WalkDir(root, func(p string, _ os.DirEntry, _ error) error {
+			clearImmutable(p)
+
+			return nil
+		})
+	})
+
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101000000.bundle", "1")
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240102000000.bundle", "2")
+	writeBackupFile(t, root, "github.com/owner/repo/notes.txt", "not a backup")
+
+	since := time.Now().Add(-time.Minute)
+
+	var locked ImmutableResult
+
+	lockNewBackups(t.Context(), s, since, 7, &locked)
+	require.Nil(t, locked.Error)
+	require.Equal(t, 2, locked.Locked)
+
+	bundle := filepath.Join(root, "github.com/owner/repo/repo.20240101000000.bundle")
+	info, err := os.Stat(bundle)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(readOnlyFileMode), info.Mode().Perm())
+	require.FileExists(t, bundle+lockSuffix)
+	require.NoFileExists(t, filepath.Join(root, "github.com/owner/repo/notes.txt"+lockSuffix))
+
+	// locking again does not replace existing locks
+	locked = ImmutableResult{}
+	lockNewBackups(t.Context(), s, since, 7, &locked)
+	require.Zero(t, locked.Locked)
+
+	var result RetentionResult
+
+	applyRetention(t.Context(), s, retentionPolicy{Last: 1}, since, nil, time.Now(), &result)
+	require.Nil(t, result.Error)
+	require.Zero(t, result.Deleted)
+	require.Equal(t, []string{"github.com/owner/repo/repo.20240101000000.bundle"}, result.Locked)
+	require.FileExists(t, bundle)
+
+	// once the lock has expired the backup and its sidecar are removed
+	result = RetentionResult{}
+
+	applyRetention(t.Context(), s, retentionPolicy{Last: 1}, since, nil, time.Now().AddDate(0, 0, 8), &result)
+	require.Nil(t, result.Error)
+	require.Equal(t, 1, result.Deleted)
+	require.Empty(t, result.Locked)
+	require.NoFileExists(t, bundle)
+	require.NoFileExists(t, bundle+lockSuffix)
+}
+
+func TestImmutableDaysFromFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "days")
+	require.NoError(t, os.WriteFile(file, []byte("30\n"), 0o600))
+
+	t.Setenv(envSobaImmutableDays+envFileSuffix, file)
+
+	require.Equal(t, 30, immutableDays())
+}
+
+func TestUnreadableLockIsTreatedAsLocked(t *testing.T) {
+	root := t.TempDir()
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101000000.bundle", "1")
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101000000.bundle"+lockSuffix, "not json")
+
+	locked := lockedKeys(t.Context(), newLocalStorage(root), []string{"github.com/owner/repo/repo.20240101000000.bundle"}, time.Now())
+	require.Len(t, locked, 1)
+}
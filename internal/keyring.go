@@ -0,0 +1,474 @@
+package internal
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"gitlab.com/tozd/go/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keyringUsageName = "keyring-usage.json"
+
+	// passphrase fingerprints are derived with scrypt so the usage file,
+	// which is copied offsite with the rest of the backup directory, can not
+	// be used to cheaply test guesses of a passphrase.
+	keyringFingerprintSalt = "soba keyring fingerprint"
+	keyringScryptN         = 1 << 15
+	keyringScryptR         = 8
+	keyringScryptP         = 1
+	keyringFingerprintLen  = 8
+)
+
+// KeyringResult reports the latest backups re-encrypted with the current
+// passphrase so githosts can compare against them. Re-encryption only
+// happens when BUNDLE_KEYRING_REENCRYPT is enabled.
+type KeyringResult struct {
+	Reencrypted int      `json:"reencrypted"`
+	Error       errors.E `json:"error,omitempty"`
+}
+
+// keyringKey is a single passphrase or identity able to open backups.
+type keyringKey struct {
+	fingerprint string
+	identity    age.Identity
+}
+
+// keyring holds every key soba may need to open existing backups and
+// records which of them opened each file.
+type keyring struct {
+	keys    []*keyringKey
+	matched *keyringKey
+}
+
+// keyringIdentity notes when its key is the one that opened a file.
+type keyringIdentity struct {
+	key  *keyringKey
+	ring *keyring
+}
+
+func (i keyringIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	fileKey, err := i.key.identity.Unwrap(stanzas)
+	if err == nil {
+		i.ring.matched = i.key
+	}
+
+	return fileKey, err
+}
+
+// loadKeyring returns the keys held in the given passphrase variables,
+// BUNDLE_IDENTITIES and BUNDLE_KEYRING, in that order.
+func loadKeyring(passphraseEnvVars ...string) (*keyring, error) {
+	ring := &keyring{}
+
+	for _, envVar := range passphraseEnvVars {
+		if passphrase, _ := GetEnvOrFile(envVar); passphrase != "" {
+			if err := ring.addPassphrase(passphrase); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if value, _ := GetEnvOrFile(envVarBundleIdentities); value != "" {
+		ids, err := parseIdentities(value)
+		if err != nil {
+			return nil, errors.WithMessage(err, envVarBundleIdentities)
+		}
+
+		for _, id := range ids {
+			ring.addIdentity(id)
+		}
+	}
+
+	if value, _ := GetEnvOrFile(envVarBundleKeyring); value != "" {
+		if err := ring.addKeyring(value); err != nil {
+			return nil, errors.WithMessage(err, envVarBundleKeyring)
+		}
+	}
+
+	if len(ring.keys) == 0 {
+		names := append(append([]string{}, passphraseEnvVars...), envVarBundleIdentities, envVarBundleKeyring)
+
+		return nil, errors.Errorf("one of %s must be set", strings.Join(names, ", "))
+	}
+
+	return ring, nil
+}
+
+// addKeyring adds the keys in a keyring file: one per line, each either an
+// age identity (AGE-SECRET-KEY-...) or a passphrase. Blank lines and lines
+// starting with # are ignored.
+func (k *keyring) addKeyring(value string) error {
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "AGE-SECRET-KEY-") {
+			id, err := age.ParseX25519Identity(line)
+			if err != nil {
+				return errors.Wrap(err, "invalid age identity")
+			}
+
+			k.addIdentity(id)
+
+			continue
+		}
+
+		if err := k.addPassphrase(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (k *keyring) addPassphrase(passphrase string) error {
+	fingerprint, err := passphraseFingerprint(passphrase)
+	if err != nil {
+		return err
+	}
+
+	id, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	k.add(&keyringKey{fingerprint: fingerprint, identity: id})
+
+	return nil
+}
+
+func (k *keyring) addIdentity(id age.Identity) {
+	fingerprint := "identity"
+
+	switch i := id.(type) {
+	case *age.X25519Identity:
+		fingerprint = i.Recipient().String()
+	case interface{ Recipient() age.Recipient }:
+		if s, ok := i.Recipient().(interface{ String() string }); ok {
+			fingerprint = s.String()
+		}
+	}
+
+	k.add(&keyringKey{fingerprint: fingerprint, identity: id})
+}
+
+func (k *keyring) add(key *keyringKey) {
+	for _, existing := range k.keys {
+		if existing.fingerprint == key.fingerprint {
+			return
+		}
+	}
+
+	k.keys = append(k.keys, key)
+}
+
+// passphraseFingerprint returns a stable, non-reversible name for a
+// passphrase.
+func passphraseFingerprint(passphrase string) (string, error) {
+	b, err := scrypt.Key([]byte(passphrase), []byte(keyringFingerprintSalt),
+		keyringScryptN, keyringScryptR, keyringScryptP, keyringFingerprintLen)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return "passphrase:" + hex.EncodeToString(b), nil
+}
+
+// identities returns the keyring as age identities, tried in order.
+func (k *keyring) identities() []age.Identity {
+	ids := make([]age.Identity, len(k.keys))
+	for i, key := range k.keys {
+		ids[i] = keyringIdentity{key: key, ring: k}
+	}
+
+	return ids
+}
+
+// decrypt opens an encrypted file, returning the plaintext and the
+// fingerprint of the key that opened it.
+func (k *keyring) decrypt(r io.Reader) (io.Reader, string, error) {
+	k.matched = nil
+
+	plaintext, err := age.Decrypt(r, k.identities()...)
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+
+	return plaintext, k.matched.fingerprint, nil
+}
+
+// KeyringUsage records the key that last opened, or wrote, each encrypted
+// backup file. Once no file refers to a key it can be retired.
+type KeyringUsage struct {
+	UpdatedAt time.Time         `json:"updated_at"`
+	Files     map[string]string `json:"files"`
+}
+
+func loadKeyringUsage(backupDir string) (*KeyringUsage, error) {
+	usage := &KeyringUsage{Files: map[string]string{}}
+
+	if _, err := readStateJSON(backupDir, keyringUsageName, usage); err != nil {
+		return nil, err
+	}
+
+	if usage.Files == nil {
+		usage.Files = map[string]string{}
+	}
+
+	return usage, nil
+}
+
+// save writes the usage, forgetting files that no longer exist.
+func (u *KeyringUsage) save(ctx context.Context, backupDir string, s Storage) error {
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		return errors.Wrap(err, "failed to list backups")
+	}
+
+	present := make(map[string]bool, len(objects))
+	for _, o := range objects {
+		present[o.Key] = true
+	}
+
+	for key := range u.Files {
+		if !present[key] {
+			delete(u.Files, key)
+		}
+	}
+
+	u.UpdatedAt = time.Now().UTC()
+
+	return writeStateJSON(backupDir, keyringUsageName, u)
+}
+
+// counts returns the number of files last opened by each key.
+func (u *KeyringUsage) counts() map[string]int {
+	counts := make(map[string]int)
+	for _, fingerprint := range u.Files {
+		counts[fingerprint]++
+	}
+
+	return counts
+}
+
+// keyringManager keeps the latest backup of every repository readable with
+// the current BUNDLE_PASSPHRASE. githosts only knows the current passphrase
+// when comparing a repository with its latest backup, so after a passphrase
+// change the latest backups can be re-encrypted before any provider runs.
+type keyringManager struct {
+	backupDir string
+	storage   *localStorage
+	ring      *keyring
+	current   string
+	recipient age.Recipient
+	reencrypt bool
+	usage     *KeyringUsage
+	result    *KeyringResult
+}
+
+// newKeyringManager does nothing unless both BUNDLE_PASSPHRASE and
+// BUNDLE_KEYRING are set, as there is otherwise only one key in use.
+func newKeyringManager(backupDir string, storage *localStorage) *keyringManager {
+	m := &keyringManager{backupDir: backupDir, storage: storage}
+
+	passphrase, _ := GetEnvOrFile(envVarBundlePassphrase)
+	keys, _ := GetEnvOrFile(envVarBundleKeyring)
+
+	if passphrase == "" || keys == "" {
+		return m
+	}
+
+	m.result = &KeyringResult{}
+
+	ring, err := loadKeyring(envVarBundlePassphrase)
+	if err != nil {
+		m.result.Error = errors.Wrap(err, "failed to load keyring")
+
+		return m
+	}
+
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		m.result.Error = errors.WithStack(err)
+
+		return m
+	}
+
+	usage, err := loadKeyringUsage(backupDir)
+	if err != nil {
+		m.result.Error = errors.Wrap(err, "failed to load keyring usage")
+
+		return m
+	}
+
+	m.ring = ring
+	m.current = ring.keys[0].fingerprint
+	m.recipient = recipient
+	m.reencrypt = envTrue(envVarBundleReencrypt)
+	m.usage = usage
+
+	return m
+}
+
+// prepare records the key that opens the latest bundle and manifest of each
+// repository. With BUNDLE_KEYRING_REENCRYPT enabled, any needing an older
+// key are re-encrypted with the current passphrase. This rewrites them, so
+// their directories are signed again and re-uploaded to destinations.
+func (m *keyringManager) prepare(ctx context.Context) {
+	if m.ring == nil {
+		return
+	}
+
+	objects, err := m.storage.List(ctx, "")
+	if err != nil {
+		m.result.Error = errors.Wrap(err, "failed to list backups")
+
+		return
+	}
+
+	now := time.Now()
+
+	for _, sets := range groupBackupSets(objects) {
+		for _, key := range sets[0].keys {
+			if !strings.HasSuffix(key, bundleExtension+ageSuffix) && !strings.HasSuffix(key, manifestExtension+ageSuffix) {
+				continue
+			}
+
+			// without re-encryption a file's key does not change once known
+			if opened, ok := m.usage.Files[key]; opened == m.current || (ok && !m.reencrypt) {
+				continue
+			}
+
+			reencrypted, rErr := m.openWithCurrentKey(ctx, key, now)
+			if rErr != nil {
+				m.result.Error = errors.WithMessagef(rErr, "failed to open %s with keyring", key)
+
+				return
+			}
+
+			if reencrypted {
+				m.result.Reencrypted++
+			}
+		}
+	}
+
+	if err = m.usage.save(ctx, m.backupDir, m.storage); err != nil {
+		m.result.Error = errors.Wrap(err, "failed to save keyring usage")
+	}
+}
+
+// openWithCurrentKey records the key that opens a file and, if it is not
+// the current passphrase and re-encryption is enabled, replaces the file
+// with one encrypted to it.
+func (m *keyringManager) openWithCurrentKey(ctx context.Context, key string, now time.Time) (bool, error) {
+	src, err := m.storage.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = src.Close() }()
+
+	plaintext, fingerprint, err := m.ring.decrypt(src)
+	if err != nil {
+		return false, err
+	}
+
+	m.usage.Files[key] = fingerprint
+
+	// a locked backup can not be replaced; githosts will take a fresh
+	// backup rather than compare against it
+	if !m.reencrypt || fingerprint == m.current || len(lockedKeys(ctx, m.storage, []string{key}, now)) > 0 {
+		return false, nil
+	}
+
+	logger.Printf("keyring: re-encrypting %s, opened with %s, with the current passphrase", key, fingerprint)
+
+	encrypted := encryptingReader(plaintext, m.recipient)
+	defer func() { _ = encrypted.Close() }()
+
+	if err = m.storage.Put(ctx, key, encrypted, -1); err != nil {
+		return false, err
+	}
+
+	m.usage.Files[key] = m.current
+
+	return true, nil
+}
+
+// record notes that encrypted files written since the given time were
+// encrypted by githosts with the current passphrase.
+func (m *keyringManager) record(ctx context.Context, since time.Time) {
+	if m.ring == nil {
+		return
+	}
+
+	objects, err := m.storage.List(ctx, "")
+	if err != nil {
+		m.result.Error = errors.Wrap(err, "failed to list backups")
+
+		return
+	}
+
+	for _, o := range objects {
+		if strings.HasSuffix(o.Key, ageSuffix) && !o.ModTime.Before(since) {
+			m.usage.Files[o.Key] = m.current
+		}
+	}
+
+	if err = m.usage.save(ctx, m.backupDir, m.storage); err != nil {
+		m.result.Error = errors.Wrap(err, "failed to save keyring usage")
+	}
+}
+
+// runKeyring prints how many backup files each key last opened, so keys no
+// longer needed can be retired.
+func runKeyring(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: soba keyring")
+	}
+
+	backupDir, err := commandBackupDir()
+	if err != nil {
+		return err
+	}
+
+	ring, err := loadKeyring(envVarBundlePassphrase, envVarBundlePassphraseOld)
+	if err != nil {
+		return err
+	}
+
+	usage, err := loadKeyringUsage(backupDir)
+	if err != nil {
+		return err
+	}
+
+	counts := usage.counts()
+
+	for _, key := range ring.keys {
+		_, _ = fmt.Fprintf(os.Stdout, "%s\t%d files\n", key.fingerprint, counts[key.fingerprint])
+		delete(counts, key.fingerprint)
+	}
+
+	unknown := make([]string, 0, len(counts))
+	for fingerprint := range counts {
+		unknown = append(unknown, fingerprint)
+	}
+
+	sort.Strings(unknown)
+
+	for _, fingerprint := range unknown {
+		_, _ = fmt.Fprintf(os.Stdout, "%s\t%d files (not in keyring)\n", fingerprint, counts[fingerprint])
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadKeyring(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	keyringFile := filepath.Join(t.TempDir(), "keyring")
+	require.NoError(t, os.WriteFile(keyringFile, []byte("# retired in 2024\nold\n\n"+identity.String()+"\nnew\n"), 0o600))
+
+	t.Setenv(envVarBundlePassphrase, "new")
+	t.Setenv(envVarBundleIdentities, "")
+	t.Setenv(envVarBundleKeyring, "")
+	require.NoError(t, os.Unsetenv(envVarBundleKeyring))
+	t.Setenv(envVarBundleKeyring+"_FILE", keyringFile)
+
+	ring, err := loadKeyring(envVarBundlePassphrase)
+	require.NoError(t, err)
+	require.Len(t, ring.keys, 3)
+
+	current, err := passphraseFingerprint("new")
+	require.NoError(t, err)
+	require.Equal(t, current, ring.keys[0].fingerprint)
+	require.Equal(t, identity.Recipient().String(), ring.keys[2].fingerprint)
+
+	backupDir := t.TempDir()
+	writeEncryptedBackupFile(t, backupDir, "repo.20240101000000.bundle.age", "content", "old")
+
+	f, err := os.Open(filepath.Join(backupDir, "repo.20240101000000.bundle.age"))
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	_, fingerprint, err := ring.decrypt(f)
+	require.NoError(t, err)
+
+	old, err := passphraseFingerprint("old")
+	require.NoError(t, err)
+	require.Equal(t, old, fingerprint)
+
+	t.Setenv(envVarBundlePassphrase, "")
+	t.Setenv(envVarBundleKeyring+"_FILE", "")
+
+	_, err = loadKeyring(envVarBundlePassphrase)
+	require.ErrorContains(t, err, "must be set")
+}
+
+func TestKeyringManagerReencryptsLatestBackups(t *testing.T) {
+	backupDir := t.TempDir()
+	writeEncryptedBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle.age", "one", "old")
+	writeEncryptedBackupFile(t, backupDir, "github.com/owner/repo/repo.20240102000000.bundle.age", "two", "old")
+	writeEncryptedBackupFile(t, backupDir, "github.com/owner/repo/repo.20240102000000.manifest.age", "{}", "new")
+
+	t.Setenv(envVarBundlePassphrase, "new")
+	t.Setenv(envVarBundleIdentities, "")
+	t.Setenv(envVarBundleKeyring, "old")
+	t.Setenv(envVarBundleReencrypt, "true")
+
+	m := newKeyringManager(backupDir, newLocalStorage(backupDir))
+	require.NotNil(t, m.result)
+	require.Nil(t, m.result.Error)
+
+	m.prepare(t.Context())
+	require.Nil(t, m.result.Error)
+	require.Equal(t, 1, m.result.Reencrypted)
+
+	newIdentity, err := age.NewScryptIdentity("new")
+	require.NoError(t, err)
+
+	oldIdentity, err := age.NewScryptIdentity("old")
+	require.NoError(t, err)
+
+	dir := filepath.Join(backupDir, "github.com/owner/repo")
+	require.Equal(t, "two", decryptBackupFile(t, filepath.Join(dir, "repo.20240102000000.bundle.age"), newIdentity))
+	require.Equal(t, "one", decryptBackupFile(t, filepath.Join(dir, "repo.20240101000000.bundle.age"), oldIdentity))
+
+	usage, err := loadKeyringUsage(backupDir)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{m.current: 2}, usage.counts())
+
+	// files already recorded against the current passphrase are not reopened
+	m.prepare(t.Context())
+	require.Nil(t, m.result.Error)
+	require.Equal(t, 1, m.result.Reencrypted)
+}
+
+func TestKeyringManagerRecordsWithoutReencrypting(t *testing.T) {
+	backupDir := t.TempDir()
+	writeEncryptedBackupFile(t, backupDir, "github.com/owner/repo/repo.20240102000000.bundle.age", "two", "old")
+	writeEncryptedBackupFile(t, backupDir, "github.com/owner/repo/repo.20240102000000.manifest.age", "{}", "new")
+
+	t.Setenv(envVarBundlePassphrase, "new")
+	t.Setenv(envVarBundleIdentities, "")
+	t.Setenv(envVarBundleKeyring, "old")
+	t.Setenv(envVarBundleReencrypt, "")
+
+	m := newKeyringManager(backupDir, newLocalStorage(backupDir))
+	require.NotNil(t, m.result)
+
+	key := filepath.Join(backupDir, "github.com/owner/repo/repo.20240102000000.bundle.age")
+	before, err := os.Stat(key)
+	require.NoError(t, err)
+
+	m.prepare(t.Context())
+	require.Nil(t, m.result.Error)
+	require.Zero(t, m.result.Reencrypted)
+
+	oldIdentity, err := age.NewScryptIdentity("old")
+	require.NoError(t, err)
+	require.Equal(t, "two", decryptBackupFile(t, key, oldIdentity))
+
+	after, err := os.Stat(key)
+	require.NoError(t, err)
+	require.Equal(t, before.ModTime(), after.ModTime())
+
+	usage, err := loadKeyringUsage(backupDir)
+	require.NoError(t, err)
+	require.Len(t, usage.counts(), 2)
+	require.Equal(t, 1, usage.counts()[m.current])
+}
+
+func TestKeyringManagerRequiresKeyring(t *testing.T) {
+	t.Setenv(envVarBundlePassphrase, "new")
+	t.Setenv(envVarBundleKeyring, "")
+
+	backupDir := t.TempDir()
+	m := newKeyringManager(backupDir, newLocalStorage(backupDir))
+	require.Nil(t, m.result)
+
+	// without a keyring nothing is done
+	m.prepare(t.Context())
+	m.record(t.Context(), time.Time{})
+	require.NoFileExists(t, statePath(backupDir, keyringUsageName))
+}
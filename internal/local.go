@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envLocalRepoDirs  = "LOCAL_REPO_DIRS"
+	envLocalRepoDepth = "LOCAL_REPO_DEPTH"
+	envLocalBackups   = "LOCAL_BACKUPS"
+	envLocalBackupLFS = "LOCAL_BACKUP_LFS"
+
+	localDomain       = "local"
+	defaultLocalDepth = 3
+)
+
+// Local backs up the git repositories found in the directories listed in
+// LOCAL_REPO_DIRS, bare or not, to local/<absolute path> so repositories
+// only held on disk are backed up without serving them over HTTP.
+func Local(backupDir string) *ProviderBackupResults {
+	logger.Println("backing up local repos")
+
+	dirs := localRepoDirs()
+	if len(dirs) == 0 {
+		logger.Println("Skipping local backup as", envLocalRepoDirs, "is missing")
+
+		return &ProviderBackupResults{
+			Provider: providerNameLocal,
+			Results: githosts.ProviderBackupResult{
+				BackupResults: []githosts.RepoBackupResults{},
+				Error:         errors.New("local repository directories are not set"),
+			},
+		}
+	}
+
+	depth, err := localRepoDepth()
+	if err != nil {
+		return &ProviderBackupResults{
+			Provider: providerNameLocal,
+			Results: githosts.ProviderBackupResult{
+				BackupResults: []githosts.RepoBackupResults{},
+				Error:         errors.WithStack(err),
+			},
+		}
+	}
+
+	return &ProviderBackupResults{
+		Provider: providerNameLocal,
+		Results:  backupLocalRepos(backupDir, dirs, depth, envTrue(envLocalBackupLFS)),
+	}
+}
+
+// backupLocalRepos backs up each repository found in dirs, adding a result
+// for each and failing the provider if a directory can not be scanned.
+func backupLocalRepos(backupDir string, dirs []string, depth int, lfs bool) githosts.ProviderBackupResult {
+	ctx := context.Background()
+	storage := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+	results := githosts.ProviderBackupResult{BackupResults: []githosts.RepoBackupResults{}}
+	remote := gitRemote{lfs: lfs}
+	seen := make(map[string]bool)
+
+	for _, dir := range dirs {
+		// repositories under a directory that could not be read are
+		// unknown, so none may be reported missing upstream
+		repos, err := findLocalRepos(dir, depth, backupDir)
+		if err != nil {
+			logger.Printf("failed to scan %s: %s", dir, err)
+
+			if results.Error == nil {
+				results.Error = errors.WithMessagef(err, "failed to scan %s", dir)
+			}
+		}
+
+		for _, repoDir := range repos {
+			repo := localRepoPath(repoDir)
+			if seen[repo] {
+				continue
+			}
+
+			seen[repo] = true
+
+			found, bErr := backupGitRepo(ctx, storage, remote, repoDir, repo, envLocalBackups)
+
+			switch {
+			case bErr != nil:
+				logger.Printf("failed to back up %s: %s", repoDir, bErr)
+
+				results.BackupResults = append(results.BackupResults,
+					githosts.RepoBackupResults{Repo: repo, Status: repoStatusFailed, Error: errors.WithStack(bErr)})
+			case found:
+				results.BackupResults = append(results.BackupResults, githosts.RepoBackupResults{Repo: repo, Status: repoStatusOK})
+			default:
+				logger.Printf("skipping empty repository %s", repoDir)
+			}
+		}
+	}
+
+	return results
+}
+
+// findLocalRepos returns the absolute paths of the git repositories in dir
+// and its subdirectories up to depth levels below it. A repository's own
+// subdirectories are not searched, nor is soba's backup or working directory.
+// A subdirectory that can not be read is skipped, and the repositories found
+// elsewhere are returned along with an error naming it.
+func findLocalRepos(dir string, depth int, backupDir string) ([]string, error) {
+	root, err := filepath.Abs(dir)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	skip := make(map[string]bool)
+	rootBackupDir, _ := GetEnvOrFile(envGitBackupDir)
+
+	for _, d := range []string{backupDir, resolveWorkingDir(backupDir), rootBackupDir} {
+		if abs, aErr := filepath.Abs(d); d != "" && aErr == nil {
+			skip[abs] = true
+		}
+	}
+
+	var (
+		repos   []string
+		skipped []error
+	)
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			if p == root {
+				return walkErr
+			}
+
+			logger.Printf("skipping %s: %s", p, walkErr)
+
+			skipped = append(skipped, walkErr)
+
+			return fs.SkipDir
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if rel, _ := filepath.Rel(root, p); rel != "." && strings.Count(rel, string(filepath.Separator)) >= depth {
+			return fs.SkipDir
+		}
+
+		if skip[p] || d.Name() == ".git" {
+			return fs.SkipDir
+		}
+
+		if isLocalRepo(p) {
+			repos = append(repos, p)
+
+			return fs.SkipDir
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if len(skipped) > 0 {
+		return repos, errors.Join(skipped...)
+	}
+
+	return repos, nil
+}
+
+// isLocalRepo reports whether dir is a working tree, with a .git directory
+// or file, or a bare repository.
+func isLocalRepo(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return true
+	}
+
+	for _, name := range []string{"HEAD", "refs", "objects"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// localRepoPath returns the backup path of a repository, its absolute path
+// under local/ without a trailing .git.
+func localRepoPath(dir string) string {
+	p := filepath.ToSlash(strings.TrimPrefix(dir, filepath.VolumeName(dir)))
+
+	return path.Join(localDomain, strings.TrimSuffix(strings.Trim(p, "/"), ".git"))
+}
+
+// localRepoDirs returns the directories listed in LOCAL_REPO_DIRS, separated
+// by commas or newlines.
+func localRepoDirs() []string {
+	list, _ := GetEnvOrFile(envLocalRepoDirs)
+
+	var dirs []string
+
+	for _, dir := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs
+}
+
+// localRepoDepth returns how many levels below each of LOCAL_REPO_DIRS are
+// searched for repositories.
+func localRepoDepth() (int, error) {
+	value, _ := GetEnvOrFile(envLocalRepoDepth)
+	if value == "" {
+		return defaultLocalDepth, nil
+	}
+
+	depth, err := strconv.Atoi(value)
+	if err != nil || depth < 0 {
+		return 0, errors.Errorf("%s must be a non-negative integer", envLocalRepoDepth)
+	}
+
+	return depth, nil
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindLocalRepos(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	root := t.TempDir()
+	backupDir := filepath.Join(root, "backups")
+
+	for _, dir := range []string{"work", "team/app", "a/b/c/too-deep"} {
+		runGit(t, "", "init", "-q", filepath.Join(root, dir))
+	}
+
+	for _, dir := range []string{"srv/bare.git", "backups/example.com/bare.git"} {
+		runGit(t, "", "init", "-q", "--bare", filepath.Join(root, dir))
+	}
+
+	// repositories are not searched for nested repositories
+	runGit(t, "", "init", "-q", filepath.Join(root, "work", "vendor", "nested"))
+
+	repos, err := findLocalRepos(root, 3, backupDir)
+	require.NoError(t, err)
+
+	var rel []string
+
+	for _, repo := range repos {
+		r, rErr := filepath.Rel(root, repo)
+		require.NoError(t, rErr)
+
+		rel = append(rel, filepath.ToSlash(r))
+	}
+
+	require.ElementsMatch(t, []string{"work", "team/app", "srv/bare.git"}, rel)
+
+	repos, err = findLocalRepos(root, 1, backupDir)
+	require.NoError(t, err)
+	require.Len(t, repos, 1)
+
+	_, err = findLocalRepos(filepath.Join(root, "missing"), 3, backupDir)
+	require.Error(t, err)
+}
+
+func TestFindLocalReposUnreadable(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any directory")
+	}
+
+	root := t.TempDir()
+
+	runGit(t, "", "init", "-q", filepath.Join(root, "work"))
+	runGit(t, "", "init", "-q", filepath.Join(root, "locked", "app"))
+
+	locked := filepath.Join(root, "locked")
+	require.NoError(t, os.Chmod(locked, 0))
+	t.Cleanup(func() { _ = os.Chmod(locked, 0o700) })
+
+	// the repositories found elsewhere are returned, along with the error
+	repos, err := findLocalRepos(root, 3, filepath.Join(root, "backups"))
+	require.Error(t, err)
+	require.Len(t, repos, 1)
+
+	// and the provider fails so none are reported missing upstream
+	results := backupLocalRepos(t.TempDir(), []string{root}, 3, false)
+	require.ErrorContains(t, results.Error, "failed to scan")
+}
+
+func TestLocalRepoPath(t *testing.T) {
+	require.Equal(t, "local/srv/git/app", localRepoPath("/srv/git/app.git"))
+	require.Equal(t, "local/home/build/work", localRepoPath("/home/build/work"))
+}
+
+func TestLocalRepoDepth(t *testing.T) {
+	t.Setenv(envLocalRepoDepth, "")
+
+	depth, err := localRepoDepth()
+	require.NoError(t, err)
+	require.Equal(t, defaultLocalDepth, depth)
+
+	t.Setenv(envLocalRepoDepth, "0")
+
+	depth, err = localRepoDepth()
+	require.NoError(t, err)
+	require.Zero(t, depth)
+
+	for _, value := range []string{"-1", "deep"} {
+		t.Setenv(envLocalRepoDepth, value)
+
+		_, err = localRepoDepth()
+		require.Error(t, err)
+	}
+}
+
+func TestBackupLocalRepos(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	repos := t.TempDir()
+	work := filepath.Join(repos, "work")
+
+	runGit(t, "", "init", "-q", work)
+	gitCommit(t, work, "first")
+	runGit(t, "", "clone", "-q", "--bare", work, filepath.Join(repos, "bare.git"))
+	runGit(t, "", "init", "-q", filepath.Join(repos, "empty"))
+
+	t.Setenv(envLocalBackups, "2")
+
+	backupDir := t.TempDir()
+
+	root, err := filepath.EvalSymlinks(repos)
+	require.NoError(t, err)
+
+	results := backupLocalRepos(backupDir, []string{repos, filepath.Join(repos, "missing")}, 1, false)
+	require.Len(t, results.BackupResults, 2)
+	require.Contains(t, results.BackupResults, githosts.RepoBackupResults{Repo: localRepoPath(work), Status: repoStatusOK})
+	require.Contains(t, results.BackupResults,
+		githosts.RepoBackupResults{Repo: localRepoPath(filepath.Join(root, "bare.git")), Status: repoStatusOK})
+	require.ErrorContains(t, results.Error, "failed to scan")
+
+	// an unchanged repository is not stored again, a changed one is
+	time.Sleep(time.Second)
+	gitCommit(t, work, "second")
+	backupLocalRepos(backupDir, []string{repos}, 1, false)
+
+	objects, err := newLocalStorage(backupDir, resolveWorkingDir(backupDir)).List(t.Context(), "")
+	require.NoError(t, err)
+
+	sets := groupBackupSets(objects)
+	require.Len(t, sets[localRepoPath(filepath.Join(root, "work"))], 2)
+	require.Len(t, sets[localRepoPath(filepath.Join(root, "bare.git"))], 1)
+
+	_, err = os.Stat(filepath.Join(backupDir, localDomain))
+	require.NoError(t, err)
+}
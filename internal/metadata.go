@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envGitHubBackupMetadata = "GITHUB_BACKUP_METADATA"
+	envGitLabBackupMetadata = "GITLAB_BACKUP_METADATA"
+	envGiteaBackupMetadata  = "GITEA_BACKUP_METADATA"
+
+	metadataSuffix = ".metadata"
+
+	// metadataVersion is incremented when the archive's content changes.
+	metadataVersion = 1
+)
+
+// metadataArchive is a snapshot of a repository's settings, each section as
+// returned by the API. Sections the token can not read are omitted.
+type metadataArchive struct {
+	exportHeader
+
+	Metadata map[string]json.RawMessage `json:"metadata"`
+}
+
+// metadataSection is part of a repository's metadata and the API path it is
+// read from.
+type metadataSection struct {
+	name  string
+	path  string
+	query url.Values
+	// list is set for paths returning a paginated list
+	list bool
+}
+
+// metadataSource describes how a provider's repository metadata is read.
+type metadataSource struct {
+	client        apiClient
+	domain        string
+	backupsEnvVar string
+	sections      func(repo string) []metadataSection
+	// volatile are the fields of the repository that change with activity
+	// rather than configuration, e.g. its star count, which are dropped so
+	// a new snapshot is only stored when a setting changes
+	volatile []string
+	// extra, if set, reads metadata that depends on the sections read, e.g.
+	// the protection of each protected branch
+	extra func(ctx context.Context, c apiClient, repo string, metadata map[string]json.RawMessage) error
+}
+
+func gitHubMetadataSource(token string) metadataSource {
+	client, domain := gitHubAPIClient(token)
+
+	return metadataSource{
+		client: client, domain: domain, backupsEnvVar: envGitHubBackups,
+		sections: func(repo string) []metadataSection {
+			p := "repos/" + repo
+
+			return []metadataSection{
+				{name: "repository", path: p},
+				{name: "collaborators", path: p + "/collaborators", list: true},
+				{name: "teams", path: p + "/teams", list: true},
+				{name: "webhooks", path: p + "/hooks", list: true},
+				{name: "protected_branches", path: p + "/branches", query: url.Values{"protected": {"true"}}, list: true},
+			}
+		},
+		volatile: []string{
+			"pushed_at", "updated_at", "size", "stargazers_count", "watchers_count", "watchers", "forks_count",
+			"forks", "open_issues_count", "open_issues", "network_count", "subscribers_count",
+		},
+		extra: gitHubBranchProtection,
+	}
+}
+
+// gitHubBranchProtection reads the rules protecting each protected branch,
+// which the branches list only summarises.
+func gitHubBranchProtection(ctx context.Context, c apiClient, repo string, metadata map[string]json.RawMessage) error {
+	var branches []struct {
+		Name string `json:"name"`
+	}
+
+	if b, ok := metadata["protected_branches"]; !ok || json.Unmarshal(b, &branches) != nil || len(branches) == 0 {
+		return nil
+	}
+
+	protection := make(map[string]json.RawMessage, len(branches))
+
+	for _, branch := range branches {
+		var rules json.RawMessage
+
+		err := c.get(ctx, "repos/"+repo+"/branches/"+url.PathEscape(branch.Name)+"/protection", nil, &rules)
+
+		switch {
+		case errors.Is(err, errAPIUnavailable), errors.Is(err, errAPIForbidden):
+			continue
+		case err != nil:
+			return err
+		}
+
+		protection[branch.Name] = rules
+	}
+
+	b, err := json.Marshal(protection)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	metadata["branch_protection"] = b
+
+	return nil
+}
+
+func gitLabMetadataSource(token string) metadataSource {
+	client, domain := gitLabAPIClient(token)
+
+	return metadataSource{
+		client: client, domain: domain, backupsEnvVar: envGitLabBackups,
+		// the project includes its topics and the groups it is shared with
+		sections: func(repo string) []metadataSection {
+			p := "projects/" + url.PathEscape(repo)
+
+			return []metadataSection{
+				{name: "repository", path: p},
+				{name: "members", path: p + "/members", list: true},
+				{name: "webhooks", path: p + "/hooks", list: true},
+				{name: "protected_branches", path: p + "/protected_branches", list: true},
+			}
+		},
+		volatile: []string{"last_activity_at", "updated_at", "star_count", "forks_count", "open_issues_count"},
+	}
+}
+
+func giteaMetadataSource(token string) metadataSource {
+	_, domain := wikiBaseURL(os.Getenv(envGiteaAPIURL), "")
+
+	return metadataSource{
+		client: apiClient{
+			baseURL: os.Getenv(envGiteaAPIURL),
+			header:  http.Header{"Authorization": {"token " + token}},
+		},
+		domain: domain, backupsEnvVar: envGiteaBackups,
+		sections: func(repo string) []metadataSection {
+			p := "repos/" + repo
+
+			return []metadataSection{
+				{name: "repository", path: p},
+				{name: "topics", path: p + "/topics"},
+				{name: "collaborators", path: p + "/collaborators", list: true},
+				{name: "teams", path: p + "/teams", list: true},
+				{name: "webhooks", path: p + "/hooks", list: true},
+				{name: "protected_branches", path: p + "/branch_protections", list: true},
+			}
+		},
+		volatile: []string{
+			"updated_at", "size", "stars_count", "forks_count", "watchers_count", "open_issues_count",
+			"open_pr_counter", "release_counter",
+		},
+	}
+}
+
+// exportMetadata snapshots the settings of each repository backed up
+// successfully to <repo>.metadata next to the repository's bundles, storing
+// a new snapshot only when they change.
+func exportMetadata(backupDir string, source metadataSource, results *githosts.ProviderBackupResult) {
+	if source.client.baseURL == "" {
+		return
+	}
+
+	storage := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+
+	exportRepos(results, source.domain, metadataSuffix, func(ctx context.Context, repo string) error {
+		archive := &metadataArchive{exportHeader: exportHeader{Version: metadataVersion, Repository: repo}}
+
+		_, err := updateExport(ctx, storage, path.Join(source.domain, repo+metadataSuffix), source.backupsEnvVar, archive,
+			func(time.Time) error {
+				metadata, fErr := fetchMetadata(ctx, source, repo)
+				archive.Metadata = metadata
+
+				return fErr
+			})
+
+		return err
+	})
+}
+
+// fetchMetadata reads each section of a repository's metadata, skipping
+// those the token does not have permission to read.
+func fetchMetadata(ctx context.Context, source metadataSource, repo string) (map[string]json.RawMessage, error) {
+	metadata := make(map[string]json.RawMessage)
+
+	for _, section := range source.sections(repo) {
+		var (
+			value json.RawMessage
+			err   error
+		)
+
+		if section.list {
+			query := url.Values{"per_page": {gitHubPageSize}}
+			for k, v := range section.query {
+				query[k] = v
+			}
+
+			var objects []json.RawMessage
+
+			if err = source.client.getPages(ctx, section.path, query, appendPage(&objects)); err == nil {
+				if objects == nil {
+					objects = []json.RawMessage{}
+				}
+
+				value, err = json.Marshal(objects)
+			}
+		} else {
+			err = source.client.get(ctx, section.path, section.query, &value)
+		}
+
+		switch {
+		case errors.Is(err, errAPIUnavailable), errors.Is(err, errAPIForbidden):
+			continue
+		case err != nil:
+			return nil, errors.WithMessage(err, section.name)
+		}
+
+		if section.name == "repository" {
+			if value, err = withoutFields(value, source.volatile); err != nil {
+				return nil, errors.WithMessage(err, section.name)
+			}
+		}
+
+		metadata[section.name] = value
+	}
+
+	if source.extra != nil {
+		if err := source.extra(ctx, source.client, repo, metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	return metadata, nil
+}
+
+// withoutFields returns a JSON object without the given fields.
+func withoutFields(object json.RawMessage, fields []string) (json.RawMessage, error) {
+	if len(fields) == 0 {
+		return object, nil
+	}
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(object, &m); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for _, f := range fields {
+		delete(m, f)
+	}
+
+	b, err := json.Marshal(m)
+
+	return b, errors.WithStack(err)
+}
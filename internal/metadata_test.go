@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/jonhadfield/githosts-utils/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportMetadata(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		description = "first"
+		stars       = "1"
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/repos/owner/repo":
+			_, _ = w.Write([]byte(`{"id":1,"description":"` + description + `","default_branch":"main",` +
+				`"topics":["backup"],"visibility":"private","stargazers_count":` + stars + `}`))
+		case "/repos/owner/repo/collaborators":
+			http.Error(w, `{"message":"Must have push access to view repository collaborators."}`, http.StatusForbidden)
+		case "/repos/owner/repo/branches":
+			_, _ = w.Write([]byte(`[{"name":"main","protected":true}]`))
+		case "/repos/owner/repo/branches/main/protection":
+			_, _ = w.Write([]byte(`{"enforce_admins":{"enabled":true}}`))
+		case "/repos/owner/repo/teams", "/repos/owner/repo/hooks":
+			_, _ = w.Write([]byte(`[]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv(envGitHubAPIURL, server.URL)
+	t.Setenv(envGitHubBackups, "5")
+	t.Setenv(envVarBundlePassphrase, "")
+	_ = os.Unsetenv(envVarBundlePassphrase)
+
+	backupDir := t.TempDir()
+	s := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+	dir := path.Join("127.0.0.1", "owner/repo"+metadataSuffix)
+
+	export := func() []*backupSet {
+		t.Helper()
+
+		results := githosts.ProviderBackupResult{BackupResults: []githosts.RepoBackupResults{
+			{Repo: "owner/repo", Status: repoStatusOK},
+		}}
+
+		exportMetadata(backupDir, gitHubMetadataSource("token"), &results)
+		require.Equal(t, githosts.RepoBackupResults{Repo: "owner/repo.metadata", Status: repoStatusOK}, results.BackupResults[1])
+
+		objects, err := s.List(t.Context(), "")
+		require.NoError(t, err)
+
+		return groupBackupSets(objects)[dir]
+	}
+
+	sets := export()
+	require.Len(t, sets, 1)
+
+	var archive metadataArchive
+
+	found, err := readExport(t.Context(), s, sets[0], &archive)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.JSONEq(t, `{"default_branch":"main","description":"first","id":1,"topics":["backup"],"visibility":"private"}`,
+		string(archive.Metadata["repository"]))
+	require.JSONEq(t, `{"main":{"enforce_admins":{"enabled":true}}}`, string(archive.Metadata["branch_protection"]))
+	require.NotContains(t, archive.Metadata, "collaborators")
+	require.Contains(t, archive.Metadata, "webhooks")
+
+	// activity alone does not change the snapshot
+	time.Sleep(time.Second)
+
+	mu.Lock()
+	stars = "2"
+	mu.Unlock()
+
+	require.Len(t, export(), 1)
+
+	// a changed setting is stored as a new snapshot
+	mu.Lock()
+	description = "second"
+	mu.Unlock()
+
+	require.Len(t, export(), 2)
+
+	// once encrypted to recipients the archive can not be read back, and is
+	// compared by the digest recorded in the state directory instead
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	var encrypted EncryptionResult
+
+	encryptBackups(t.Context(), s, time.Now(), []age.Recipient{identity.Recipient()}, &encrypted)
+	require.Nil(t, encrypted.Error)
+	require.Equal(t, 2, encrypted.Encrypted)
+
+	time.Sleep(time.Second)
+
+	require.Len(t, export(), 2)
+
+	mu.Lock()
+	description = "third"
+	mu.Unlock()
+
+	require.Len(t, export(), 3)
+}
@@ -0,0 +1,285 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"io"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	migrateEncrypt = "encrypt"
+	migrateDecrypt = "decrypt"
+)
+
+// MigrateReport lists every file converted by a migration.
+type MigrateReport struct {
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt time.Time     `json:"finished_at"`
+	Mode       string        `json:"mode"`
+	DryRun     bool          `json:"dry_run,omitempty"`
+	Migrated   []string      `json:"migrated"`
+	Failed     []FileFailure `json:"failed,omitempty"`
+}
+
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list the files that would be converted without changing them")
+
+	flags.Usage = func() {
+		_, _ = io.WriteString(flags.Output(), "usage: soba migrate [-dry-run] encrypt|decrypt\n\n"+
+			"encrypt  encrypts plaintext bundles, manifests and LFS archives with "+envVarBundlePassphrase+" or "+envVarBundleRecipients+"\n"+
+			"decrypt  decrypts .age files with "+envVarBundlePassphrase+", "+envVarBundleIdentities+" or "+envVarBundleKeyring+"\n\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+
+		return errors.WithStack(err)
+	}
+
+	mode := flags.Arg(0)
+	if flags.NArg() != 1 || (mode != migrateEncrypt && mode != migrateDecrypt) {
+		flags.Usage()
+
+		return errors.New("migrate requires either encrypt or decrypt")
+	}
+
+	backupDir, err := commandBackupDir()
+	if err != nil {
+		return err
+	}
+
+	m := &migrator{
+		storage: newLocalStorage(backupDir, resolveWorkingDir(backupDir)),
+	}
+
+	// identities are needed to decrypt, and if available are used to check
+	// each encrypted file can be read back before the original is removed
+	ring, err := loadKeyring(envVarBundlePassphrase)
+
+	switch {
+	case err == nil:
+		m.identities = ring.identities()
+	case mode == migrateDecrypt:
+		return err
+	}
+
+	if mode == migrateEncrypt {
+		if m.recipients, err = encryptionRecipients(); err != nil {
+			return err
+		}
+	}
+
+	report, err := m.run(context.Background(), mode, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	if !*dryRun {
+		if err = signChecksums(context.Background(), m.storage, report.StartedAt); err != nil {
+			return err
+		}
+	}
+
+	name := "migrate-" + mode + "-report-" + report.StartedAt.Format(timeStampFormat) + ".json"
+	if err = writeStateJSON(backupDir, name, report); err != nil {
+		return err
+	}
+
+	logger.Printf("migrate %s: %d converted, %d failed; report written to %s",
+		mode, len(report.Migrated), len(report.Failed), statePath(backupDir, name))
+
+	if len(report.Failed) > 0 {
+		return errors.Errorf("failed to %s %d files", mode, len(report.Failed))
+	}
+
+	return nil
+}
+
+type migrator struct {
+	storage    *localStorage
+	identities []age.Identity
+	recipients []age.Recipient
+}
+
+// run converts every backup file not already in the requested form. The
+// original is only removed once the converted copy has been read back and
+// matches it, so an interrupted migration can simply be run again.
+func (m *migrator) run(ctx context.Context, mode string, dryRun bool) (*MigrateReport, error) {
+	report := &MigrateReport{StartedAt: time.Now().UTC(), Mode: mode, DryRun: dryRun}
+
+	objects, err := m.storage.List(ctx, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list backups")
+	}
+
+	for _, o := range objects {
+		_, ok := parseBackupFile(o.Key)
+		if !ok || strings.HasSuffix(o.Key, refsSuffix) || strings.HasSuffix(o.Key, ageSuffix) != (mode == migrateDecrypt) {
+			continue
+		}
+
+		// replacing a file would defeat the protection of immutable mode
+		if len(lockedKeys(ctx, m.storage, []string{o.Key}, time.Now())) > 0 {
+			report.Failed = append(report.Failed, FileFailure{Key: o.Key, Error: "backup is locked"})
+
+			continue
+		}
+
+		if dryRun {
+			report.Migrated = append(report.Migrated, o.Key)
+
+			continue
+		}
+
+		if mode == migrateEncrypt {
+			err = m.encrypt(ctx, o.Key)
+		} else {
+			err = m.decrypt(ctx, o.Key)
+		}
+
+		if err != nil {
+			logger.Printf("migrate: failed to %s %s: %s", mode, o.Key, err)
+
+			report.Failed = append(report.Failed, FileFailure{Key: o.Key, Error: err.Error()})
+
+			continue
+		}
+
+		report.Migrated = append(report.Migrated, o.Key)
+	}
+
+	report.FinishedAt = time.Now().UTC()
+
+	return report, nil
+}
+
+func (m *migrator) encrypt(ctx context.Context, key string) error {
+	src, err := m.storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	plainHash := sha256.New()
+
+	encrypted := encryptingReader(io.TeeReader(src, plainHash), m.recipients...)
+	defer func() { _ = encrypted.Close() }()
+
+	target := key + ageSuffix
+
+	// the original is read again and compared with what was encrypted
+	// before the encrypted file is renamed into place
+	checked := &checkedReader{r: encrypted, check: func() error {
+		sum, sErr := storageChecksum(ctx, m.storage, key, sha256.New())
+		if sErr != nil {
+			return sErr
+		}
+
+		if !bytes.Equal(sum, plainHash.Sum(nil)) {
+			return errors.New("original changed while it was encrypted")
+		}
+
+		return nil
+	}}
+
+	if err = m.storage.Put(ctx, target, checked, -1); err != nil {
+		return err
+	}
+
+	if len(m.identities) > 0 {
+		if err = m.verify(ctx, target, plainHash.Sum(nil), true); err != nil {
+			_ = m.storage.Delete(ctx, target)
+
+			return err
+		}
+	}
+
+	return removeBackupFile(ctx, m.storage, key)
+}
+
+// checkedReader calls check once r is exhausted, returning its error in
+// place of io.EOF so a Put fails rather than storing the data.
+type checkedReader struct {
+	r     io.Reader
+	check func() error
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		if cErr := c.check(); cErr != nil {
+			return n, cErr
+		}
+	}
+
+	return n, err
+}
+
+func (m *migrator) decrypt(ctx context.Context, key string) error {
+	src, err := m.storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	plaintext, err := age.Decrypt(src, m.identities...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	plainHash := sha256.New()
+	target := strings.TrimSuffix(key, ageSuffix)
+
+	if err = m.storage.Put(ctx, target, io.TeeReader(plaintext, plainHash), -1); err != nil {
+		return err
+	}
+
+	if err = m.verify(ctx, target, plainHash.Sum(nil), false); err != nil {
+		_ = m.storage.Delete(ctx, target)
+
+		return err
+	}
+
+	return removeBackupFile(ctx, m.storage, key)
+}
+
+// verify reads key back, decrypting it if encrypted, and checks its
+// plaintext matches the expected SHA-256.
+func (m *migrator) verify(ctx context.Context, key string, want []byte, encrypted bool) error {
+	r, err := m.storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+
+	var plaintext io.Reader = r
+
+	if encrypted {
+		if plaintext, err = age.Decrypt(r, m.identities...); err != nil {
+			return errors.Wrap(err, "failed to decrypt converted file")
+		}
+	}
+
+	h := sha256.New()
+
+	if _, err = io.Copy(h, plaintext); err != nil {
+		return errors.Wrap(err, "failed to read converted file")
+	}
+
+	if !bytes.Equal(h.Sum(nil), want) {
+		return errors.New("converted file does not match the original")
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+)
+
+func TestMigrateEncryptAndDecrypt(t *testing.T) {
+	backupDir := t.TempDir()
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle", "bundle")
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.manifest", "manifest")
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.lfs.tar.gz", "lfs")
+	writeBackupFile(t, backupDir, "github.com/owner/repo/README", "not a backup")
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	t.Setenv(envGitBackupDir, backupDir)
+	t.Setenv(envVarBundlePassphrase, "")
+	t.Setenv(envVarBundleRecipients, identity.Recipient().String())
+	t.Setenv(envVarBundleIdentities, identity.String())
+
+	require.NoError(t, RunCommand([]string{"migrate", "encrypt"}))
+
+	dir := filepath.Join(backupDir, "github.com/owner/repo")
+	for _, name := range []string{"repo.20240101000000.bundle", "repo.20240101000000.manifest", "repo.20240101000000.lfs.tar.gz"} {
+		require.NoFileExists(t, filepath.Join(dir, name))
+		require.FileExists(t, filepath.Join(dir, name+ageSuffix))
+	}
+
+	require.Equal(t, "bundle", decryptBackupFile(t, filepath.Join(dir, "repo.20240101000000.bundle.age"), identity))
+	require.FileExists(t, filepath.Join(dir, "README"))
+
+	require.NoError(t, RunCommand([]string{"migrate", "decrypt"}))
+
+	b, err := os.ReadFile(filepath.Join(dir, "repo.20240101000000.lfs.tar.gz"))
+	require.NoError(t, err)
+	require.Equal(t, "lfs", string(b))
+	require.NoFileExists(t, filepath.Join(dir, "repo.20240101000000.lfs.tar.gz.age"))
+
+	reports, err := filepath.Glob(statePath(backupDir, "migrate-*-report-*.json"))
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+}
+
+func TestMigrateKeepsOriginalWhenVerificationFails(t *testing.T) {
+	backupDir := t.TempDir()
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle", "bundle")
+
+	recipient, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	// the identity can not decrypt what was encrypted, so nothing is removed
+	m := &migrator{
+		storage:    newLocalStorage(backupDir),
+		identities: []age.Identity{other},
+		recipients: []age.Recipient{recipient.Recipient()},
+	}
+
+	report, err := m.run(t.Context(), migrateEncrypt, false)
+	require.NoError(t, err)
+	require.Len(t, report.Failed, 1)
+
+	dir := filepath.Join(backupDir, "github.com/owner/repo")
+	require.FileExists(t, filepath.Join(dir, "repo.20240101000000.bundle"))
+	require.NoFileExists(t, filepath.Join(dir, "repo.20240101000000.bundle.age"))
+}
+
+func TestMigrateEncryptWithoutIdentities(t *testing.T) {
+	backupDir := t.TempDir()
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle", "bundle")
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	t.Setenv(envGitBackupDir, backupDir)
+	t.Setenv(envVarBundlePassphrase, "")
+	t.Setenv(envVarBundleRecipients, identity.Recipient().String())
+	t.Setenv(envVarBundleIdentities, "")
+	t.Setenv(envVarBundleKeyring, "")
+
+	require.NoError(t, RunCommand([]string{"migrate", "encrypt"}))
+
+	dir := filepath.Join(backupDir, "github.com/owner/repo")
+	require.NoFileExists(t, filepath.Join(dir, "repo.20240101000000.bundle"))
+	require.Equal(t, "bundle", decryptBackupFile(t, filepath.Join(dir, "repo.20240101000000.bundle.age"), identity))
+
+	// decrypting still needs them
+	require.Error(t, RunCommand([]string{"migrate", "decrypt"}))
+}
+
+func TestCheckedReader(t *testing.T) {
+	r := &checkedReader{r: strings.NewReader("data"), check: func() error { return errors.New("changed") }}
+
+	_, err := io.ReadAll(r)
+	require.ErrorContains(t, err, "changed")
+
+	r = &checkedReader{r: strings.NewReader("data"), check: func() error { return nil }}
+
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(b))
+}
+
+func TestMigrateSkipsLockedBackups(t *testing.T) {
+	backupDir := t.TempDir()
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle", "bundle")
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle"+lockSuffix,
+		`{"locked_until":"`+time.Now().Add(time.Hour).UTC().Format(time.RFC3339)+`"}`)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	m := &migrator{
+		storage:    newLocalStorage(backupDir),
+		identities: []age.Identity{identity},
+		recipients: []age.Recipient{identity.Recipient()},
+	}
+
+	report, err := m.run(t.Context(), migrateEncrypt, false)
+	require.NoError(t, err)
+	require.Empty(t, report.Migrated)
+	require.Len(t, report.Failed, 1)
+	require.FileExists(t, filepath.Join(backupDir, "github.com/owner/repo/repo.20240101000000.bundle"))
+}
+
+func TestMigrateRequiresMode(t *testing.T) {
+	require.Error(t, RunCommand([]string{"migrate"}))
+	require.Error(t, RunCommand([]string{"migrate", "compress"}))
+}
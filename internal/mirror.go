@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const envSobaMirrorDirs = "SOBA_MIRROR_DIRS"
+
+// MirrorResult summarises the changes made to a local mirror of the backup
+// directory during a backup run.
+type MirrorResult struct {
+	Mirror  string   `json:"mirror"`
+	Copied  int      `json:"copied"`
+	Deleted int      `json:"deleted"`
+	Error   errors.E `json:"error,omitempty"`
+}
+
+// mirrorSyncer keeps additional copies of the backup tree on other local
+// mounts, such as a USB disk or a separate NFS export. Every copied file is
+// read back and checked against the source before it is counted, and files
+// copied to a mirror that retention has since removed from the backup
+// directory are removed from the mirror too.
+type mirrorSyncer struct {
+	stateDir string
+	source   Storage
+	mirrors  []Storage
+	results  []MirrorResult
+}
+
+func newMirrorSyncer(backupDir, workingDir string) *mirrorSyncer {
+	s := &mirrorSyncer{
+		stateDir: backupDir,
+		source:   newLocalStorage(backupDir, workingDir),
+	}
+
+	for _, dir := range getOrgsListFromEnvVar(envSobaMirrorDirs) {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+
+		if err := validateMirrorDir(backupDir, dir); err != nil {
+			s.results = append(s.results, MirrorResult{Mirror: dir, Error: err})
+
+			continue
+		}
+
+		s.mirrors = append(s.mirrors, newLocalStorage(dir))
+		s.results = append(s.results, MirrorResult{Mirror: dir})
+	}
+
+	return s
+}
+
+// validateMirrorDir checks the mirror exists rather than creating it, so an
+// unmounted disk is reported instead of silently filling its mount point.
+func validateMirrorDir(backupDir, dir string) errors.E {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return errors.Wrapf(err, "mirror directory %q is not accessible", dir)
+	}
+
+	if !info.IsDir() {
+		return errors.Errorf("mirror %q is not a directory", dir)
+	}
+
+	absBackup, err := filepath.Abs(backupDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	absMirror, err := filepath.Abs(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if rel, rErr := filepath.Rel(absBackup, absMirror); rErr == nil && !strings.HasPrefix(rel, "..") {
+		return errors.Errorf("mirror directory %q must not be inside %s", dir, envGitBackupDir)
+	}
+
+	return nil
+}
+
+// sync brings every mirror up to date with the backup directory.
+func (s *mirrorSyncer) sync() {
+	for _, m := range s.mirrors {
+		r := s.result(m.Name())
+
+		copied, deleted, err := syncTracked(context.Background(), s.stateDir, s.source, m, copyAndVerify)
+		r.Copied += copied
+		r.Deleted += deleted
+
+		if err != nil {
+			logger.Printf("failed to mirror to %s: %s", m.Name(), err)
+
+			r.Error = err
+
+			continue
+		}
+
+		logger.Printf("mirrored to %s: %d copied, %d deleted", m.Name(), copied, deleted)
+	}
+}
+
+func (s *mirrorSyncer) result(name string) *MirrorResult {
+	for i := range s.results {
+		if s.results[i].Mirror == name {
+			return &s.results[i]
+		}
+	}
+
+	s.results = append(s.results, MirrorResult{Mirror: name})
+
+	return &s.results[len(s.results)-1]
+}
+
+// copyAndVerify hashes the source while copying it and then reads the copy
+// back, removing it again if the checksums differ.
+func copyAndVerify(ctx context.Context, src, dst Storage, o ObjectInfo) error {
+	r, err := src.Get(ctx, o.Key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+
+	srcHash := sha256.New()
+
+	if err = dst.Put(ctx, o.Key, io.TeeReader(r, srcHash), o.Size); err != nil {
+		return err
+	}
+
+	dstSum, err := storageChecksum(ctx, dst, o.Key, sha256.New())
+	if err != nil {
+		return errors.Wrap(err, "failed to read back copy")
+	}
+
+	if !bytes.Equal(srcHash.Sum(nil), dstSum) {
+		_ = dst.Delete(ctx, o.Key)
+
+		return errors.New("checksum mismatch after copy")
+	}
+
+	return nil
+}
+
+func storageChecksum(ctx context.Context, s Storage, key string, h hash.Hash) ([]byte, error) {
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+
+	if _, err = io.Copy(h, r); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// corruptingStorage flips the first byte of everything written to it so
+// checksum verification can be exercised.
+type corruptingStorage struct {
+	*memoryStorage
+}
+
+func (c corruptingStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if len(b) > 0 {
+		b[0] ^= 0xff
+	}
+
+	c.objects[key] = b
+
+	return nil
+}
+
+func TestMirrorSyncCopiesVerifiesAndAppliesRetention(t *testing.T) {
+	backupDir := t.TempDir()
+	mirrorDir := t.TempDir()
+
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle", "one")
+	writeBackupFile(t, backupDir, workingDIRName+"/clone/HEAD", "transient")
+	writeBackupFile(t, mirrorDir, "notes.txt", "not soba's")
+
+	t.Setenv(envSobaMirrorDirs, mirrorDir)
+
+	mirrors := newMirrorSyncer(backupDir, filepath.Join(backupDir, workingDIRName))
+	require.Len(t, mirrors.mirrors, 1)
+
+	mirrors.sync()
+	require.FileExists(t, filepath.Join(mirrorDir, "github.com/owner/repo/repo.20240101000000.bundle"))
+	require.NoDirExists(t, filepath.Join(mirrorDir, workingDIRName))
+
+	// retention removes the oldest bundle locally and a new one is written
+	require.NoError(t, os.Remove(filepath.Join(backupDir, "github.com/owner/repo/repo.20240101000000.bundle")))
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240102000000.bundle", "two")
+
+	mirrors.sync()
+	require.NoFileExists(t, filepath.Join(mirrorDir, "github.com/owner/repo/repo.20240101000000.bundle"))
+	require.FileExists(t, filepath.Join(mirrorDir, "github.com/owner/repo/repo.20240102000000.bundle"))
+	require.FileExists(t, filepath.Join(mirrorDir, "notes.txt"))
+
+	require.Len(t, mirrors.results, 1)
+	require.Nil(t, mirrors.results[0].Error)
+	require.Equal(t, 2, mirrors.results[0].Copied)
+	require.Equal(t, 1, mirrors.results[0].Deleted)
+}
+
+func TestMirrorSyncDetectsChecksumMismatch(t *testing.T) {
+	backupDir := t.TempDir()
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle", "bundle")
+
+	dst := corruptingStorage{newMemoryStorage()}
+
+	manifest := &syncManifest{Files: make(map[string]syncedFile)}
+
+	copied, _, err := syncStorage(t.Context(), newLocalStorage(backupDir), dst, manifest, copyAndVerify)
+	require.ErrorContains(t, err, "checksum mismatch")
+	require.Zero(t, copied)
+	require.Empty(t, dst.objects)
+	require.Empty(t, manifest.Files)
+}
+
+func TestNewMirrorSyncerRejectsInvalidDirs(t *testing.T) {
+	backupDir := t.TempDir()
+	nested := filepath.Join(backupDir, "mirror")
+	require.NoError(t, os.Mkdir(nested, 0o700))
+
+	t.Setenv(envSobaMirrorDirs, filepath.Join(t.TempDir(), "unmounted")+","+nested)
+
+	mirrors := newMirrorSyncer(backupDir, filepath.Join(backupDir, workingDIRName))
+	require.Empty(t, mirrors.mirrors)
+	require.Len(t, mirrors.results, 2)
+	require.ErrorContains(t, mirrors.results[0].Error, "not accessible")
+	require.ErrorContains(t, mirrors.results[1].Error, "must not be inside")
+
+	_, failed := getBackupsStats(BackupResults{Results: &[]ProviderBackupResults{}, Mirrors: mirrors.results})
+	require.Equal(t, 2, failed)
+}
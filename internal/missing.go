@@ -0,0 +1,527 @@
+package internal
+
+import (
+	"context"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envSobaMissingUpstream      = "SOBA_MISSING_UPSTREAM"
+	envSobaMissingUpstreamGrace = "SOBA_MISSING_UPSTREAM_GRACE"
+
+	missingUpstreamKeep    = "keep"
+	missingUpstreamArchive = "archive"
+	missingUpstreamPrune   = "prune"
+
+	defaultMissingUpstreamGrace = 30 * hoursPerDay * time.Hour
+
+	// archiveDIRName is the directory, within the backup directory, that
+	// repositories missing upstream are moved to.
+	archiveDIRName       = "archive"
+	missingUpstreamState = "missing-upstream.json"
+
+	// repoOwnersState maps each repository directory to the provider that
+	// backs it up, so providers sharing a host do not report each other's
+	// repositories as missing.
+	repoOwnersState = "repo-owners.json"
+
+	missingKept     = "kept"
+	missingArchived = "archived"
+	missingPruned   = "pruned"
+	missingLocked   = "locked"
+	missingHeld     = "held"
+)
+
+// MissingUpstreamResult reports the repositories with backups that a
+// provider no longer lists, e.g. because they were deleted, renamed or
+// access to them was revoked.
+type MissingUpstreamResult struct {
+	Repos []MissingRepo `json:"repos,omitempty"`
+	Error errors.E      `json:"error,omitempty"`
+}
+
+// MissingRepo is a repository missing upstream and what was done with its
+// backups: kept, archived, pruned, or held or locked if some backups had to
+// be left in place.
+type MissingRepo struct {
+	Dir    string    `json:"dir"`
+	Since  time.Time `json:"since"`
+	New    bool      `json:"new,omitempty"`
+	Action string    `json:"action"`
+
+	// key is the directory in storage, which differs from Dir when paths
+	// are obfuscated
+	key string
+	// archived is set if backups may have been moved to the archive
+	archived bool
+}
+
+// changed reports whether a repository went missing or its backups were
+// archived or pruned during the run.
+func (r *MissingUpstreamResult) changed() bool {
+	return r != nil && slices.ContainsFunc(r.Repos, func(repo MissingRepo) bool {
+		return repo.New || repo.Action != missingKept
+	})
+}
+
+// changedDirs returns the repository directories backups were archived or
+// pruned from, and the archive directories they were archived to.
+func (r *MissingUpstreamResult) changedDirs() []string {
+	if r == nil {
+		return nil
+	}
+
+	var dirs []string
+
+	for _, repo := range r.Repos {
+		if repo.Action != missingKept {
+			dirs = append(dirs, repo.key)
+		}
+
+		if repo.archived {
+			dirs = append(dirs, path.Join(archiveDIRName, repo.key))
+		}
+	}
+
+	return dirs
+}
+
+// missingUpstreamPolicy is what is done with the backups of a repository
+// missing upstream: Action is keep, archive or prune, with pruning delayed
+// until it has been missing for Grace.
+type missingUpstreamPolicy struct {
+	Action string
+	Grace  time.Duration
+}
+
+func missingUpstreamPolicyFromEnv() (missingUpstreamPolicy, error) {
+	p := missingUpstreamPolicy{Action: missingUpstreamKeep, Grace: defaultMissingUpstreamGrace}
+
+	action, _ := GetEnvOrFile(envSobaMissingUpstream)
+	if value := strings.ToLower(strings.TrimSpace(action)); value != "" {
+		if !slices.Contains([]string{missingUpstreamKeep, missingUpstreamArchive, missingUpstreamPrune}, value) {
+			return p, errors.Errorf("%s must be one of keep, archive or prune", envSobaMissingUpstream)
+		}
+
+		p.Action = value
+	}
+
+	if value, _ := GetEnvOrFile(envSobaMissingUpstreamGrace); value != "" {
+		grace, err := parseRetentionAge(value)
+		if err != nil || grace < 0 {
+			return p, errors.Errorf("invalid %s: %q", envSobaMissingUpstreamGrace, value)
+		}
+
+		p.Grace = grace
+	}
+
+	return p, nil
+}
+
+// realDirResolver returns a function mapping a directory in the backup
+// directory to the repository it holds, reading the path index when paths
+// are obfuscated.
+func realDirResolver(backupDir string) (func(string) string, error) {
+	if !obfuscatePaths() {
+		return func(dir string) string { return dir }, nil
+	}
+
+	key, err := pathKey()
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := readPathIndex(backupDir, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(dir string) string { return index.Paths[dir] }, nil
+}
+
+// listedRepoPath returns the path of a repository reported by githosts,
+// either its path with namespace, e.g. owner/repo, or its URL.
+func listedRepoPath(repo string) string {
+	repo = strings.TrimSuffix(repo, ".git")
+
+	if u, err := url.Parse(repo); err == nil && u.Host != "" {
+		return u.Host + u.Path
+	}
+
+	return strings.Trim(repo, "/")
+}
+
+// providerDomain returns the directory a provider stores repositories
+// listed by their path with namespace under, e.g. github.com, or an empty
+// string if soba does not know it.
+func providerDomain(backupsEnvVar string) string {
+	var domain string
+
+	switch backupsEnvVar {
+	case envGitHubBackups:
+		_, domain = wikiBaseURL(os.Getenv(envGitHubAPIURL), "https://api.github.com")
+	case envGitLabBackups:
+		_, domain = wikiBaseURL(os.Getenv(envGitLabAPIURL), "https://gitlab.com/api/v4")
+	case envGiteaBackups:
+		_, domain = wikiBaseURL(os.Getenv(envGiteaAPIURL), "")
+	case envAzureDevOpsBackups:
+		domain = "dev.azure.com"
+	}
+
+	return domain
+}
+
+// findMissingUpstream returns the repository directories, keyed by storage
+// directory, that owners records as backed up by the provider but that do
+// not hold any of the listed repositories, and those that do hold one.
+// A repository listed by its path with namespace is only found under
+// domain, or under any host if domain is empty, and one listed by URL or
+// full path only in exactly that directory. Directories written by other
+// providers, even on the same host, and archived repositories are ignored.
+func findMissingUpstream(objects []ObjectInfo, provider, domain string, owners map[string]string, listed []string, realDir func(string) string) (missing, found map[string]string) {
+	missing = make(map[string]string)
+	found = make(map[string]string)
+
+	isListed := func(repoPath string) bool {
+		// a wiki or export is listed with its repository, which is listed
+		// even if its backup, and so its wiki or export, failed
+		for _, suffix := range exportSuffixes {
+			if base, ok := strings.CutSuffix(repoPath, suffix); ok {
+				repoPath = base
+
+				break
+			}
+		}
+
+		host, rest, _ := strings.Cut(repoPath, "/")
+
+		return slices.ContainsFunc(listed, func(repo string) bool {
+			p := listedRepoPath(repo)
+
+			return p != "" && (repoPath == p || (rest == p && (domain == "" || host == domain)))
+		})
+	}
+
+	for dir := range groupBackupSets(objects) {
+		if strings.HasPrefix(dir, archiveDIRName+"/") {
+			continue
+		}
+
+		repoPath := realDir(dir)
+		if repoPath == "" {
+			continue
+		}
+
+		switch {
+		case isListed(repoPath):
+			found[dir] = repoPath
+		case owners[repoPath] == provider:
+			missing[dir] = repoPath
+		}
+	}
+
+	return missing, found
+}
+
+// providerName returns the name a provider is recorded under in the state
+// directory, e.g. github for GITHUB_BACKUPS.
+func providerName(backupsEnvVar string) string {
+	return strings.ToLower(strings.TrimSuffix(backupsEnvVar, backupsEnvVarSuffix))
+}
+
+// ownedDirs returns a function reporting whether a directory in the backup
+// directory holds a repository recorded as backed up by the provider.
+func ownedDirs(backupDir, provider string) (func(string) bool, error) {
+	owners := map[string]string{}
+
+	if _, err := readStateJSON(backupDir, repoOwnersState, &owners); err != nil {
+		return nil, err
+	}
+
+	realDir, err := realDirResolver(backupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(dir string) bool {
+		repoPath := realDir(dir)
+
+		return repoPath != "" && owners[repoPath] == provider
+	}, nil
+}
+
+// checkMissingUpstream finds the repositories a provider no longer lists and
+// applies the policy to them. The provider backing up each repository, the
+// one that wrote to its directory since started or else the first to list
+// it, is recorded in the state directory so only repositories it backed up
+// before are checked. The time each was first found missing is kept there
+// too so pruning can wait out the grace period.
+func checkMissingUpstream(ctx context.Context, l *localStorage, provider, domain string, started time.Time, listed []string, realDir func(string) string, policy missingUpstreamPolicy, now time.Time, result *MissingUpstreamResult) {
+	objects, err := l.List(ctx, "")
+	if err != nil {
+		result.Error = errors.Wrap(err, "failed to list backups for missing upstream repositories")
+
+		return
+	}
+
+	owners := map[string]string{}
+
+	if _, err = readStateJSON(l.root, repoOwnersState, &owners); err != nil {
+		result.Error = errors.WithStack(err)
+
+		return
+	}
+
+	missing, found := findMissingUpstream(objects, provider, domain, owners, listed, realDir)
+
+	since := map[string]time.Time{}
+
+	if _, err = readStateJSON(l.root, missingUpstreamState, &since); err != nil {
+		result.Error = errors.WithStack(err)
+
+		return
+	}
+
+	written := make(map[string]bool)
+
+	for _, o := range objects {
+		if !o.ModTime.Before(started) {
+			written[path.Dir(o.Key)] = true
+		}
+	}
+
+	for dir, repoPath := range found {
+		if _, ok := owners[repoPath]; !ok || written[dir] {
+			owners[repoPath] = provider
+		}
+
+		if owners[repoPath] == provider {
+			delete(since, repoPath)
+		}
+	}
+
+	dirs := make([]string, 0, len(missing))
+	for dir := range missing {
+		dirs = append(dirs, dir)
+	}
+
+	sort.Strings(dirs)
+
+	sets := groupBackupSets(objects)
+	held := readHolds(ctx, l, objects)
+
+	for _, dir := range dirs {
+		repoPath := missing[dir]
+
+		repo := MissingRepo{Dir: repoPath, Since: since[repoPath], Action: missingKept, key: dir}
+		if repo.Since.IsZero() {
+			repo.Since = now
+			repo.New = true
+			since[repoPath] = now
+
+			logger.Printf("%s is no longer listed upstream", repoPath)
+		}
+
+		switch {
+		case policy.Action == missingUpstreamArchive:
+			repo.Action, err = archiveRepoBackups(ctx, l, dir, sets[dir], held, now)
+			repo.archived = true
+		case policy.Action == missingUpstreamPrune && now.Sub(repo.Since) >= policy.Grace:
+			repo.Action, err = pruneRepoBackups(ctx, l, dir, sets[dir], held, now)
+		}
+
+		if err != nil {
+			result.Error = errors.WithMessagef(err, "failed to %s backups of %s", policy.Action, repoPath)
+
+			return
+		}
+
+		// once its backups are gone or archived the repository is no longer
+		// tracked, so it is reported again if it ever returns and vanishes
+		if repo.Action == missingArchived || repo.Action == missingPruned {
+			delete(since, repoPath)
+		}
+
+		result.Repos = append(result.Repos, repo)
+	}
+
+	// forget repositories whose backups were removed by other means
+	present := make(map[string]bool)
+	for dir := range sets {
+		present[realDir(dir)] = true
+	}
+
+	for repoPath := range since {
+		if !present[repoPath] {
+			delete(since, repoPath)
+		}
+	}
+
+	for repoPath := range owners {
+		if !present[repoPath] {
+			delete(owners, repoPath)
+		}
+	}
+
+	if err = writeStateJSON(l.root, missingUpstreamState, since); err != nil {
+		result.Error = errors.WithStack(err)
+
+		return
+	}
+
+	if err = writeStateJSON(l.root, repoOwnersState, owners); err != nil {
+		result.Error = errors.WithStack(err)
+	}
+}
+
+// archiveRepoBackups moves the backups of a repository to the archive
+// directory, returning held or locked if any had to be left behind.
+func archiveRepoBackups(ctx context.Context, l *localStorage, dir string, sets []*backupSet, held holds, now time.Time) (string, error) {
+	action := missingArchived
+
+	for _, set := range sets {
+		if reason := keptInPlace(ctx, l, set, held, now); reason != "" {
+			action = reason
+
+			continue
+		}
+
+		for _, key := range set.keys {
+			if err := moveBackupFile(ctx, l, key, path.Join(archiveDIRName, key)); err != nil {
+				return "", err
+			}
+		}
+
+		if err := removeExpiredHold(ctx, l, set); err != nil {
+			return "", err
+		}
+	}
+
+	// release assets go with the last of the archives referencing them
+	if action == missingArchived {
+		assets, err := releaseAssetKeys(ctx, l, dir)
+		if err != nil {
+			return "", err
+		}
+
+		for _, key := range assets {
+			if err = moveBackupFile(ctx, l, key, path.Join(archiveDIRName, key)); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return action, removeRepoDirIfEmpty(ctx, l, dir)
+}
+
+// pruneRepoBackups removes the backups of a repository, returning held or
+// locked if any had to be left behind.
+func pruneRepoBackups(ctx context.Context, l *localStorage, dir string, sets []*backupSet, held holds, now time.Time) (string, error) {
+	action := missingPruned
+
+	for _, set := range sets {
+		if reason := keptInPlace(ctx, l, set, held, now); reason != "" {
+			action = reason
+
+			continue
+		}
+
+		for _, key := range set.keys {
+			if err := removeBackupFile(ctx, l, key); err != nil {
+				return "", err
+			}
+		}
+
+		if err := removeExpiredHold(ctx, l, set); err != nil {
+			return "", err
+		}
+	}
+
+	if action == missingPruned {
+		assets, err := releaseAssetKeys(ctx, l, dir)
+		if err != nil {
+			return "", err
+		}
+
+		for _, key := range assets {
+			if err = removeBackupFile(ctx, l, key); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return action, removeRepoDirIfEmpty(ctx, l, dir)
+}
+
+// keptInPlace returns why a backup set can not be archived or pruned, if it
+// is held or locked.
+func keptInPlace(ctx context.Context, l *localStorage, set *backupSet, held holds, now time.Time) string {
+	if _, ok := held.held(set, now); ok {
+		return missingHeld
+	}
+
+	if len(lockedKeys(ctx, l, set.keys, now)) > 0 {
+		return missingLocked
+	}
+
+	return ""
+}
+
+// moveBackupFile renames a backup file, dropping its expired lock sidecar.
+func moveBackupFile(ctx context.Context, l *localStorage, key, target string) error {
+	if err := os.MkdirAll(path.Dir(l.path(target)), storageDirMode); err != nil {
+		return errors.WithStack(err)
+	}
+
+	clearImmutable(l.path(key))
+
+	if err := os.Rename(l.path(key), l.path(target)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := l.Stat(ctx, key+lockSuffix); err == nil {
+		return removeBackupFile(ctx, l, key+lockSuffix)
+	}
+
+	return nil
+}
+
+// removeRepoDirIfEmpty removes a repository directory, and any parents left
+// empty, once it holds no backups. Its checksums are removed with it as they
+// would otherwise list files that are gone.
+func removeRepoDirIfEmpty(ctx context.Context, l *localStorage, dir string) error {
+	objects, err := l.List(ctx, dir+"/")
+	if err != nil {
+		return err
+	}
+
+	if slices.ContainsFunc(objects, func(o ObjectInfo) bool {
+		_, ok := parseBackupFile(o.Key)
+
+		return ok && path.Dir(o.Key) == dir
+	}) {
+		return nil
+	}
+
+	for _, name := range []string{checksumsName, checksumsName + signatureSuffix} {
+		if dErr := l.Delete(ctx, path.Join(dir, name)); dErr != nil && !errors.Is(dErr, fs.ErrNotExist) {
+			return dErr
+		}
+	}
+
+	// the assets directory is left once the assets are moved or removed
+	_ = os.Remove(l.path(path.Join(dir, releaseAssetsDIRName)))
+
+	removeEmptyDirs(l, dir)
+
+	return nil
+}
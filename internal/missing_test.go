@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeMissingUpstreamBackups(t *testing.T, root string) {
+	t.Helper()
+
+	writeBackupFile(t, root, "github.com/owner/kept/kept.20240101000000.bundle", "1")
+	writeBackupFile(t, root, "github.com/owner/gone/gone.20240101000000.bundle", "2")
+	writeBackupFile(t, root, "github.com/owner/gone/gone.20240101000000.manifest", "{}")
+	writeBackupFile(t, root, "gitlab.com/group/sub/project/project.20240101000000.bundle", "3")
+}
+
+func TestFindMissingUpstream(t *testing.T) {
+	root := t.TempDir()
+	writeMissingUpstreamBackups(t, root)
+	writeBackupFile(t, root, "archive/github.com/owner/old/old.20230101000000.bundle", "4")
+
+	objects, err := newLocalStorage(root).List(t.Context(), "")
+	require.NoError(t, err)
+
+	identity := func(dir string) string { return dir }
+
+	owners := map[string]string{
+		"github.com/owner/kept":        "github",
+		"github.com/owner/gone":        "github",
+		"gitlab.com/group/sub/project": "gitlab",
+	}
+
+	// only directories the provider backed up are checked
+	missing, found := findMissingUpstream(objects, "github", "github.com", owners, []string{"owner/kept"}, identity)
+	require.Equal(t, map[string]string{"github.com/owner/gone": "github.com/owner/gone"}, missing)
+	require.Equal(t, map[string]string{"github.com/owner/kept": "github.com/owner/kept"}, found)
+
+	missing, _ = findMissingUpstream(objects, "gitlab", "gitlab.com", owners, []string{"https://gitlab.com/group/sub/project.git"}, identity)
+	require.Empty(t, missing)
+
+	// wikis and exports of a listed repository are found with it
+	root = t.TempDir()
+	writeBackupFile(t, root, "github.com/owner/failed.wiki/failed.wiki.20240101000000.bundle", "5")
+	writeBackupFile(t, root, "github.com/owner/failed.issues/failed.issues.20240101000000.json.gz", "6")
+
+	siblings, err := newLocalStorage(root).List(t.Context(), "")
+	require.NoError(t, err)
+
+	owners["github.com/owner/failed.wiki"] = "github"
+	owners["github.com/owner/failed.issues"] = "github"
+
+	missing, found = findMissingUpstream(siblings, "github", "github.com", owners, []string{"owner/failed"}, identity)
+	require.Empty(t, missing)
+	require.Len(t, found, 2)
+
+	// another provider backing up to the same host does not claim them
+	missing, _ = findMissingUpstream(objects, "generic", "", owners, []string{"https://github.com/owner/other.git"}, identity)
+	require.Empty(t, missing)
+
+	// a listed path only matches the whole path under the provider's domain
+	root = t.TempDir()
+	writeBackupFile(t, root, "gitlab.com/group/org/app/app.20240101000000.bundle", "7")
+
+	nested, err := newLocalStorage(root).List(t.Context(), "")
+	require.NoError(t, err)
+
+	owners["gitlab.com/group/org/app"] = "gitlab"
+
+	missing, found = findMissingUpstream(nested, "gitlab", "gitlab.com", owners, []string{"org/app"}, identity)
+	require.Equal(t, map[string]string{"gitlab.com/group/org/app": "gitlab.com/group/org/app"}, missing)
+	require.Empty(t, found)
+
+	_, found = findMissingUpstream(nested, "github", "github.com", owners, []string{"group/org/app"}, identity)
+	require.Empty(t, found)
+
+	missing, found = findMissingUpstream(nested, "gitlab", "", owners, []string{"group/org/app"}, identity)
+	require.Empty(t, missing)
+	require.Len(t, found, 1)
+}
+
+func TestCheckMissingUpstream(t *testing.T) {
+	root := t.TempDir()
+	writeMissingUpstreamBackups(t, root)
+
+	l := newLocalStorage(root)
+	identity := func(dir string) string { return dir }
+	listed := []string{"owner/kept"}
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	prune := missingUpstreamPolicy{Action: missingUpstreamPrune, Grace: 7 * 24 * time.Hour}
+
+	var result MissingUpstreamResult
+
+	// the provider first lists both repositories, recording them as its own
+	checkMissingUpstream(t.Context(), l, "github", "github.com", start, []string{"owner/kept", "owner/gone"}, identity, prune, start, &result)
+	require.Nil(t, result.Error)
+	require.Empty(t, result.Repos)
+
+	// another provider on the same host does not report them
+	checkMissingUpstream(t.Context(), l, "generic", "", start, []string{"github.com/other/repo"}, identity, prune, start, &result)
+	require.Nil(t, result.Error)
+	require.Empty(t, result.Repos)
+
+	checkMissingUpstream(t.Context(), l, "github", "github.com", start, listed, identity, prune, start, &result)
+	require.Nil(t, result.Error)
+	require.Equal(t, []MissingRepo{{
+		Dir: "github.com/owner/gone", Since: start, New: true, Action: missingKept, key: "github.com/owner/gone",
+	}}, result.Repos)
+	require.True(t, result.changed())
+	require.Empty(t, result.changedDirs())
+
+	// still within the grace period
+	result = MissingUpstreamResult{}
+
+	checkMissingUpstream(t.Context(), l, "github", "github.com", start, listed, identity, prune, start.Add(24*time.Hour), &result)
+	require.Len(t, result.Repos, 1)
+	require.Equal(t, start, result.Repos[0].Since)
+	require.False(t, result.changed())
+	require.FileExists(t, filepath.Join(root, "github.com/owner/gone/gone.20240101000000.bundle"))
+
+	result = MissingUpstreamResult{}
+
+	checkMissingUpstream(t.Context(), l, "github", "github.com", start, listed, identity, prune, start.Add(8*24*time.Hour), &result)
+	require.Nil(t, result.Error)
+	require.Equal(t, missingPruned, result.Repos[0].Action)
+	require.Equal(t, []string{"github.com/owner/gone"}, result.changedDirs())
+	require.NoDirExists(t, filepath.Join(root, "github.com/owner/gone"))
+	require.FileExists(t, filepath.Join(root, "github.com/owner/kept/kept.20240101000000.bundle"))
+}
+
+func TestCheckMissingUpstreamArchive(t *testing.T) {
+	root := t.TempDir()
+	writeMissingUpstreamBackups(t, root)
+
+	l := newLocalStorage(root)
+	now := time.Now()
+
+	require.NoError(t, lockBackupFile(t.Context(), l, "github.com/owner/gone/gone.20240101000000.manifest", now.Add(-time.Hour)))
+
+	var result MissingUpstreamResult
+
+	checkMissingUpstream(t.Context(), l, "github", "github.com", now, []string{"owner/kept", "owner/gone"}, func(dir string) string { return dir },
+		missingUpstreamPolicy{Action: missingUpstreamArchive}, now, &result)
+	require.Empty(t, result.Repos)
+
+	checkMissingUpstream(t.Context(), l, "github", "github.com", now, []string{"owner/kept"}, func(dir string) string { return dir },
+		missingUpstreamPolicy{Action: missingUpstreamArchive}, now, &result)
+	require.Nil(t, result.Error)
+	require.Equal(t, missingArchived, result.Repos[0].Action)
+	require.NoDirExists(t, filepath.Join(root, "github.com/owner/gone"))
+	require.FileExists(t, filepath.Join(root, "archive/github.com/owner/gone/gone.20240101000000.bundle"))
+	require.FileExists(t, filepath.Join(root, "archive/github.com/owner/gone/gone.20240101000000.manifest"))
+	require.NoFileExists(t, filepath.Join(root, "archive/github.com/owner/gone/gone.20240101000000.manifest"+lockSuffix))
+	require.Equal(t, []string{"github.com/owner/gone", "archive/github.com/owner/gone"}, result.changedDirs())
+
+	// archived repositories are not reported again
+	result = MissingUpstreamResult{}
+
+	checkMissingUpstream(t.Context(), l, "github", "github.com", now, []string{"owner/kept"}, func(dir string) string { return dir },
+		missingUpstreamPolicy{Action: missingUpstreamArchive}, now, &result)
+	require.Nil(t, result.Error)
+	require.Empty(t, result.Repos)
+}
+
+func TestMissingUpstreamPolicyFromEnv(t *testing.T) {
+	t.Setenv(envSobaMissingUpstream, "Prune")
+	t.Setenv(envSobaMissingUpstreamGrace, "2w")
+
+	policy, err := missingUpstreamPolicyFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, missingUpstreamPolicy{Action: missingUpstreamPrune, Grace: 14 * 24 * time.Hour}, policy)
+
+	t.Setenv(envSobaMissingUpstream, "delete")
+
+	_, err = missingUpstreamPolicyFromEnv()
+	require.ErrorContains(t, err, envSobaMissingUpstream)
+}
@@ -52,6 +52,77 @@ func getResultsErrors(results BackupResults) []errors.E {
 		}
 	}
 
+	for _, d := range results.Destinations {
+		if d.Error != nil {
+			errs = append(errs, errors.WithMessage(d.Error, d.Destination))
+		}
+	}
+
+	for _, m := range results.Mirrors {
+		if m.Error != nil {
+			errs = append(errs, errors.WithMessagef(m.Error, "mirror %s", m.Mirror))
+		}
+	}
+
+	if results.Signing != nil && results.Signing.Error != nil {
+		errs = append(errs, results.Signing.Error)
+	}
+
+	if results.Obfuscation != nil && results.Obfuscation.Error != nil {
+		errs = append(errs, results.Obfuscation.Error)
+	}
+
+	if results.Keyring != nil && results.Keyring.Error != nil {
+		errs = append(errs, results.Keyring.Error)
+	}
+
+	if results.Encryption != nil && results.Encryption.Error != nil {
+		errs = append(errs, results.Encryption.Error)
+	}
+
+	if results.Immutable != nil && results.Immutable.Error != nil {
+		errs = append(errs, results.Immutable.Error)
+	}
+
+	if results.Retention != nil && results.Retention.Error != nil {
+		errs = append(errs, results.Retention.Error)
+	}
+
+	if q := results.Quota; q != nil {
+		if q.Error != nil {
+			errs = append(errs, q.Error)
+		}
+
+		// evictions are not failures, but mean the quota is too small
+		if len(q.Evicted) > 0 {
+			errs = append(errs, errors.Errorf("backup quota exceeded: evicted %d backups, %s of %s used",
+				len(q.Evicted), formatSize(q.Used), formatSize(q.Quota)))
+		}
+	}
+
+	if s := results.Submodules; s != nil {
+		if s.Error != nil {
+			errs = append(errs, s.Error)
+		}
+
+		// unreachable submodules are not failures, but may leave a restore
+		// unbuildable
+		for _, warning := range s.Warnings {
+			errs = append(errs, errors.Errorf("submodule not backed up: %s", warning))
+		}
+	}
+
+	if m := results.MissingUpstream; m != nil {
+		if m.Error != nil {
+			errs = append(errs, m.Error)
+		}
+
+		for _, repo := range m.Repos {
+			errs = append(errs, errors.Errorf("%s missing upstream since %s: backups %s",
+				repo.Dir, repo.Since.Format(time.DateOnly), repo.Action))
+		}
+	}
+
 	return errs
 }
 
@@ -62,8 +133,11 @@ func notify(backupResults BackupResults, succeeded int, failed int) {
 	// Check if we should only notify on failure
 	notifyOnFailureOnly := envTrue(envSobaNotifyOnFailureOnly)
 
-	// Skip notifications if success-only and no failures
-	if notifyOnFailureOnly && failed == 0 {
+	// Skip notifications if success-only and no failures, unless backups
+	// had to be evicted to stay within the quota, a repository has gone
+	// missing upstream or a submodule could not be backed up
+	if notifyOnFailureOnly && failed == 0 && !backupResults.Quota.evicted() && !backupResults.MissingUpstream.changed() &&
+		!backupResults.Submodules.warned() {
 		logger.Println("skipping notification (no failures)")
 
 		return
@@ -0,0 +1,549 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envSobaObfuscatePaths = "SOBA_OBFUSCATE_PATHS"
+	envSobaPathKey        = "SOBA_PATH_KEY" // nolint:gosec
+
+	pathIndexName   = "path-index.age"
+	stagingDIRName  = "staging"
+	obfuscatedBytes = 16
+)
+
+// ObfuscationResult reports the backups moved into the obfuscated layout.
+type ObfuscationResult struct {
+	Moved int      `json:"moved"`
+	Error errors.E `json:"error,omitempty"`
+}
+
+// pathIndex maps each obfuscated repository directory back to its real
+// path, e.g. github.com/owner/repo.
+type pathIndex struct {
+	Paths map[string]string `json:"paths"`
+}
+
+// obfuscatePaths reports whether repository names are hidden in the backup
+// layout.
+func obfuscatePaths() bool {
+	return envTrue(envSobaObfuscatePaths)
+}
+
+// pathKey returns the secret used to hash path components and encrypt the
+// index.
+func pathKey() (string, error) {
+	key, _ := GetEnvOrFile(envSobaPathKey)
+	if key = strings.TrimSpace(key); key == "" {
+		return "", errors.Errorf("%s must be set when %s is enabled", envSobaPathKey, envSobaObfuscatePaths)
+	}
+
+	return key, nil
+}
+
+// obfuscateDir replaces each component of a repository directory with a
+// keyed hash of the path up to and including it, so the same owner name
+// under two providers does not share a hash.
+func obfuscateDir(key, dir string) string {
+	parts := strings.Split(dir, "/")
+	hashed := make([]string, len(parts))
+
+	for i := range parts {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(strings.Join(parts[:i+1], "/")))
+		hashed[i] = hex.EncodeToString(mac.Sum(nil)[:obfuscatedBytes])
+	}
+
+	return strings.Join(hashed, "/")
+}
+
+// obfuscateName replaces the repository name at the start of a backup file
+// name with the final component of the obfuscated directory.
+func obfuscateName(realDir, obfuscatedDir, name string) string {
+	if rest, ok := strings.CutPrefix(name, path.Base(realDir)+"."); ok {
+		return path.Base(obfuscatedDir) + "." + rest
+	}
+
+	return name
+}
+
+func readPathIndex(backupDir, key string) (*pathIndex, error) {
+	index := &pathIndex{Paths: map[string]string{}}
+
+	b, err := os.ReadFile(statePath(backupDir, pathIndexName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+
+		return nil, errors.WithStack(err)
+	}
+
+	id, err := age.NewScryptIdentity(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(b), id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt %s", pathIndexName)
+	}
+
+	if err = json.NewDecoder(r).Decode(index); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", pathIndexName)
+	}
+
+	if index.Paths == nil {
+		index.Paths = map[string]string{}
+	}
+
+	return index, nil
+}
+
+func writePathIndex(ctx context.Context, backupDir, key string, index *pathIndex) error {
+	b, err := json.Marshal(index)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	recipient, err := age.NewScryptRecipient(key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	encrypted := encryptingReader(bytes.NewReader(b), recipient)
+	defer func() { _ = encrypted.Close() }()
+
+	return newLocalStorage(statePath(backupDir)).Put(ctx, pathIndexName, encrypted, -1)
+}
+
+// storagePath returns where a repository directory, a backup file in one,
+// or a directory above them, given by its real path, is stored when paths
+// are obfuscated. Other paths, such as those already obfuscated, are
+// returned unchanged.
+func storagePath(backupDir, p string) (string, error) {
+	if !obfuscatePaths() || p == "" {
+		return p, nil
+	}
+
+	key, err := pathKey()
+	if err != nil {
+		return "", err
+	}
+
+	index, err := readPathIndex(backupDir, key)
+	if err != nil {
+		return "", err
+	}
+
+	for dir, realDir := range index.Paths {
+		switch {
+		case p == realDir:
+			return dir, nil
+		case path.Dir(p) == realDir:
+			return path.Join(dir, obfuscateName(realDir, dir, path.Base(p))), nil
+		case strings.HasPrefix(realDir, p+"/"):
+			// each component is hashed with the path up to it, so a parent
+			// directory is a prefix of its repositories' directories
+			return obfuscateDir(key, p), nil
+		}
+	}
+
+	return p, nil
+}
+
+// pathObfuscator lets providers write backups under their real names while
+// storing them under keyed hashes. Providers are given a staging directory
+// holding links to the latest backup of each repository, under its real
+// name, to compare against. New backups written there are moved into the
+// backup directory once each provider completes.
+type pathObfuscator struct {
+	root    string
+	staging string
+	storage *localStorage
+	key     string
+	index   *pathIndex
+	result  *ObfuscationResult
+}
+
+func newPathObfuscator(backupDir, workingDir string, storage *localStorage) *pathObfuscator {
+	o := &pathObfuscator{root: backupDir, storage: storage}
+
+	if !obfuscatePaths() {
+		return o
+	}
+
+	o.result = &ObfuscationResult{}
+
+	key, err := pathKey()
+	if err != nil {
+		o.result.Error = errors.WithStack(err)
+
+		return o
+	}
+
+	index, err := readPathIndex(backupDir, key)
+	if err != nil {
+		o.result.Error = errors.WithStack(err)
+
+		return o
+	}
+
+	o.key = key
+	o.index = index
+	o.staging = filepath.Join(workingDir, stagingDIRName)
+
+	return o
+}
+
+// backupDir returns the directory providers should write to.
+func (o *pathObfuscator) backupDir() string {
+	if o.index == nil {
+		return o.root
+	}
+
+	return o.staging
+}
+
+// prepare moves any repository directory still stored under its real name
+// into the obfuscated layout, then links the latest backup of each
+// repository into the staging directory.
+func (o *pathObfuscator) prepare(ctx context.Context) {
+	if o.index == nil {
+		return
+	}
+
+	objects, err := o.storage.List(ctx, "")
+	if err != nil {
+		o.result.Error = errors.Wrap(err, "failed to list backups")
+
+		return
+	}
+
+	// every file of a repository directory moves with it, as sidecars and
+	// release assets would otherwise still reveal the repository name
+	plain := make(map[string][]ObjectInfo)
+
+	for _, obj := range objects {
+		dir, ok := releaseAssetDir(obj.Key)
+		if !ok {
+			dir = path.Dir(obj.Key)
+		}
+
+		// archived repositories keep their obfuscated directory
+		if _, ok = o.index.Paths[strings.TrimPrefix(dir, archiveDIRName+"/")]; ok || dir == "." ||
+			strings.HasPrefix(obj.Key, stateDIRName+"/") {
+			continue
+		}
+
+		plain[dir] = append(plain[dir], obj)
+	}
+
+	dirs := make([]string, 0, len(plain))
+	for dir := range plain {
+		dirs = append(dirs, dir)
+	}
+
+	sort.Strings(dirs)
+
+	if len(dirs) > 0 {
+		logger.Printf("obfuscating %d existing repository directories", len(dirs))
+	}
+
+	for _, dir := range dirs {
+		if err = o.moveDir(ctx, dir, plain[dir]); err != nil {
+			o.result.Error = errors.WithMessagef(err, "failed to obfuscate %s", dir)
+
+			return
+		}
+	}
+
+	if err = os.RemoveAll(o.staging); err != nil {
+		o.result.Error = errors.WithStack(err)
+
+		return
+	}
+
+	if err = o.link(ctx, o.staging, true); err != nil {
+		o.result.Error = errors.Wrap(err, "failed to prepare staging directory")
+	}
+}
+
+// moveDir moves the files of a repository directory stored under its real
+// name into the obfuscated layout. A directory with locked backups stays
+// where it is until their locks expire, as they can not be moved.
+func (o *pathObfuscator) moveDir(ctx context.Context, dir string, objects []ObjectInfo) error {
+	keys := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+
+	if len(lockedKeys(ctx, o.storage, keys, time.Now())) > 0 {
+		logger.Printf("not obfuscating %s until its backups are unlocked", dir)
+
+		return nil
+	}
+
+	var (
+		files []ObjectInfo
+		stale []string
+	)
+
+	for _, obj := range objects {
+		switch name := path.Base(obj.Key); {
+		// checksums list the real file names; they are signed again for the
+		// obfuscated directory. Expired locks go with the files they locked.
+		case name == checksumsName || name == checksumsName+signatureSuffix || strings.HasSuffix(name, lockSuffix):
+			stale = append(stale, obj.Key)
+		default:
+			files = append(files, obj)
+		}
+	}
+
+	if err := o.move(ctx, o.storage, files); err != nil {
+		return err
+	}
+
+	for _, key := range stale {
+		if _, err := o.storage.Stat(ctx, key); err != nil {
+			continue
+		}
+
+		if err := removeBackupFile(ctx, o.storage, key); err != nil {
+			return err
+		}
+	}
+
+	removeEmptyDirs(o.storage, dir)
+
+	return nil
+}
+
+// collect moves the backups written to the staging directory by a provider
+// into the obfuscated layout.
+func (o *pathObfuscator) collect(ctx context.Context) {
+	if o.index == nil {
+		return
+	}
+
+	staged := newLocalStorage(o.staging, filepath.Join(o.staging, workingDIRName))
+
+	objects, err := staged.List(ctx, "")
+	if err != nil {
+		o.result.Error = errors.Wrap(err, "failed to list staged backups")
+
+		return
+	}
+
+	if err = o.move(ctx, staged, objects); err != nil {
+		o.result.Error = errors.WithStack(err)
+	}
+}
+
+// move stores each file under its obfuscated key, removes the original and
+// records the directory in the index. Release assets keep their names, in
+// the assets directory of the obfuscated releases directory.
+func (o *pathObfuscator) move(ctx context.Context, from *localStorage, objects []ObjectInfo) error {
+	for _, obj := range objects {
+		realDir, asset := releaseAssetDir(obj.Key)
+		if !asset {
+			realDir = path.Dir(obj.Key)
+		}
+
+		dir := obfuscateDir(o.key, realDir)
+		target := path.Join(dir, obfuscateName(realDir, dir, path.Base(obj.Key)))
+
+		if asset {
+			target = path.Join(dir, releaseAssetsDIRName, path.Base(obj.Key))
+		}
+
+		if err := o.copy(ctx, from, obj, target); err != nil {
+			return errors.WithMessagef(err, "failed to obfuscate %s", obj.Key)
+		}
+
+		// the index is written before the original is removed, so an
+		// interruption leaves at worst an extra copy rather than an
+		// unmapped one
+		if _, ok := o.index.Paths[dir]; !ok {
+			o.index.Paths[dir] = realDir
+
+			if err := writePathIndex(ctx, o.root, o.key, o.index); err != nil {
+				return err
+			}
+		}
+
+		if err := removeBackupFile(ctx, from, obj.Key); err != nil {
+			return errors.WithMessagef(err, "failed to remove %s", obj.Key)
+		}
+
+		// empty directories would still reveal the repository name
+		removeEmptyDirs(from, path.Dir(obj.Key))
+
+		o.result.Moved++
+	}
+
+	return nil
+}
+
+// removeEmptyDirs removes dir and each of its parents until one is not
+// empty.
+func removeEmptyDirs(l *localStorage, dir string) {
+	for d := dir; d != "."; d = path.Dir(d) {
+		if os.Remove(l.path(d)) != nil {
+			break
+		}
+	}
+}
+
+func (o *pathObfuscator) copy(ctx context.Context, from *localStorage, obj ObjectInfo, target string) error {
+	r, err := from.Get(ctx, obj.Key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+
+	return o.storage.Put(ctx, target, r, obj.Size)
+}
+
+// link creates a tree of symlinks under dst with the real layout, pointing
+// at the obfuscated backups and release assets. With latestOnly, only the
+// most recent backup of each repository is linked.
+func (o *pathObfuscator) link(ctx context.Context, dst string, latestOnly bool) error {
+	objects, err := o.storage.List(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	root, err := filepath.Abs(o.root)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for dir, sets := range groupBackupSets(objects) {
+		realDir, ok := o.index.Paths[dir]
+		if !ok {
+			continue
+		}
+
+		if latestOnly {
+			sets = sets[:1]
+		}
+
+		if err = os.MkdirAll(filepath.Join(dst, filepath.FromSlash(realDir)), storageDirMode); err != nil {
+			return errors.WithStack(err)
+		}
+
+		for _, set := range sets {
+			for _, key := range set.keys {
+				name := path.Base(realDir) + strings.TrimPrefix(path.Base(key), set.repo)
+				link := filepath.Join(dst, filepath.FromSlash(realDir), name)
+
+				if err = os.Symlink(filepath.Join(root, filepath.FromSlash(key)), link); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+		}
+	}
+
+	if latestOnly {
+		return nil
+	}
+
+	for dir, assets := range releaseAssetFiles(objects) {
+		realDir, ok := o.index.Paths[dir]
+		if !ok {
+			continue
+		}
+
+		assetsDir := filepath.Join(dst, filepath.FromSlash(realDir), releaseAssetsDIRName)
+
+		if err = os.MkdirAll(assetsDir, storageDirMode); err != nil {
+			return errors.WithStack(err)
+		}
+
+		for _, asset := range assets {
+			if err = os.Symlink(filepath.Join(root, filepath.FromSlash(asset.Key)), filepath.Join(assetsDir, path.Base(asset.Key))); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// runIndex lists the obfuscated directory of each repository, or with -link
+// recreates the real layout as symlinks for browsing and restoring.
+func runIndex(args []string) error {
+	flags := flag.NewFlagSet("index", flag.ContinueOnError)
+	linkDir := flags.String("link", "", "create symlinks with the real layout under this directory")
+
+	flags.Usage = func() {
+		_, _ = io.WriteString(flags.Output(), "usage: soba index [-link dir] [prefix]\n\n"+
+			"Lists the obfuscated directory holding the backups of each repository, decrypting\n"+
+			"the index with "+envSobaPathKey+".\n\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+
+		return errors.WithStack(err)
+	}
+
+	backupDir, err := commandBackupDir()
+	if err != nil {
+		return err
+	}
+
+	key, err := pathKey()
+	if err != nil {
+		return err
+	}
+
+	index, err := readPathIndex(backupDir, key)
+	if err != nil {
+		return err
+	}
+
+	if *linkDir != "" {
+		o := &pathObfuscator{root: backupDir, storage: newLocalStorage(backupDir, resolveWorkingDir(backupDir)), key: key, index: index}
+
+		return o.link(context.Background(), *linkDir, false)
+	}
+
+	paths := make([]string, 0, len(index.Paths))
+
+	for dir, realDir := range index.Paths {
+		if strings.HasPrefix(realDir, flags.Arg(0)) {
+			paths = append(paths, realDir+"\t"+dir)
+		}
+	}
+
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		fmt.Println(p)
+	}
+
+	return nil
+}
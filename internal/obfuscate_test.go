@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObfuscateDir(t *testing.T) {
+	dir := obfuscateDir("secret", "github.com/owner/repo")
+	parts := strings.Split(dir, "/")
+	require.Len(t, parts, 3)
+
+	for _, p := range parts {
+		require.Len(t, p, obfuscatedBytes*2)
+	}
+
+	require.Equal(t, dir, obfuscateDir("secret", "github.com/owner/repo"))
+	require.NotEqual(t, dir, obfuscateDir("other", "github.com/owner/repo"))
+
+	// the same owner under another provider does not share a hash
+	other := strings.Split(obfuscateDir("secret", "gitlab.com/owner/repo"), "/")
+	require.NotEqual(t, parts[1], other[1])
+
+	require.Equal(t, parts[2]+".20240101000000.bundle.age",
+		obfuscateName("github.com/owner/repo", dir, "repo.20240101000000.bundle.age"))
+}
+
+func TestPathObfuscator(t *testing.T) {
+	backupDir := t.TempDir()
+	workingDir := filepath.Join(backupDir, workingDIRName)
+
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle", "one")
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle"+lockSuffix, `{"locked_until":"2000-01-01T00:00:00Z"}`)
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.hold", `{"reason":"legal"}`)
+	writeBackupFile(t, backupDir, "github.com/owner/repo/"+checksumsName, "")
+	writeBackupFile(t, backupDir, "github.com/owner/repo.releases/repo.releases.20240101000000.json.gz", "releases")
+	writeBackupFile(t, backupDir, "github.com/owner/repo.releases/assets/"+strings.Repeat("ab", 32), "asset")
+	writeBackupFile(t, backupDir, "github.com/owner/locked/locked.20240101000000.bundle", "locked")
+	writeBackupFile(t, backupDir, "github.com/owner/locked/locked.20240101000000.bundle"+lockSuffix, `{"locked_until":"2999-01-01T00:00:00Z"}`)
+
+	t.Setenv(envSobaObfuscatePaths, "true")
+	t.Setenv(envSobaPathKey, "secret")
+
+	local := newLocalStorage(backupDir, workingDir)
+
+	o := newPathObfuscator(backupDir, workingDir, local)
+	require.Nil(t, o.result.Error)
+	require.Equal(t, filepath.Join(workingDir, stagingDIRName), o.backupDir())
+
+	// existing repository directories are moved, with their sidecars and
+	// release assets, into the obfuscated layout and their latest backups
+	// linked into staging under their real names
+	o.prepare(t.Context())
+	require.Nil(t, o.result.Error)
+	require.Equal(t, 4, o.result.Moved)
+	require.NoDirExists(t, filepath.Join(backupDir, "github.com", "owner", "repo"))
+	require.NoDirExists(t, filepath.Join(backupDir, "github.com", "owner", "repo.releases"))
+	require.FileExists(t, filepath.Join(backupDir, obfuscateDir("secret", "github.com/owner/repo.releases"),
+		releaseAssetsDIRName, strings.Repeat("ab", 32)))
+
+	// locked backups can not be moved until their locks expire
+	require.FileExists(t, filepath.Join(backupDir, "github.com", "owner", "locked", "locked.20240101000000.bundle"))
+
+	staged := filepath.Join(o.backupDir(), "github.com", "owner", "repo")
+
+	b, err := os.ReadFile(filepath.Join(staged, "repo.20240101000000.bundle"))
+	require.NoError(t, err)
+	require.Equal(t, "one", string(b))
+
+	// a provider writes a new backup to staging
+	writeBackupFile(t, o.backupDir(), "github.com/owner/repo/repo.20240102000000.bundle", "two")
+
+	o.collect(t.Context())
+	require.Nil(t, o.result.Error)
+	require.Equal(t, 5, o.result.Moved)
+
+	dir := obfuscateDir("secret", "github.com/owner/repo")
+
+	objects, err := local.List(t.Context(), dir)
+	require.NoError(t, err)
+	require.Len(t, objects, 3)
+
+	for _, obj := range objects {
+		require.NotContains(t, obj.Key, "repo.")
+	}
+
+	require.FileExists(t, filepath.Join(backupDir, dir, path.Base(dir)+holdSuffix))
+
+	index, err := readPathIndex(backupDir, "secret")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		dir: "github.com/owner/repo",
+		obfuscateDir("secret", "github.com/owner/repo.releases"): "github.com/owner/repo.releases",
+	}, index.Paths)
+
+	_, err = readPathIndex(backupDir, "wrong")
+	require.Error(t, err)
+
+	// the index command recreates the real layout
+	t.Setenv(envGitBackupDir, backupDir)
+
+	linkDir := t.TempDir()
+	require.NoError(t, RunCommand([]string{"index", "-link", linkDir}))
+
+	b, err = os.ReadFile(filepath.Join(linkDir, "github.com", "owner", "repo", "repo.20240102000000.bundle"))
+	require.NoError(t, err)
+	require.Equal(t, "two", string(b))
+	require.FileExists(t, filepath.Join(linkDir, "github.com", "owner", "repo", "repo.20240101000000.bundle"))
+	require.FileExists(t, filepath.Join(linkDir, "github.com", "owner", "repo.releases", releaseAssetsDIRName, strings.Repeat("ab", 32)))
+}
+
+func TestPathObfuscatorDisabled(t *testing.T) {
+	t.Setenv(envSobaObfuscatePaths, "")
+
+	backupDir := t.TempDir()
+
+	o := newPathObfuscator(backupDir, filepath.Join(backupDir, workingDIRName), newLocalStorage(backupDir))
+	require.Nil(t, o.result)
+	require.Equal(t, backupDir, o.backupDir())
+
+	o.prepare(t.Context())
+	o.collect(t.Context())
+}
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const envSobaBackupQuota = "SOBA_BACKUP_QUOTA"
+
+// sizeUnits maps size suffixes to their multipliers, longest first so KiB is
+// matched before B.
+var sizeUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30}, {"t", 1 << 40},
+	{"b", 1},
+}
+
+// QuotaResult reports the size of the backup directory against
+// SOBA_BACKUP_QUOTA and the backups evicted to stay within it.
+type QuotaResult struct {
+	Quota   int64    `json:"quota"`
+	Used    int64    `json:"used"`
+	Evicted []string `json:"evicted,omitempty"`
+	Error   errors.E `json:"error,omitempty"`
+}
+
+// evicted reports whether any backups were evicted.
+func (q *QuotaResult) evicted() bool {
+	return q != nil && len(q.Evicted) > 0
+}
+
+// evictedDirs returns the repository directories backups were evicted from.
+func (q *QuotaResult) evictedDirs() []string {
+	if q == nil {
+		return nil
+	}
+
+	dirs := make([]string, 0, len(q.Evicted))
+	for _, e := range q.Evicted {
+		dirs = append(dirs, path.Dir(e))
+	}
+
+	return dirs
+}
+
+// parseSize parses a size such as 500GB, 1.5TiB or 1048576.
+func parseSize(value string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(value))
+	multiplier := 1.0
+
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			multiplier = u.multiplier
+
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 || n*multiplier > math.MaxInt64 {
+		return 0, errors.Errorf("invalid size %q", value)
+	}
+
+	return int64(n * multiplier), nil
+}
+
+// formatSize returns a size in the largest binary unit it fills.
+func formatSize(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	v := float64(n)
+
+	i := 0
+	for ; v >= 1024 && i < len(units)-1; i++ {
+		v /= 1024
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
+
+// backupQuota returns the size limit for the backup directory, or 0 if
+// there is none.
+func backupQuota() (int64, error) {
+	value, _ := GetEnvOrFile(envSobaBackupQuota)
+	if value == "" {
+		return 0, nil
+	}
+
+	quota, err := parseSize(value)
+	if err != nil {
+		return 0, errors.WithMessage(err, envSobaBackupQuota)
+	}
+
+	return quota, nil
+}
+
+// enforceQuota evicts backups, oldest first across all repositories, until
+// the backup directory fits within the quota. The latest backup of each
+// repository and locked or held backups are never evicted. Release assets
+// count towards the quota and are removed once no remaining archive
+// references them.
+func enforceQuota(ctx context.Context, s *localStorage, quota int64, now time.Time, result *QuotaResult) {
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		result.Error = errors.Wrap(err, "failed to list backups for quota")
+
+		return
+	}
+
+	sizes := make(map[string]int64, len(objects))
+
+	var used int64
+
+	for _, o := range objects {
+		sizes[o.Key] = o.Size
+		used += o.Size
+	}
+
+	result.Quota = quota
+	result.Used = used
+
+	if used <= quota {
+		return
+	}
+
+	held := readHolds(ctx, s, objects)
+	assets := releaseAssetFiles(objects)
+	refs := releaseAssetRefs{}
+
+	if _, err = readStateJSON(s.root, releaseAssetsState, &refs); err != nil {
+		result.Error = errors.WithStack(err)
+
+		return
+	}
+
+	dirSets := groupBackupSets(objects)
+
+	var candidates []*backupSet
+
+	for _, sets := range dirSets {
+		candidates = append(candidates, sets[1:]...)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].timestamp != candidates[j].timestamp {
+			return candidates[i].timestamp < candidates[j].timestamp
+		}
+
+		return candidates[i].dir < candidates[j].dir
+	})
+
+	for _, set := range candidates {
+		if used <= quota {
+			break
+		}
+
+		if _, ok := held.held(set, now); ok || len(lockedKeys(ctx, s, set.keys, now)) > 0 {
+			continue
+		}
+
+		for _, key := range set.keys {
+			if dErr := removeBackupFile(ctx, s, key); dErr != nil {
+				result.Error = errors.WithMessagef(dErr, "failed to remove %s", key)
+
+				return
+			}
+
+			used -= sizes[key]
+		}
+
+		if dErr := removeExpiredHold(ctx, s, set); dErr != nil {
+			result.Error = errors.WithStack(dErr)
+
+			return
+		}
+
+		logger.Printf("quota: evicted %s/%s", set.dir, set.timestamp)
+
+		result.Evicted = append(result.Evicted, path.Join(set.dir, set.timestamp))
+
+		dirSets[set.dir] = slices.DeleteFunc(dirSets[set.dir], func(other *backupSet) bool { return other == set })
+
+		if len(assets[set.dir]) == 0 {
+			continue
+		}
+
+		pruned, pErr := pruneDirAssets(ctx, s, refs, set.dir, dirSets[set.dir], assets[set.dir], now)
+
+		for _, o := range pruned {
+			used -= o.Size
+		}
+
+		assets[set.dir] = slices.DeleteFunc(assets[set.dir], func(o ObjectInfo) bool { return slices.Contains(pruned, o) })
+
+		if pErr != nil {
+			result.Error = errors.WithMessagef(pErr, "failed to remove release assets of %s", set.dir)
+
+			return
+		}
+	}
+
+	result.Used = used
+
+	if used > quota {
+		result.Error = errors.Errorf("backups use %s, over the %s quota, with nothing left to evict",
+			formatSize(used), formatSize(quota))
+	}
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	for value, want := range map[string]int64{
+		"1048576": 1 << 20,
+		"500GB":   500e9,
+		"1.5TiB":  3 << 39,
+		"10 mib":  10 << 20,
+		"2k":      2 << 10,
+	} {
+		got, err := parseSize(value)
+		require.NoError(t, err, value)
+		require.Equal(t, want, got, value)
+	}
+
+	for _, value := range []string{"", "GB", "-1GB", "lots"} {
+		_, err := parseSize(value)
+		require.Error(t, err, value)
+	}
+
+	require.Equal(t, "1.5 GiB", formatSize(3<<29))
+	require.Equal(t, "10 B", formatSize(10))
+}
+
+func TestBackupQuotaFromFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "quota")
+	require.NoError(t, os.WriteFile(file, []byte("500GB\n"), 0o600))
+
+	t.Setenv(envSobaBackupQuota+envFileSuffix, file)
+
+	quota, err := backupQuota()
+	require.NoError(t, err)
+	require.Equal(t, int64(500e9), quota)
+}
+
+func TestEnforceQuota(t *testing.T) {
+	root := t.TempDir()
+	s := newLocalStorage(root)
+
+	writeBackupFile(t, root, "github.com/owner/a/a.20240101000000.bundle", "1111")
+	writeBackupFile(t, root, "github.com/owner/a/a.20240103000000.bundle", "2222")
+	writeBackupFile(t, root, "github.com/owner/a/a.20240105000000.bundle", "3333")
+	writeBackupFile(t, root, "github.com/owner/b/b.20240102000000.bundle", "4444")
+	writeBackupFile(t, root, "github.com/owner/b/b.20240102000000.manifest", "{}")
+	writeBackupFile(t, root, "github.com/owner/b/b.20240104000000.bundle", "5555")
+
+	var result QuotaResult
+
+	// 22 bytes used, so the two oldest sets across both repositories go
+	enforceQuota(t.Context(), s, 13, time.Now(), &result)
+	require.Nil(t, result.Error)
+	require.Equal(t, []string{"github.com/owner/a/20240101000000", "github.com/owner/b/20240102000000"}, result.Evicted)
+	require.Equal(t, []string{"github.com/owner/a", "github.com/owner/b"}, result.evictedDirs())
+	require.Equal(t, int64(12), result.Used)
+	require.NoFileExists(t, filepath.Join(root, "github.com/owner/b/b.20240102000000.manifest"))
+
+	// the latest backup of each repository is never evicted
+	result = QuotaResult{}
+
+	enforceQuota(t.Context(), s, 4, time.Now(), &result)
+	require.ErrorContains(t, result.Error, "nothing left to evict")
+	require.Equal(t, []string{"github.com/owner/a/20240103000000"}, result.Evicted)
+	require.FileExists(t, filepath.Join(root, "github.com/owner/a/a.20240105000000.bundle"))
+	require.FileExists(t, filepath.Join(root, "github.com/owner/b/b.20240104000000.bundle"))
+}
@@ -0,0 +1,361 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	ageSuffix         = ".age"
+	bundleExtension   = ".bundle"
+	manifestExtension = ".manifest"
+	lfsExtension      = ".lfs.tar.gz"
+
+	// refsSuffix names the file holding a digest of the refs in a bundle.
+	// With public key encryption soba can not read earlier bundles back, so
+	// the digest is what lets it recognise a backup that changed nothing.
+	refsSuffix = ".refs"
+)
+
+// EncryptionResult reports the backups encrypted to BUNDLE_RECIPIENTS
+// during a run.
+type EncryptionResult struct {
+	Encrypted int      `json:"encrypted"`
+	Unchanged int      `json:"unchanged"`
+	Error     errors.E `json:"error,omitempty"`
+}
+
+// bundleRecipients returns the recipients configured in BUNDLE_RECIPIENTS,
+// or nil if public key encryption is not in use.
+func bundleRecipients() ([]age.Recipient, error) {
+	value, _ := GetEnvOrFile(envVarBundleRecipients)
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	return parseRecipients(value)
+}
+
+// parseRecipients parses age X25519 recipients (age1...) and SSH public keys
+// (ssh-ed25519 and ssh-rsa), separated by newlines or commas. Blank lines and
+// lines starting with # are ignored.
+func parseRecipients(value string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+
+	for _, line := range strings.FieldsFunc(value, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var (
+			r   age.Recipient
+			err error
+		)
+
+		if strings.HasPrefix(line, "ssh-") {
+			r, err = agessh.ParseRecipient(line)
+		} else {
+			r, err = age.ParseX25519Recipient(line)
+		}
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid recipient in %s", envVarBundleRecipients)
+		}
+
+		recipients = append(recipients, r)
+	}
+
+	if len(recipients) == 0 {
+		return nil, errors.Errorf("%s contains no recipients", envVarBundleRecipients)
+	}
+
+	return recipients, nil
+}
+
+// encryptionRecipients returns the recipients new backups are encrypted to:
+// the BUNDLE_PASSPHRASE, or the public keys in BUNDLE_RECIPIENTS.
+func encryptionRecipients() ([]age.Recipient, error) {
+	if passphrase, _ := GetEnvOrFile(envVarBundlePassphrase); passphrase != "" {
+		r, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		return []age.Recipient{r}, nil
+	}
+
+	recipients, err := bundleRecipients()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recipients) == 0 {
+		return nil, errors.Errorf("one of %s or %s must be set", envVarBundlePassphrase, envVarBundleRecipients)
+	}
+
+	return recipients, nil
+}
+
+// parseIdentities parses age identities (AGE-SECRET-KEY-...) and unencrypted
+// SSH private keys in PEM form, as found in an age identity file.
+func parseIdentities(value string) ([]age.Identity, error) {
+	var identities []age.Identity
+
+	for len(strings.TrimSpace(value)) > 0 {
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, "-----BEGIN") {
+			end := strings.Index(value, "-----END")
+			if end == -1 {
+				return nil, errors.New("unterminated SSH private key")
+			}
+
+			if nl := strings.IndexByte(value[end:], '\n'); nl != -1 {
+				end += nl
+			} else {
+				end = len(value)
+			}
+
+			id, err := agessh.ParseIdentity([]byte(value[:end]))
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid SSH identity")
+			}
+
+			identities = append(identities, id)
+			value = value[end:]
+
+			continue
+		}
+
+		line, rest, _ := strings.Cut(value, "\n")
+		value = rest
+
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, err := age.ParseX25519Identity(line)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid age identity")
+		}
+
+		identities = append(identities, id)
+	}
+
+	return identities, nil
+}
+
+// validateEncryptionConfig rejects configurations where it is unclear how
+// backups should be encrypted.
+func validateEncryptionConfig() error {
+	passphrase, _ := GetEnvOrFile(envVarBundlePassphrase)
+	recipients, _ := GetEnvOrFile(envVarBundleRecipients)
+
+	if passphrase != "" && strings.TrimSpace(recipients) != "" {
+		return errors.Errorf("only one of %s and %s may be set", envVarBundlePassphrase, envVarBundleRecipients)
+	}
+
+	_, err := bundleRecipients()
+
+	return err
+}
+
+// encryptingReader returns a reader producing src encrypted to recipients.
+func encryptingReader(src io.Reader, recipients ...age.Recipient) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		w, err := age.Encrypt(pw, recipients...)
+		if err == nil {
+			if _, err = io.Copy(w, src); err == nil {
+				err = w.Close()
+			}
+		}
+
+		_ = pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+// encryptBackups encrypts every plaintext bundle, manifest and LFS archive
+// to recipients, including those written before recipients were configured
+// or left behind by a run that failed, removing the plaintext once the
+// encrypted copy is in place. A backup written since the given time whose
+// bundle refs match the previous backup of the repository is discarded, as
+// githosts can not compare against a bundle it is unable to decrypt.
+func encryptBackups(ctx context.Context, s *localStorage, since time.Time, recipients []age.Recipient, result *EncryptionResult) {
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		result.Error = errors.Wrap(err, "failed to list backups to encrypt")
+
+		return
+	}
+
+	modTimes := make(map[string]time.Time, len(objects))
+	for _, o := range objects {
+		modTimes[o.Key] = o.ModTime
+	}
+
+	for dir, sets := range groupBackupSets(objects) {
+		for i, set := range sets {
+			plaintext := plaintextKeys(set.keys)
+			if len(plaintext) == 0 {
+				continue
+			}
+
+			// only new backups are compared, older ones are kept as they are
+			var older []*backupSet
+
+			if slices.ContainsFunc(plaintext, func(k string) bool { return !modTimes[k].Before(since) }) {
+				older = sets[i+1:]
+			}
+
+			unchanged, eErr := encryptBackupSet(ctx, s, set, older, plaintext, recipients)
+			if eErr != nil {
+				result.Error = errors.WithMessagef(eErr, "failed to encrypt backup %s/%s", dir, set.timestamp)
+
+				return
+			}
+
+			if unchanged {
+				result.Unchanged++
+
+				continue
+			}
+
+			result.Encrypted++
+		}
+	}
+}
+
+// plaintextKeys returns the unencrypted backup files of a backup set.
+func plaintextKeys(keys []string) []string {
+	var plaintext []string
+
+	for _, k := range keys {
+		if strings.HasSuffix(k, ageSuffix) || strings.HasSuffix(k, refsSuffix) {
+			continue
+		}
+
+		plaintext = append(plaintext, k)
+	}
+
+	return plaintext
+}
+
+func encryptBackupSet(ctx context.Context, s *localStorage, set *backupSet, older []*backupSet, plaintext []string, recipients []age.Recipient) (bool, error) {
+	var digest string
+
+	for _, key := range plaintext {
+		if !strings.HasSuffix(key, bundleExtension) {
+			continue
+		}
+
+		var err error
+
+		if digest, err = bundleRefsDigest(ctx, s, key); err != nil {
+			return false, err
+		}
+
+		if len(older) > 0 && digest == readRefsDigest(ctx, s, older[0]) {
+			for _, k := range plaintext {
+				if err = s.Delete(ctx, k); err != nil {
+					return false, err
+				}
+			}
+
+			return true, nil
+		}
+	}
+
+	for _, key := range plaintext {
+		if err := encryptFile(ctx, s, key, recipients); err != nil {
+			return false, errors.WithMessage(err, key)
+		}
+	}
+
+	if digest != "" {
+		if err := s.Put(ctx, set.key(refsSuffix), strings.NewReader(digest), int64(len(digest))); err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+func readRefsDigest(ctx context.Context, s Storage, set *backupSet) string {
+	r, err := s.Get(ctx, set.key(refsSuffix))
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = r.Close() }()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return ""
+	}
+
+	return string(b)
+}
+
+func encryptFile(ctx context.Context, s *localStorage, key string, recipients []age.Recipient) error {
+	src, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	r := encryptingReader(src, recipients...)
+
+	err = s.Put(ctx, key+ageSuffix, r, -1)
+
+	_ = r.Close()
+	_ = src.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return s.Delete(ctx, key)
+}
+
+// bundleRefsDigest returns the SHA-256 of the header of a git bundle, which
+// lists every ref it contains and the commit each points to.
+func bundleRefsDigest(ctx context.Context, s Storage, key string) (string, error) {
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = r.Close() }()
+
+	br := bufio.NewReader(r)
+	h := sha256.New()
+
+	for {
+		line, rErr := br.ReadBytes('\n')
+		if rErr != nil {
+			return "", errors.Wrap(rErr, "failed to read bundle header")
+		}
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+
+		h.Write(line)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
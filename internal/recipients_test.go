@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+)
+
+const testBundleHeader = "# v2 git bundle\n" +
+	"1111111111111111111111111111111111111111 refs/heads/main\n" +
+	"\n" +
+	"PACK"
+
+func TestParseRecipients(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	recipients, err := parseRecipients("# backup key\n" + identity.Recipient().String() + "\n\n" +
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN restore@example")
+	require.NoError(t, err)
+	require.Len(t, recipients, 2)
+
+	_, err = parseRecipients("age1invalid")
+	require.Error(t, err)
+
+	_, err = parseRecipients("# only a comment")
+	require.Error(t, err)
+}
+
+func TestValidateEncryptionConfig(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	t.Setenv(envVarBundlePassphrase, "")
+	t.Setenv(envVarBundleRecipients, identity.Recipient().String())
+	require.NoError(t, validateEncryptionConfig())
+
+	t.Setenv(envVarBundlePassphrase, "secret")
+	require.Error(t, validateEncryptionConfig())
+}
+
+func TestEncryptBackupsToRecipients(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	root := t.TempDir()
+	s := newLocalStorage(root)
+	since := time.Now().Add(-time.Minute)
+
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101000000.bundle", testBundleHeader)
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101000000.manifest", "{}")
+
+	var result EncryptionResult
+
+	encryptBackups(t.Context(), s, since, []age.Recipient{identity.Recipient()}, &result)
+	require.Nil(t, result.Error)
+	require.Equal(t, 1, result.Encrypted)
+
+	dir := filepath.Join(root, "github.com/owner/repo")
+	require.NoFileExists(t, filepath.Join(dir, "repo.20240101000000.bundle"))
+	require.NoFileExists(t, filepath.Join(dir, "repo.20240101000000.manifest"))
+	require.FileExists(t, filepath.Join(dir, "repo.20240101000000.manifest.age"))
+	require.FileExists(t, filepath.Join(dir, "repo.20240101000000.refs"))
+
+	// only the holder of the identity can read the bundle back
+	f, err := os.Open(filepath.Join(dir, "repo.20240101000000.bundle.age"))
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	r, err := age.Decrypt(f, identity)
+	require.NoError(t, err)
+
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, testBundleHeader, string(b))
+
+	// a later backup with the same refs is discarded
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240102000000.bundle", testBundleHeader)
+
+	result = EncryptionResult{}
+
+	encryptBackups(t.Context(), s, since, []age.Recipient{identity.Recipient()}, &result)
+	require.Nil(t, result.Error)
+	require.Zero(t, result.Encrypted)
+	require.Equal(t, 1, result.Unchanged)
+	require.NoFileExists(t, filepath.Join(dir, "repo.20240102000000.bundle"))
+	require.NoFileExists(t, filepath.Join(dir, "repo.20240102000000.bundle.age"))
+
+	// and one with changed refs is kept
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240103000000.bundle",
+		strings.Replace(testBundleHeader, "1111", "2222", 1))
+
+	result = EncryptionResult{}
+
+	encryptBackups(t.Context(), s, since, []age.Recipient{identity.Recipient()}, &result)
+	require.Nil(t, result.Error)
+	require.Equal(t, 1, result.Encrypted)
+	require.FileExists(t, filepath.Join(dir, "repo.20240103000000.bundle.age"))
+
+	// plaintext backups written before the run are encrypted too, even with
+	// the same refs as the backup before them
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20231201000000.bundle", testBundleHeader)
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20231101000000.bundle", testBundleHeader)
+
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"repo.20231201000000.bundle", "repo.20231101000000.bundle"} {
+		require.NoError(t, os.Chtimes(filepath.Join(dir, name), old, old))
+	}
+
+	result = EncryptionResult{}
+
+	encryptBackups(t.Context(), s, since, []age.Recipient{identity.Recipient()}, &result)
+	require.Nil(t, result.Error)
+	require.Equal(t, 2, result.Encrypted)
+	require.FileExists(t, filepath.Join(dir, "repo.20231201000000.bundle.age"))
+	require.FileExists(t, filepath.Join(dir, "repo.20231101000000.bundle.age"))
+	require.NoFileExists(t, filepath.Join(dir, "repo.20231201000000.bundle"))
+}
@@ -0,0 +1,344 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	rekeyJournalName  = "rekey.journal"
+	rekeyJournalMode  = 0o600
+	rekeyJournalKeyID = "key-id "
+)
+
+// RekeyReport lists every file considered by a rekey.
+type RekeyReport struct {
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt time.Time     `json:"finished_at"`
+	DryRun     bool          `json:"dry_run,omitempty"`
+	Rekeyed    []string      `json:"rekeyed"`
+	Current    []string      `json:"current,omitempty"`
+	Failed     []FileFailure `json:"failed,omitempty"`
+}
+
+// FileFailure records a file a command could not process.
+type FileFailure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+func runRekey(args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list the files that would be re-keyed without changing them")
+
+	flags.Usage = func() {
+		_, _ = io.WriteString(flags.Output(), "usage: soba rekey [-dry-run]\n\n"+
+			"Decrypts every .age file under "+envGitBackupDir+" with "+envVarBundlePassphraseOld+", "+envVarBundleIdentities+
+			"\nor "+envVarBundleKeyring+" and re-encrypts it with "+envVarBundlePassphrase+" or "+envVarBundleRecipients+".\n\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+
+		return errors.WithStack(err)
+	}
+
+	backupDir, err := commandBackupDir()
+	if err != nil {
+		return err
+	}
+
+	// the new passphrase is included so files already re-keyed by an earlier
+	// run can be recognised even without the journal
+	ring, err := loadKeyring(envVarBundlePassphraseOld, envVarBundlePassphrase)
+	if err != nil {
+		return errors.WithMessage(err, "no old key")
+	}
+
+	var current string
+
+	if passphrase, _ := GetEnvOrFile(envVarBundlePassphrase); passphrase != "" {
+		if current, err = passphraseFingerprint(passphrase); err != nil {
+			return err
+		}
+	}
+
+	if len(ring.keys) == 1 && ring.keys[0].fingerprint == current {
+		return errors.Errorf("no old key: one of %s, %s or %s must be set",
+			envVarBundlePassphraseOld, envVarBundleIdentities, envVarBundleKeyring)
+	}
+
+	recipients, err := encryptionRecipients()
+	if err != nil {
+		return errors.WithMessage(err, "no new key")
+	}
+
+	rekey := &rekeyer{
+		storage:    newLocalStorage(backupDir, resolveWorkingDir(backupDir)),
+		backupDir:  backupDir,
+		ring:       ring,
+		current:    current,
+		recipients: recipients,
+		keyID:      newKeyID(current),
+	}
+
+	report, err := rekey.run(context.Background(), *dryRun)
+	if err != nil {
+		return err
+	}
+
+	if current != "" && !*dryRun {
+		if err = rekey.recordUsage(context.Background(), report); err != nil {
+			return err
+		}
+	}
+
+	if !*dryRun {
+		if err = signChecksums(context.Background(), rekey.storage, report.StartedAt); err != nil {
+			return err
+		}
+	}
+
+	name := "rekey-report-" + report.StartedAt.Format(timeStampFormat) + ".json"
+	if err = writeStateJSON(backupDir, name, report); err != nil {
+		return err
+	}
+
+	logger.Printf("rekey: %d re-keyed, %d already current, %d failed; report written to %s",
+		len(report.Rekeyed), len(report.Current), len(report.Failed), statePath(backupDir, name))
+
+	if len(report.Failed) > 0 {
+		return errors.Errorf("failed to re-key %d files", len(report.Failed))
+	}
+
+	return nil
+}
+
+// newKeyID identifies the key being re-keyed to, so a journal left by an
+// interrupted run is only resumed with the same key. A passphrase is
+// identified by its salted fingerprint, recipients, being public, by their
+// hash.
+func newKeyID(current string) string {
+	if current != "" {
+		return current
+	}
+
+	recipients, _ := GetEnvOrFile(envVarBundleRecipients)
+
+	sum := sha256.Sum256([]byte("recipients:" + recipients))
+
+	return hex.EncodeToString(sum[:])
+}
+
+type rekeyer struct {
+	storage   *localStorage
+	backupDir string
+	ring      *keyring
+	// current is the fingerprint of the new passphrase, if there is one.
+	current    string
+	recipients []age.Recipient
+	keyID      string
+}
+
+// run re-encrypts every .age file in the backup directory. Each file is
+// replaced atomically and recorded in a journal as soon as it is done, so an
+// interrupted run can be repeated and carries on where it stopped.
+func (r *rekeyer) run(ctx context.Context, dryRun bool) (*RekeyReport, error) {
+	report := &RekeyReport{StartedAt: time.Now().UTC(), DryRun: dryRun}
+
+	objects, err := r.storage.List(ctx, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list backups")
+	}
+
+	done, err := r.readJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	var journal *os.File
+
+	if !dryRun {
+		if journal, err = r.openJournal(len(done) == 0); err != nil {
+			return nil, err
+		}
+		defer func() { _ = journal.Close() }()
+	}
+
+	for _, o := range objects {
+		if !strings.HasSuffix(o.Key, ageSuffix) {
+			continue
+		}
+
+		if done[o.Key] {
+			report.Current = append(report.Current, o.Key)
+
+			continue
+		}
+
+		// replacing a file would defeat the protection of immutable mode
+		if len(lockedKeys(ctx, r.storage, []string{o.Key}, time.Now())) > 0 {
+			report.Failed = append(report.Failed, FileFailure{Key: o.Key, Error: "backup is locked"})
+
+			continue
+		}
+
+		if dryRun {
+			report.Rekeyed = append(report.Rekeyed, o.Key)
+
+			continue
+		}
+
+		current, rErr := r.rekeyFile(ctx, o.Key)
+		if rErr != nil {
+			logger.Printf("rekey: failed to re-key %s: %s", o.Key, rErr)
+
+			report.Failed = append(report.Failed, FileFailure{Key: o.Key, Error: rErr.Error()})
+
+			continue
+		}
+
+		if current {
+			report.Current = append(report.Current, o.Key)
+		} else {
+			report.Rekeyed = append(report.Rekeyed, o.Key)
+		}
+
+		if _, err = journal.WriteString(o.Key + "\n"); err == nil {
+			err = journal.Sync()
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to update rekey journal")
+		}
+	}
+
+	report.FinishedAt = time.Now().UTC()
+
+	// the journal is only needed to resume an incomplete run
+	if !dryRun && len(report.Failed) == 0 {
+		_ = journal.Close()
+
+		if err = os.Remove(statePath(r.backupDir, rekeyJournalName)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return report, nil
+}
+
+// rekeyFile re-encrypts a single file, reporting whether it was already
+// encrypted with the new key.
+func (r *rekeyer) rekeyFile(ctx context.Context, key string) (bool, error) {
+	src, err := r.storage.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = src.Close() }()
+
+	plaintext, fingerprint, err := r.ring.decrypt(src)
+	if err != nil {
+		return false, err
+	}
+
+	if r.current != "" && fingerprint == r.current {
+		return true, nil
+	}
+
+	encrypted := encryptingReader(plaintext, r.recipients...)
+	defer func() { _ = encrypted.Close() }()
+
+	return false, r.storage.Put(ctx, key, encrypted, -1)
+}
+
+// recordUsage notes in the keyring usage that the files re-keyed, or found
+// to be current, now need only the new passphrase.
+func (r *rekeyer) recordUsage(ctx context.Context, report *RekeyReport) error {
+	usage, err := loadKeyringUsage(r.backupDir)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range append(append([]string{}, report.Rekeyed...), report.Current...) {
+		usage.Files[key] = r.current
+	}
+
+	return usage.save(ctx, r.backupDir, r.storage)
+}
+
+// readJournal returns the files completed by an earlier, interrupted run.
+func (r *rekeyer) readJournal() (map[string]bool, error) {
+	f, err := os.Open(statePath(r.backupDir, rekeyJournalName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]bool{}, nil
+		}
+
+		return nil, errors.WithStack(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	done := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if keyID, ok := strings.CutPrefix(line, rekeyJournalKeyID); ok {
+			if keyID != r.keyID {
+				return nil, errors.Errorf("%s was written re-keying to a different key; finish that rekey or remove the journal",
+					statePath(r.backupDir, rekeyJournalName))
+			}
+
+			continue
+		}
+
+		done[line] = true
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if len(done) > 0 {
+		logger.Printf("rekey: resuming, %d files already re-keyed", len(done))
+	}
+
+	return done, nil
+}
+
+func (r *rekeyer) openJournal(create bool) (*os.File, error) {
+	p := statePath(r.backupDir, rekeyJournalName)
+
+	if err := os.MkdirAll(statePath(r.backupDir), storageDirMode); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, rekeyJournalMode)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if create {
+		if _, err = f.WriteString(rekeyJournalKeyID + r.keyID + "\n"); err != nil {
+			_ = f.Close()
+
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return f, nil
+}
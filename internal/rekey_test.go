@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+)
+
+// writeEncryptedBackupFile writes content encrypted with a passphrase using a
+// low scrypt work factor to keep tests fast.
+func writeEncryptedBackupFile(t *testing.T, backupDir, rel, content, passphrase string) {
+	t.Helper()
+
+	r, err := age.NewScryptRecipient(passphrase)
+	require.NoError(t, err)
+	r.SetWorkFactor(10)
+
+	var buf bytes.Buffer
+
+	w, err := age.Encrypt(&buf, r)
+	require.NoError(t, err)
+
+	_, err = io.WriteString(w, content)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	writeBackupFile(t, backupDir, rel, buf.String())
+}
+
+func decryptBackupFile(t *testing.T, path string, identity age.Identity) string {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	r, err := age.Decrypt(f, identity)
+	require.NoError(t, err)
+
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	return string(b)
+}
+
+func TestRekeyToRecipients(t *testing.T) {
+	backupDir := t.TempDir()
+	writeEncryptedBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle.age", "bundle", "old")
+	writeEncryptedBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.manifest.age", "manifest", "old")
+	writeBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.refs", "digest")
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	t.Setenv(envGitBackupDir, backupDir)
+	t.Setenv(envVarBundlePassphraseOld, "old")
+	t.Setenv(envVarBundleIdentities, "")
+	t.Setenv(envVarBundlePassphrase, "")
+	t.Setenv(envVarBundleRecipients, identity.Recipient().String())
+
+	require.NoError(t, RunCommand([]string{"rekey"}))
+
+	dir := filepath.Join(backupDir, "github.com/owner/repo")
+	require.Equal(t, "bundle", decryptBackupFile(t, filepath.Join(dir, "repo.20240101000000.bundle.age"), identity))
+	require.Equal(t, "manifest", decryptBackupFile(t, filepath.Join(dir, "repo.20240101000000.manifest.age"), identity))
+	require.NoFileExists(t, statePath(backupDir, rekeyJournalName))
+
+	reports, err := filepath.Glob(statePath(backupDir, "rekey-report-*.json"))
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+
+	var report RekeyReport
+
+	found, err := readStateJSON(backupDir, filepath.Base(reports[0]), &report)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Len(t, report.Rekeyed, 2)
+	require.Empty(t, report.Failed)
+}
+
+func TestRekeyResumesFromJournal(t *testing.T) {
+	backupDir := t.TempDir()
+	writeEncryptedBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle.age", "one", "old")
+	writeEncryptedBackupFile(t, backupDir, "github.com/owner/repo/repo.20240102000000.bundle.age", "two", "old")
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	t.Setenv(envVarBundlePassphrase, "")
+	t.Setenv(envVarBundleRecipients, identity.Recipient().String())
+
+	ring := &keyring{}
+	require.NoError(t, ring.addPassphrase("old"))
+
+	r := &rekeyer{
+		storage:    newLocalStorage(backupDir),
+		backupDir:  backupDir,
+		ring:       ring,
+		recipients: []age.Recipient{identity.Recipient()},
+		keyID:      newKeyID(""),
+	}
+
+	// simulate a run interrupted after re-keying the first file
+	_, err = r.rekeyFile(t.Context(), "github.com/owner/repo/repo.20240101000000.bundle.age")
+	require.NoError(t, err)
+
+	journal, err := r.openJournal(true)
+	require.NoError(t, err)
+
+	_, err = journal.WriteString("github.com/owner/repo/repo.20240101000000.bundle.age\n")
+	require.NoError(t, err)
+	require.NoError(t, journal.Close())
+
+	report, err := r.run(t.Context(), false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"github.com/owner/repo/repo.20240102000000.bundle.age"}, report.Rekeyed)
+	require.Equal(t, []string{"github.com/owner/repo/repo.20240101000000.bundle.age"}, report.Current)
+	require.Empty(t, report.Failed)
+
+	dir := filepath.Join(backupDir, "github.com/owner/repo")
+	require.Equal(t, "one", decryptBackupFile(t, filepath.Join(dir, "repo.20240101000000.bundle.age"), identity))
+	require.Equal(t, "two", decryptBackupFile(t, filepath.Join(dir, "repo.20240102000000.bundle.age"), identity))
+
+	// a journal written for another key is not resumed
+	r.keyID = "other"
+
+	journal, err = r.openJournal(true)
+	require.NoError(t, err)
+	require.NoError(t, journal.Close())
+
+	r.keyID = newKeyID("")
+
+	_, err = r.run(t.Context(), false)
+	require.ErrorContains(t, err, "different key")
+}
+
+func TestNewKeyID(t *testing.T) {
+	fingerprint, err := passphraseFingerprint("secret")
+	require.NoError(t, err)
+	require.Equal(t, fingerprint, newKeyID(fingerprint))
+
+	t.Setenv(envVarBundleRecipients, "age1one")
+	one := newKeyID("")
+
+	t.Setenv(envVarBundleRecipients, "age1two")
+	require.NotEqual(t, one, newKeyID(""))
+}
+
+func TestRekeySkipsLockedBackups(t *testing.T) {
+	backupDir := t.TempDir()
+	key := "github.com/owner/repo/repo.20240101000000.bundle.age"
+	writeEncryptedBackupFile(t, backupDir, key, "bundle", "old")
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	ring := &keyring{}
+	require.NoError(t, ring.addPassphrase("old"))
+
+	r := &rekeyer{
+		storage:    newLocalStorage(backupDir),
+		backupDir:  backupDir,
+		ring:       ring,
+		recipients: []age.Recipient{identity.Recipient()},
+		keyID:      newKeyID(""),
+	}
+
+	writeBackupFile(t, backupDir, key+lockSuffix,
+		`{"locked_until":"`+time.Now().Add(time.Hour).UTC().Format(time.RFC3339)+`"}`)
+
+	report, err := r.run(t.Context(), false)
+	require.NoError(t, err)
+	require.Equal(t, []FileFailure{{Key: key, Error: "backup is locked"}}, report.Failed)
+	require.Empty(t, report.Rekeyed)
+}
+
+func TestRekeyReportsFilesItCannotDecrypt(t *testing.T) {
+	backupDir := t.TempDir()
+	writeEncryptedBackupFile(t, backupDir, "github.com/owner/repo/repo.20240101000000.bundle.age", "bundle", "unknown")
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	t.Setenv(envGitBackupDir, backupDir)
+	t.Setenv(envVarBundlePassphraseOld, "old")
+	t.Setenv(envVarBundleIdentities, "")
+	t.Setenv(envVarBundlePassphrase, "")
+	t.Setenv(envVarBundleRecipients, identity.Recipient().String())
+
+	err = RunCommand([]string{"rekey"})
+	require.ErrorContains(t, err, "failed to re-key 1 files")
+
+	// the journal is kept so the run can be resumed
+	b, err := os.ReadFile(statePath(backupDir, rekeyJournalName))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(b), rekeyJournalKeyID))
+}
+
+func TestParseIdentities(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	ids, err := parseIdentities("# created: 2024-01-01\n" + identity.String() + "\n")
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+
+	_, err = parseIdentities("AGE-SECRET-KEY-INVALID")
+	require.Error(t, err)
+}
+
+func TestRunCommandRejectsUnknownCommand(t *testing.T) {
+	require.ErrorContains(t, RunCommand([]string{"unknown"}), "unknown command")
+}
@@ -0,0 +1,618 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/jonhadfield/githosts-utils/v2"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envGitHubBackupReleases    = "GITHUB_BACKUP_RELEASES"
+	envGitLabBackupReleases    = "GITLAB_BACKUP_RELEASES"
+	envGiteaBackupReleases     = "GITEA_BACKUP_RELEASES"
+	envSobaReleaseAssetMaxSize = "SOBA_RELEASE_ASSET_MAX_SIZE"
+
+	releasesSuffix       = ".releases"
+	releaseAssetsDIRName = "assets"
+
+	// releasesVersion is incremented when the archive's content changes.
+	releasesVersion = 1
+
+	// releaseAssetsState records the assets each releases archive
+	// references, by directory and archive timestamp, so assets no longer
+	// referenced can be found without reading archives back, which is not
+	// possible once they are encrypted to BUNDLE_RECIPIENTS.
+	releaseAssetsState = "release-assets.json"
+)
+
+// releaseAssetRegex matches the name of a stored asset, its SHA-256.
+var releaseAssetRegex = regexp.MustCompile(`^[0-9a-f]{64}(\.age)?$`)
+
+// releasesArchive is the releases of a repository as returned by the API,
+// and the assets attached to them.
+type releasesArchive struct {
+	exportHeader
+
+	Releases []json.RawMessage `json:"releases"`
+	Assets   []releaseAsset    `json:"assets"`
+}
+
+// releaseAsset is a file attached to a release. Assets are stored once per
+// repository, named by their SHA-256, in the assets directory next to the
+// releases archives.
+type releaseAsset struct {
+	Release   string `json:"release"`
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Size      int64  `json:"size,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	// Skipped is why the asset was not downloaded, e.g. its size
+	Skipped string `json:"skipped,omitempty"`
+
+	// digest is the SHA-256 the provider reports, if any, which saves
+	// downloading an asset already stored
+	digest string
+}
+
+// releaseSource describes how a provider lists releases and their assets.
+type releaseSource struct {
+	client        apiClient
+	domain        string
+	backupsEnvVar string
+	// releases returns the path listing a repository's releases
+	releases func(repo string) string
+	// assets returns the assets attached to a release
+	assets func(release json.RawMessage) []releaseAsset
+	// downloadHeader is added to requests for assets served by the API
+	downloadHeader http.Header
+}
+
+func gitHubReleaseSource(token string) releaseSource {
+	client, domain := gitHubAPIClient(token)
+
+	return releaseSource{
+		client: client, domain: domain, backupsEnvVar: envGitHubBackups,
+		releases: func(repo string) string { return "repos/" + repo + "/releases" },
+		assets: func(release json.RawMessage) []releaseAsset {
+			var r struct {
+				TagName string `json:"tag_name"`
+				Assets  []struct {
+					Name      string `json:"name"`
+					URL       string `json:"url"`
+					Size      int64  `json:"size"`
+					UpdatedAt string `json:"updated_at"`
+					Digest    string `json:"digest"`
+				} `json:"assets"`
+			}
+
+			_ = json.Unmarshal(release, &r)
+
+			assets := make([]releaseAsset, 0, len(r.Assets))
+			for _, a := range r.Assets {
+				assets = append(assets, releaseAsset{
+					Release: r.TagName, Name: a.Name, URL: a.URL, Size: a.Size, UpdatedAt: a.UpdatedAt,
+					digest: strings.TrimPrefix(a.Digest, "sha256:"),
+				})
+			}
+
+			return assets
+		},
+		// the API serves the asset itself, rather than its details, when
+		// asked for a binary
+		downloadHeader: http.Header{"Accept": {"application/octet-stream"}},
+	}
+}
+
+func giteaReleaseSource(token string) releaseSource {
+	_, domain := wikiBaseURL(os.Getenv(envGiteaAPIURL), "")
+
+	return releaseSource{
+		client: apiClient{
+			baseURL: os.Getenv(envGiteaAPIURL),
+			header:  http.Header{"Authorization": {"token " + token}},
+		},
+		domain: domain, backupsEnvVar: envGiteaBackups,
+		releases: func(repo string) string { return "repos/" + repo + "/releases" },
+		assets: func(release json.RawMessage) []releaseAsset {
+			var r struct {
+				TagName string `json:"tag_name"`
+				Assets  []struct {
+					Name               string `json:"name"`
+					BrowserDownloadURL string `json:"browser_download_url"`
+					Size               int64  `json:"size"`
+					CreatedAt          string `json:"created_at"`
+				} `json:"assets"`
+			}
+
+			_ = json.Unmarshal(release, &r)
+
+			assets := make([]releaseAsset, 0, len(r.Assets))
+			for _, a := range r.Assets {
+				assets = append(assets, releaseAsset{
+					Release: r.TagName, Name: a.Name, URL: a.BrowserDownloadURL, Size: a.Size, UpdatedAt: a.CreatedAt,
+				})
+			}
+
+			return assets
+		},
+	}
+}
+
+func gitLabReleaseSource(token string) releaseSource {
+	client, domain := gitLabAPIClient(token)
+
+	return releaseSource{
+		client: client, domain: domain, backupsEnvVar: envGitLabBackups,
+		releases: func(repo string) string { return "projects/" + url.PathEscape(repo) + "/releases" },
+		// the source archives GitLab lists are generated from the repository,
+		// so only links are downloaded
+		assets: func(release json.RawMessage) []releaseAsset {
+			var r struct {
+				TagName string `json:"tag_name"`
+				Assets  struct {
+					Links []struct {
+						Name           string `json:"name"`
+						URL            string `json:"url"`
+						DirectAssetURL string `json:"direct_asset_url"`
+					} `json:"links"`
+				} `json:"assets"`
+			}
+
+			_ = json.Unmarshal(release, &r)
+
+			assets := make([]releaseAsset, 0, len(r.Assets.Links))
+			for _, l := range r.Assets.Links {
+				u := l.DirectAssetURL
+				if u == "" {
+					u = l.URL
+				}
+
+				assets = append(assets, releaseAsset{Release: r.TagName, Name: l.Name, URL: u})
+			}
+
+			return assets
+		},
+	}
+}
+
+// releaseAssetMaxSize returns the largest asset to download, or zero for no
+// limit.
+func releaseAssetMaxSize() (int64, error) {
+	value := os.Getenv(envSobaReleaseAssetMaxSize)
+	if value == "" {
+		return 0, nil
+	}
+
+	size, err := parseSize(value)
+	if err != nil {
+		return 0, errors.WithMessage(err, envSobaReleaseAssetMaxSize)
+	}
+
+	return size, nil
+}
+
+// exportReleases exports the releases of each repository backed up
+// successfully to <repo>.releases next to the repository's bundles,
+// downloading any asset not already stored.
+func exportReleases(backupDir string, source releaseSource, results *githosts.ProviderBackupResult) {
+	if source.client.baseURL == "" {
+		return
+	}
+
+	maxSize, err := releaseAssetMaxSize()
+	if err != nil {
+		logger.Printf("not exporting releases: %s", err)
+
+		return
+	}
+
+	storage := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+
+	exportRepos(results, source.domain, releasesSuffix, func(ctx context.Context, repo string) error {
+		dir := path.Join(source.domain, repo+releasesSuffix)
+		archive := &releasesArchive{exportHeader: exportHeader{Version: releasesVersion, Repository: repo}}
+
+		timestamp, uErr := updateExport(ctx, storage, dir, source.backupsEnvVar, archive, func(time.Time) error {
+			return archive.fetch(ctx, storage, source, repo, dir, maxSize)
+		})
+		if uErr != nil {
+			return uErr
+		}
+
+		existing, existingDir := existingBackups(backupDir, dir)
+
+		return recordReleaseAssets(existing.root, existingDir, timestamp, archive.Assets)
+	})
+}
+
+// fetch replaces the archive's releases with those listed by the provider
+// and stores each asset not stored already.
+func (a *releasesArchive) fetch(ctx context.Context, s *localStorage, source releaseSource, repo, dir string, maxSize int64) error {
+	var releases []json.RawMessage
+
+	if err := source.client.getPages(ctx, source.releases(repo), url.Values{"per_page": {gitHubPageSize}},
+		appendPage(&releases)); err != nil {
+		if errors.Is(err, errAPIUnavailable) {
+			return nil
+		}
+
+		return err
+	}
+
+	// assets stored by an earlier export, by where they were downloaded from
+	known := make(map[string]releaseAsset, len(a.Assets))
+	for _, asset := range a.Assets {
+		if asset.SHA256 != "" {
+			known[asset.URL] = asset
+		}
+	}
+
+	existing, existingDir := existingBackups(s.root, dir)
+	assetsDir := path.Join(existingDir, releaseAssetsDIRName)
+
+	a.Releases = mergeByKey(nil, releases, "tag_name")
+	a.Assets = nil
+
+	for _, release := range a.Releases {
+		for _, asset := range source.assets(release) {
+			if err := storeReleaseAsset(ctx, existing, assetsDir, source, &asset, known[asset.URL], maxSize); err != nil {
+				return errors.WithMessagef(err, "asset %s of release %s", asset.Name, asset.Release)
+			}
+
+			a.Assets = append(a.Assets, asset)
+		}
+	}
+
+	return nil
+}
+
+// storeReleaseAsset sets the SHA-256 of an asset, downloading and storing it
+// in dir unless a file with the same content is stored already, or records
+// why it was skipped.
+func storeReleaseAsset(ctx context.Context, s *localStorage, dir string, source releaseSource, asset *releaseAsset,
+	previous releaseAsset, maxSize int64,
+) error {
+	switch {
+	case previous.SHA256 != "" && previous.Size == asset.Size && previous.UpdatedAt == asset.UpdatedAt &&
+		assetStored(ctx, s, dir, previous.SHA256):
+		asset.SHA256 = previous.SHA256
+
+		return nil
+	case asset.digest != "" && assetStored(ctx, s, dir, asset.digest):
+		asset.SHA256 = asset.digest
+
+		return nil
+	case maxSize > 0 && asset.Size > maxSize:
+		asset.Skipped = "larger than " + formatSize(maxSize)
+
+		return nil
+	}
+
+	workingDir := resolveWorkingDir(s.root)
+
+	if err := os.MkdirAll(workingDir, workingDIRMode); err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp, err := os.CreateTemp(workingDir, "asset-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	h := sha256.New()
+
+	n, err := downloadReleaseAsset(ctx, source, asset.URL, io.MultiWriter(tmp, h), maxSize)
+	if err != nil {
+		return err
+	}
+
+	if maxSize > 0 && n > maxSize {
+		asset.Skipped = "larger than " + formatSize(maxSize)
+
+		return nil
+	}
+
+	asset.SHA256 = hex.EncodeToString(h.Sum(nil))
+	if asset.Size == 0 {
+		asset.Size = n
+	}
+
+	if assetStored(ctx, s, dir, asset.SHA256) {
+		return nil
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return storeAssetFile(ctx, s, tmp, path.Join(dir, asset.SHA256))
+}
+
+// assetStored reports whether an asset with the given SHA-256 is stored in
+// dir, encrypted or not.
+func assetStored(ctx context.Context, s Storage, dir, sum string) bool {
+	for _, key := range []string{path.Join(dir, sum), path.Join(dir, sum+ageSuffix)} {
+		if _, err := s.Stat(ctx, key); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// storeAssetFile writes an asset, encrypted to BUNDLE_PASSPHRASE or
+// BUNDLE_RECIPIENTS if either is set. Assets are not backup sets, so they
+// are encrypted here rather than along with new backups.
+func storeAssetFile(ctx context.Context, s Storage, r io.Reader, key string) error {
+	passphrase, _ := GetEnvOrFile(envVarBundlePassphrase)
+	recipientsValue, _ := GetEnvOrFile(envVarBundleRecipients)
+
+	if passphrase == "" && recipientsValue == "" {
+		return s.Put(ctx, key, r, -1)
+	}
+
+	recipients, err := encryptionRecipients()
+	if err != nil {
+		return err
+	}
+
+	encrypted := encryptingReader(r, recipients...)
+	defer func() { _ = encrypted.Close() }()
+
+	return s.Put(ctx, key+ageSuffix, encrypted, -1)
+}
+
+// downloadReleaseAsset writes an asset to w, stopping once more than maxSize
+// bytes, if set, have been read. The provider's credentials are only sent
+// to its own host, as assets may be links to anywhere.
+func downloadReleaseAsset(ctx context.Context, source releaseSource, assetURL string, w io.Writer, maxSize int64) (int64, error) {
+	if httpClient == nil {
+		httpClient = getHTTPClient(os.Getenv(envSobaLogLevel))
+	}
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, assetURL, nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	if api, pErr := url.Parse(source.client.baseURL); pErr == nil && api.Host == req.URL.Host {
+		for k, values := range source.client.header {
+			req.Header[k] = values
+		}
+
+		for k, values := range source.downloadHeader {
+			req.Header[k] = values
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("GET %s returned %s", req.URL.Path, resp.Status)
+	}
+
+	var r io.Reader = resp.Body
+	if maxSize > 0 {
+		r = io.LimitReader(resp.Body, maxSize+1)
+	}
+
+	n, err := io.Copy(w, r)
+
+	return n, errors.WithStack(err)
+}
+
+// releaseAssetRefs maps each releases directory, and the timestamp of each
+// archive in it, to the SHA-256 of the assets the archive references.
+type releaseAssetRefs map[string]map[string][]string
+
+// recordReleaseAssets records the assets referenced by the archive stored in
+// dir at timestamp.
+func recordReleaseAssets(root, dir, timestamp string, assets []releaseAsset) error {
+	refs := releaseAssetRefs{}
+
+	if _, err := readStateJSON(root, releaseAssetsState, &refs); err != nil {
+		return err
+	}
+
+	sums := []string{}
+
+	for _, asset := range assets {
+		if asset.SHA256 != "" {
+			sums = append(sums, asset.SHA256)
+		}
+	}
+
+	if refs[dir] == nil {
+		refs[dir] = make(map[string][]string)
+	}
+
+	refs[dir][timestamp] = sums
+
+	return writeStateJSON(root, releaseAssetsState, refs)
+}
+
+// referenced returns the SHA-256 of every asset referenced by the archives
+// in sets, or false if the assets of any are unknown, as they were neither
+// recorded nor can be read from the archive.
+func (r releaseAssetRefs) referenced(ctx context.Context, s Storage, dir string, sets []*backupSet) (map[string]bool, bool) {
+	referenced := make(map[string]bool)
+
+	for _, set := range sets {
+		sums, ok := r[dir][set.timestamp]
+		if !ok {
+			var archive releasesArchive
+
+			if found, err := readExport(ctx, s, set, &archive); !found || err != nil {
+				return nil, false
+			}
+
+			for _, asset := range archive.Assets {
+				sums = append(sums, asset.SHA256)
+			}
+		}
+
+		for _, sum := range sums {
+			referenced[sum] = true
+		}
+	}
+
+	return referenced, true
+}
+
+// releaseAssetFiles returns the stored assets by the releases directory
+// holding them.
+func releaseAssetFiles(objects []ObjectInfo) map[string][]ObjectInfo {
+	files := make(map[string][]ObjectInfo)
+
+	for _, o := range objects {
+		if dir, ok := releaseAssetDir(o.Key); ok {
+			files[dir] = append(files[dir], o)
+		}
+	}
+
+	return files
+}
+
+// releaseAssetDir returns the releases directory of a stored asset, or false
+// if key is not one.
+func releaseAssetDir(key string) (string, bool) {
+	dir := path.Dir(key)
+	if path.Base(dir) != releaseAssetsDIRName || !releaseAssetRegex.MatchString(path.Base(key)) {
+		return "", false
+	}
+
+	return path.Dir(dir), true
+}
+
+// releaseAssetKeys returns the keys of the assets stored for the releases
+// directory dir.
+func releaseAssetKeys(ctx context.Context, s Storage, dir string) ([]string, error) {
+	objects, err := s.List(ctx, path.Join(dir, releaseAssetsDIRName)+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+
+	for _, o := range objects {
+		if assetDir, ok := releaseAssetDir(o.Key); ok && assetDir == dir {
+			keys = append(keys, o.Key)
+		}
+	}
+
+	return keys, nil
+}
+
+// pruneDirAssets removes the assets of a releases directory that none of
+// the archives in sets reference, returning those removed. Nothing is
+// removed if the assets of any archive are unknown, and locked assets are
+// kept.
+func pruneDirAssets(ctx context.Context, l *localStorage, refs releaseAssetRefs, dir string, sets []*backupSet,
+	assets []ObjectInfo, now time.Time,
+) ([]ObjectInfo, error) {
+	referenced, ok := refs.referenced(ctx, l, dir, sets)
+	if !ok {
+		return nil, nil
+	}
+
+	var removed []ObjectInfo
+
+	for _, o := range assets {
+		if referenced[strings.TrimSuffix(path.Base(o.Key), ageSuffix)] || len(lockedKeys(ctx, l, []string{o.Key}, now)) > 0 {
+			continue
+		}
+
+		if err := removeBackupFile(ctx, l, o.Key); err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, o)
+	}
+
+	return removed, nil
+}
+
+// pruneReleaseAssets removes the assets no archive in their releases
+// directory references any more, once the archives that did have been
+// rotated, evicted or pruned, returning the directories assets were removed
+// from and how many were. Archived repositories keep their assets.
+func pruneReleaseAssets(ctx context.Context, l *localStorage, now time.Time) ([]string, int, error) {
+	objects, err := l.List(ctx, "")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	refs := releaseAssetRefs{}
+
+	if _, err = readStateJSON(l.root, releaseAssetsState, &refs); err != nil {
+		return nil, 0, err
+	}
+
+	sets := groupBackupSets(objects)
+	files := releaseAssetFiles(objects)
+
+	dirs := make([]string, 0, len(files))
+	for dir := range files {
+		if !strings.HasPrefix(dir, archiveDIRName+"/") {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	slices.Sort(dirs)
+
+	var (
+		changed []string
+		removed int
+	)
+
+	for _, dir := range dirs {
+		pruned, pErr := pruneDirAssets(ctx, l, refs, dir, sets[dir], files[dir], now)
+		if len(pruned) > 0 {
+			changed = append(changed, dir)
+			removed += len(pruned)
+		}
+
+		if pErr != nil {
+			return changed, removed, pErr
+		}
+	}
+
+	// forget archives that are gone
+	for dir, timestamps := range refs {
+		for timestamp := range timestamps {
+			if !slices.ContainsFunc(sets[dir], func(set *backupSet) bool { return set.timestamp == timestamp }) {
+				delete(timestamps, timestamp)
+			}
+		}
+
+		if len(timestamps) == 0 {
+			delete(refs, dir)
+		}
+	}
+
+	return changed, removed, writeStateJSON(l.root, releaseAssetsState, refs)
+}
@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportReleases(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		downloads int
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		asset := func(id, size string) string {
+			return `{"name":"asset-` + id + `","size":` + size + `,"updated_at":"2024-01-01T00:00:00Z","url":"http://` +
+				r.Host + `/repos/owner/repo/releases/assets/` + id + `"}`
+		}
+
+		switch {
+		case r.URL.Path == "/repos/owner/repo/releases":
+			_, _ = w.Write([]byte(`[{"tag_name":"v2","assets":[` + asset("2", "4") + `,` + asset("3", "100") + `]},` +
+				`{"tag_name":"v1","assets":[` + asset("1", "4") + `]}]`))
+		case strings.HasPrefix(r.URL.Path, "/repos/owner/repo/releases/assets/"):
+			if r.Header.Get("Accept") != "application/octet-stream" || r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "expected a binary download", http.StatusBadRequest)
+
+				return
+			}
+
+			downloads++
+			_, _ = w.Write([]byte("same"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv(envGitHubAPIURL, server.URL)
+	t.Setenv(envSobaReleaseAssetMaxSize, "10")
+	t.Setenv(envVarBundlePassphrase, "")
+	_ = os.Unsetenv(envVarBundlePassphrase)
+
+	backupDir := t.TempDir()
+	s := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+	dir := path.Join("127.0.0.1", "owner/repo"+releasesSuffix)
+
+	export := func() {
+		t.Helper()
+
+		results := githosts.ProviderBackupResult{BackupResults: []githosts.RepoBackupResults{
+			{Repo: "owner/repo", Status: repoStatusOK},
+		}}
+
+		exportReleases(backupDir, gitHubReleaseSource("token"), &results)
+		require.Equal(t, githosts.RepoBackupResults{Repo: "owner/repo.releases", Status: repoStatusOK}, results.BackupResults[1])
+	}
+
+	export()
+
+	objects, err := s.List(t.Context(), dir+"/")
+	require.NoError(t, err)
+
+	sets := groupBackupSets(objects)[dir]
+	require.Len(t, sets, 1)
+
+	var archive releasesArchive
+
+	found, err := readExport(t.Context(), s, sets[0], &archive)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Len(t, archive.Releases, 2)
+	require.Len(t, archive.Assets, 3)
+
+	sum := sha256.Sum256([]byte("same"))
+	stored := path.Join(dir, releaseAssetsDIRName, hex.EncodeToString(sum[:]))
+
+	// identical assets are stored once, and those over the size cap skipped
+	require.Equal(t, 2, downloads)
+	require.Len(t, objects, 2)
+	require.Equal(t, stored, objects[0].Key)
+	require.Equal(t, "larger than 10 B", archive.Assets[2].Skipped)
+	require.Equal(t, hex.EncodeToString(sum[:]), archive.Assets[0].SHA256)
+
+	// the assets each archive references are recorded
+	refs := releaseAssetRefs{}
+
+	_, err = readStateJSON(backupDir, releaseAssetsState, &refs)
+	require.NoError(t, err)
+	require.Equal(t, []string{hex.EncodeToString(sum[:]), hex.EncodeToString(sum[:])}, refs[dir][sets[0].timestamp])
+
+	// assets stored already are not downloaded again
+	time.Sleep(time.Second)
+	export()
+	require.Equal(t, 2, downloads)
+
+	objects, err = s.List(t.Context(), dir+"/")
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+}
+
+func TestPruneReleaseAssets(t *testing.T) {
+	root := t.TempDir()
+	s := newLocalStorage(root)
+	now := time.Now()
+	dir := "github.com/owner/repo.releases"
+
+	asset := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+
+		return hex.EncodeToString(sum[:])
+	}
+
+	first, second, unused := asset("first"), asset("second"), asset("unused")
+
+	writeBackupFile(t, root, dir+"/repo.releases.20240101000000.json.gz", "1")
+	writeBackupFile(t, root, dir+"/repo.releases.20240102000000.json.gz", "2")
+	writeBackupFile(t, root, path.Join(dir, releaseAssetsDIRName, first), "first")
+	writeBackupFile(t, root, path.Join(dir, releaseAssetsDIRName, second)+ageSuffix, "second")
+	writeBackupFile(t, root, path.Join(dir, releaseAssetsDIRName, unused), "unused")
+
+	// an archive whose assets are neither recorded nor readable
+	writeBackupFile(t, root, "github.com/owner/other.releases/other.releases.20240101000000.json.gz", "not gzip")
+	writeBackupFile(t, root, path.Join("github.com/owner/other.releases", releaseAssetsDIRName, unused), "unused")
+
+	require.NoError(t, writeStateJSON(root, releaseAssetsState, releaseAssetRefs{dir: {
+		"20231231000000": {unused},
+		"20240101000000": {first},
+		"20240102000000": {second},
+	}}))
+
+	objects, err := s.List(t.Context(), "")
+	require.NoError(t, err)
+
+	// assets are checksummed with their releases directory
+	require.True(t, slices.ContainsFunc(groupRepoFiles(objects)[dir].backups, func(o ObjectInfo) bool {
+		return o.Key == path.Join(dir, releaseAssetsDIRName, first)
+	}))
+
+	dirs, removed, err := pruneReleaseAssets(t.Context(), s, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{dir}, dirs)
+	require.Equal(t, 1, removed)
+	require.NoFileExists(t, filepath.Join(root, dir, releaseAssetsDIRName, unused))
+	require.FileExists(t, filepath.Join(root, "github.com/owner/other.releases", releaseAssetsDIRName, unused))
+
+	refs := releaseAssetRefs{}
+
+	_, err = readStateJSON(root, releaseAssetsState, &refs)
+	require.NoError(t, err)
+	require.NotContains(t, refs[dir], "20231231000000")
+
+	// evicting an archive evicts the assets only it referenced
+	var quota QuotaResult
+
+	enforceQuota(t.Context(), s, 1, now, &quota)
+	require.Equal(t, []string{dir + "/20240101000000"}, quota.Evicted)
+	require.NoFileExists(t, filepath.Join(root, dir, releaseAssetsDIRName, first))
+	require.FileExists(t, filepath.Join(root, dir, releaseAssetsDIRName, second)+ageSuffix)
+
+	// and pruning a repository's backups prunes its assets
+	objects, err = s.List(t.Context(), "")
+	require.NoError(t, err)
+
+	action, err := pruneRepoBackups(t.Context(), s, dir, groupBackupSets(objects)[dir], holds{}, now)
+	require.NoError(t, err)
+	require.Equal(t, missingPruned, action)
+	require.NoDirExists(t, filepath.Join(root, dir))
+}
+
+func TestStoreAssetFileEncrypts(t *testing.T) {
+	t.Setenv(envVarBundlePassphrase, "secret")
+
+	s := newLocalStorage(t.TempDir())
+
+	require.NoError(t, storeAssetFile(t.Context(), s, strings.NewReader("binary"), "example.com/repo.releases/assets/abc"))
+	require.True(t, assetStored(t.Context(), s, "example.com/repo.releases/assets", "abc"))
+
+	_, err := s.Stat(t.Context(), "example.com/repo.releases/assets/abc"+ageSuffix)
+	require.NoError(t, err)
+
+	ring, err := loadKeyring(envVarBundlePassphrase)
+	require.NoError(t, err)
+
+	f, err := s.Get(t.Context(), "example.com/repo.releases/assets/abc"+ageSuffix)
+	require.NoError(t, err)
+
+	defer func() { _ = f.Close() }()
+
+	r, _, err := ring.decrypt(f)
+	require.NoError(t, err)
+
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "binary", string(b))
+}
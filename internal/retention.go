@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// unlimitedBackupsToRetain is passed to githosts when soba applies
+// retention itself, so githosts never deletes a backup.
+const unlimitedBackupsToRetain = math.MaxInt32
+
+// backupFileRegex matches the files githosts writes for a single backup of a
+// repository: <repo>.<timestamp>.bundle, the matching manifest and LFS
+// archive, each optionally age encrypted, and the refs digest kept when
+// encrypting to recipients. Data exported from a provider's API is stored
+// the same way as <repo>.<timestamp>.json.gz.
+var backupFileRegex = regexp.MustCompile(`^(.+)\.(\d{14})\.(bundle|manifest|lfs\.tar\.gz|refs|json\.gz)(\.age)?$`)
+
+// RetentionResult reports backups removed by soba managed retention and
+// those kept because they could not yet be removed.
+type RetentionResult struct {
+	Deleted int      `json:"deleted"`
+	Locked  []string `json:"locked,omitempty"`
+	Held    []string `json:"held,omitempty"`
+	// Assets is the number of release assets removed as no archive
+	// references them any more
+	Assets int      `json:"assets,omitempty"`
+	Error  errors.E `json:"error,omitempty"`
+
+	// dirs are the repository directories files were removed from
+	dirs []string
+}
+
+// changedDirs returns the repository directories files were removed from.
+func (r *RetentionResult) changedDirs() []string {
+	if r == nil {
+		return nil
+	}
+
+	return r.dirs
+}
+
+// removedFrom records that files were removed from dir.
+func (r *RetentionResult) removedFrom(dirs ...string) {
+	for _, dir := range dirs {
+		if !slices.Contains(r.dirs, dir) {
+			r.dirs = append(r.dirs, dir)
+		}
+	}
+}
+
+// backupFile is a single file belonging to a backup of a repository.
+type backupFile struct {
+	key       string
+	repo      string
+	timestamp string
+}
+
+func parseBackupFile(key string) (backupFile, bool) {
+	m := backupFileRegex.FindStringSubmatch(path.Base(key))
+	if m == nil {
+		return backupFile{}, false
+	}
+
+	return backupFile{key: key, repo: m[1], timestamp: m[2]}, true
+}
+
+// sobaManagesRetention reports whether soba, rather than githosts, removes
+// old backups. This is required whenever some backups must outlive the
+// configured count, e.g. while they are locked in immutable mode, on hold or
+// kept by a grandfather-father-son policy, or when githosts only sees part
+// of the backups, as with obfuscated paths.
+func sobaManagesRetention() bool {
+	return immutableDays() > 0 || obfuscatePaths() || gfsConfigured() || holdsInUse()
+}
+
+// providerBackupsToRetain returns the number of backups githosts should keep
+// for a provider.
+func providerBackupsToRetain(envVar string) int {
+	if sobaManagesRetention() {
+		return unlimitedBackupsToRetain
+	}
+
+	return getBackupsToRetain(envVar)
+}
+
+// backupSet is every file written for one backup of a repository.
+type backupSet struct {
+	dir       string
+	repo      string
+	timestamp string
+	keys      []string
+}
+
+// key returns the key of the file in the set with the given suffix, e.g.
+// ".bundle".
+func (s *backupSet) key(suffix string) string {
+	return path.Join(s.dir, s.repo+"."+s.timestamp+suffix)
+}
+
+// groupBackupSets groups backup files by repository directory, returning the
+// sets for each directory ordered newest first.
+func groupBackupSets(objects []ObjectInfo) map[string][]*backupSet {
+	byDir := make(map[string][]*backupSet)
+
+	for _, o := range objects {
+		f, ok := parseBackupFile(o.Key)
+		if !ok {
+			continue
+		}
+
+		dir := path.Dir(o.Key)
+		sets := byDir[dir]
+
+		i := slices.IndexFunc(sets, func(s *backupSet) bool { return s.timestamp == f.timestamp })
+		if i == -1 {
+			sets = append(sets, &backupSet{dir: dir, repo: f.repo, timestamp: f.timestamp})
+			i = len(sets) - 1
+		}
+
+		sets[i].keys = append(sets[i].keys, o.Key)
+		byDir[dir] = sets
+	}
+
+	for _, sets := range byDir {
+		sort.Slice(sets, func(i, j int) bool { return sets[i].timestamp > sets[j].timestamp })
+	}
+
+	return byDir
+}
+
+// applyRetention keeps the backups the policy retains in each repository
+// directory that has been written to since the given time or that owned
+// reports as the provider's, and removes the rest, so backups left locked
+// in a repository that has not changed since are removed once their lock
+// expires. A backup on hold or with any file still locked is kept and
+// reported instead.
+func applyRetention(ctx context.Context, s Storage, policy retentionPolicy, since time.Time, owned func(dir string) bool,
+	now time.Time, result *RetentionResult,
+) {
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		result.Error = errors.Wrap(err, "failed to list backups for retention")
+
+		return
+	}
+
+	updated := make(map[string]bool)
+
+	for _, o := range objects {
+		if !o.ModTime.Before(since) {
+			updated[path.Dir(o.Key)] = true
+		}
+	}
+
+	held := readHolds(ctx, s, objects)
+
+	for dir, sets := range groupBackupSets(objects) {
+		if !updated[dir] && (owned == nil || !owned(dir)) {
+			continue
+		}
+
+		reasons := policy.explain(sets, now)
+
+		for i, set := range sets {
+			if len(reasons[i]) > 0 {
+				continue
+			}
+
+			if _, ok := held.held(set, now); ok {
+				result.Held = append(result.Held, path.Join(dir, set.timestamp))
+
+				continue
+			}
+
+			if locked := lockedKeys(ctx, s, set.keys, now); len(locked) > 0 {
+				logger.Printf("retention: keeping %s/%s as it is locked", dir, set.timestamp)
+
+				result.Locked = append(result.Locked, locked...)
+
+				continue
+			}
+
+			for _, key := range set.keys {
+				if dErr := removeBackupFile(ctx, s, key); dErr != nil {
+					result.Error = errors.WithMessagef(dErr, "failed to remove %s", key)
+
+					return
+				}
+
+				result.Deleted++
+			}
+
+			result.removedFrom(dir)
+
+			if dErr := removeExpiredHold(ctx, s, set); dErr != nil {
+				result.Error = errors.WithStack(dErr)
+
+				return
+			}
+		}
+	}
+}
+
+func dirUpdatedSince(objects []ObjectInfo, dir string, since time.Time) bool {
+	return slices.ContainsFunc(objects, func(o ObjectInfo) bool {
+		return path.Dir(o.Key) == dir && !o.ModTime.Before(since)
+	})
+}
+
+// applyLocalPolicies encrypts, locks and prunes the backups written by a
+// provider, and keeps the backup directory within its quota, before they
+// are copied to mirrors and destinations.
+func applyLocalPolicies(ctx context.Context, local *localStorage, run providerRun, results *BackupResults) {
+	if recipients, err := bundleRecipients(); err != nil || len(recipients) > 0 {
+		if results.Encryption == nil {
+			results.Encryption = &EncryptionResult{}
+		}
+
+		if err != nil {
+			results.Encryption.Error = errors.Wrap(err, "failed to load recipients")
+		} else {
+			encryptBackups(ctx, local, run.started, recipients, results.Encryption)
+		}
+	}
+
+	if days := immutableDays(); days > 0 {
+		if results.Immutable == nil {
+			results.Immutable = &ImmutableResult{}
+		}
+
+		lockNewBackups(ctx, local, run.started, days, results.Immutable)
+	}
+
+	// a provider that failed may have listed only some of its repositories
+	if run.results.Error == nil && len(run.results.BackupResults) > 0 {
+		if results.MissingUpstream == nil {
+			results.MissingUpstream = &MissingUpstreamResult{}
+		}
+
+		policy, err := missingUpstreamPolicyFromEnv()
+		if err == nil {
+			var realDir func(string) string
+
+			if realDir, err = realDirResolver(local.root); err == nil {
+				listed := make([]string, 0, len(run.results.BackupResults))
+				for _, r := range run.results.BackupResults {
+					listed = append(listed, r.Repo)
+				}
+
+				checkMissingUpstream(ctx, local, providerName(run.backupsEnvVar), providerDomain(run.backupsEnvVar), run.started, listed, realDir, policy, time.Now(), results.MissingUpstream)
+			}
+		}
+
+		if err != nil {
+			results.MissingUpstream.Error = errors.WithStack(err)
+		}
+	}
+
+	if sobaManagesRetention() {
+		if results.Retention == nil {
+			results.Retention = &RetentionResult{}
+		}
+
+		owned, err := ownedDirs(local.root, providerName(run.backupsEnvVar))
+		if err != nil {
+			results.Retention.Error = errors.WithStack(err)
+		} else {
+			applyRetention(ctx, local, retentionPolicyFor(run.backupsEnvVar), run.started, owned, time.Now(), results.Retention)
+		}
+	}
+
+	if quota, err := backupQuota(); err != nil || quota > 0 {
+		if results.Quota == nil {
+			results.Quota = &QuotaResult{}
+		}
+
+		if err != nil {
+			results.Quota.Error = errors.WithStack(err)
+		} else {
+			enforceQuota(ctx, local, quota, time.Now(), results.Quota)
+		}
+	}
+
+	// assets of releases archives removed above, or rotated on export, that
+	// no archive references any more
+	dirs, removed, err := pruneReleaseAssets(ctx, local, time.Now())
+	if err != nil || removed > 0 {
+		if results.Retention == nil {
+			results.Retention = &RetentionResult{}
+		}
+
+		results.Retention.Assets += removed
+		results.Retention.removedFrom(dirs...)
+
+		if err != nil {
+			results.Retention.Error = errors.Wrap(err, "failed to prune release assets")
+		}
+	}
+}
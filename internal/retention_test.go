@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBackupFile(t *testing.T) {
+	f, ok := parseBackupFile("github.com/owner/repo/repo.20240101000000.bundle.age")
+	require.True(t, ok)
+	require.Equal(t, "repo", f.repo)
+	require.Equal(t, "20240101000000", f.timestamp)
+
+	_, ok = parseBackupFile("github.com/owner/repo/repo.20240101000000.lfs.tar.gz")
+	require.True(t, ok)
+
+	_, ok = parseBackupFile("github.com/owner/repo/repo.20240101000000.bundle.lock")
+	require.False(t, ok)
+}
+
+func TestApplyRetentionKeepsNewestPerRepo(t *testing.T) {
+	root := t.TempDir()
+	s := newLocalStorage(root)
+
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101000000.bundle", "1")
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240101000000.manifest", "1")
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240102000000.bundle", "2")
+	writeBackupFile(t, root, "github.com/owner/repo/repo.20240103000000.bundle", "3")
+	writeBackupFile(t, root, "github.com/owner/other/other.20240101000000.bundle", "1")
+	writeBackupFile(t, root, "github.com/owner/other/other.20240102000000.bundle", "2")
+	writeBackupFile(t, root, "github.com/owner/other/other.20240103000000.bundle", "3")
+
+	// only the first repository was written to by this run
+	since := time.Now().Add(-time.Minute)
+	old := since.Add(-time.Hour)
+
+	for _, name := range []string{"other.20240101000000.bundle", "other.20240102000000.bundle", "other.20240103000000.bundle"} {
+		require.NoError(t, os.Chtimes(filepath.Join(root, "github.com/owner/other", name), old, old))
+	}
+
+	var result RetentionResult
+
+	applyRetention(t.Context(), s, retentionPolicy{Last: 2}, since, nil, time.Now(), &result)
+	require.Nil(t, result.Error)
+	require.Equal(t, 2, result.Deleted)
+	require.NoFileExists(t, filepath.Join(root, "github.com/owner/repo/repo.20240101000000.bundle"))
+	require.NoFileExists(t, filepath.Join(root, "github.com/owner/repo/repo.20240101000000.manifest"))
+	require.FileExists(t, filepath.Join(root, "github.com/owner/repo/repo.20240102000000.bundle"))
+	require.FileExists(t, filepath.Join(root, "github.com/owner/other/other.20240101000000.bundle"))
+
+	// a repository of the provider's is evaluated even if not written to
+	require.NoError(t, writeStateJSON(root, repoOwnersState, map[string]string{"github.com/owner/other": "github"}))
+
+	t.Setenv(envSobaObfuscatePaths, "")
+
+	owned, err := ownedDirs(root, "github")
+	require.NoError(t, err)
+	require.True(t, owned("github.com/owner/other"))
+	require.False(t, owned("github.com/owner/repo"))
+
+	result = RetentionResult{}
+
+	applyRetention(t.Context(), s, retentionPolicy{Last: 2}, since, owned, time.Now(), &result)
+	require.Nil(t, result.Error)
+	require.Equal(t, 1, result.Deleted)
+	require.NoFileExists(t, filepath.Join(root, "github.com/owner/other/other.20240101000000.bundle"))
+}
+
+func TestProviderBackupsToRetain(t *testing.T) {
+	t.Setenv(envGitHubBackups, "3")
+	t.Setenv(envSobaImmutableDays, "")
+	require.Equal(t, 3, providerBackupsToRetain(envGitHubBackups))
+
+	t.Setenv(envSobaImmutableDays, "30")
+	require.Equal(t, unlimitedBackupsToRetain, providerBackupsToRetain(envGitHubBackups))
+}
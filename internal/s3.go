@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envS3Bucket          = "SOBA_S3_BUCKET"
+	envS3Endpoint        = "SOBA_S3_ENDPOINT"
+	envS3Region          = "SOBA_S3_REGION"
+	envS3Prefix          = "SOBA_S3_PREFIX"
+	envS3AccessKeyID     = "SOBA_S3_ACCESS_KEY_ID"
+	envS3SecretAccessKey = "SOBA_S3_SECRET_ACCESS_KEY" // nolint:gosec
+	envS3Insecure        = "SOBA_S3_INSECURE"
+	envS3PathStyle       = "SOBA_S3_PATH_STYLE"
+	envS3SSE             = "SOBA_S3_SSE"
+	envS3SSEKMSKeyID     = "SOBA_S3_SSE_KMS_KEY_ID"
+	envS3PartSize        = "SOBA_S3_PART_SIZE"
+
+	defaultS3Endpoint = "s3.amazonaws.com"
+	s3SSEAES256       = "AES256"
+	s3SSEKMS          = "aws:kms"
+	bytesPerMiB       = 1 << 20
+
+	// S3 parts must be between 5 MiB and 5 GiB
+	s3MinPartSizeMiB = 5
+	s3MaxPartSizeMiB = 5 << 10
+)
+
+// s3Storage keeps the backup tree in an S3 compatible bucket. Any service
+// speaking the S3 API (MinIO, Backblaze B2, Wasabi, ...) can be used by
+// overriding the endpoint.
+type s3Storage struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	sse      encrypt.ServerSide
+	partSize uint64
+}
+
+func newS3Storage(bucket, prefix string) (*s3Storage, error) {
+	endpoint := os.Getenv(envS3Endpoint)
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+
+	opts := &minio.Options{
+		Creds:  s3Credentials(),
+		Secure: !envTrue(envS3Insecure),
+		Region: os.Getenv(envS3Region),
+	}
+
+	if envTrue(envS3PathStyle) {
+		opts.BucketLookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(endpoint, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create S3 client")
+	}
+
+	sse, err := s3ServerSideEncryption()
+	if err != nil {
+		return nil, err
+	}
+
+	partSize, err := s3PartSize()
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Storage{
+		client:   client,
+		bucket:   bucket,
+		prefix:   strings.Trim(prefix, "/"),
+		sse:      sse,
+		partSize: partSize,
+	}, nil
+}
+
+// s3Credentials prefers explicit soba credentials and otherwise falls back
+// to the standard AWS environment, shared credentials file and instance role.
+func s3Credentials() *credentials.Credentials {
+	accessKeyID, _ := GetEnvOrFile(envS3AccessKeyID)
+	secretAccessKey, _ := GetEnvOrFile(envS3SecretAccessKey)
+
+	if accessKeyID != "" && secretAccessKey != "" {
+		return credentials.NewStaticV4(accessKeyID, secretAccessKey, "")
+	}
+
+	return credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{},
+	})
+}
+
+// s3PartSize returns the multipart upload part size set in
+// SOBA_S3_PART_SIZE, in bytes, or zero to let minio choose.
+func s3PartSize() (uint64, error) {
+	value := os.Getenv(envS3PartSize)
+	if value == "" {
+		return 0, nil
+	}
+
+	mib, ok := isInt(value)
+	if !ok || mib < s3MinPartSizeMiB || mib > s3MaxPartSizeMiB {
+		return 0, errors.Errorf("%s must be a number of MiB between %d and %d", envS3PartSize, s3MinPartSizeMiB, s3MaxPartSizeMiB)
+	}
+
+	return uint64(mib) * bytesPerMiB, nil
+}
+
+func s3ServerSideEncryption() (encrypt.ServerSide, error) {
+	switch sse := os.Getenv(envS3SSE); {
+	case sse == "":
+		return nil, nil
+	case strings.EqualFold(sse, s3SSEAES256):
+		return encrypt.NewSSE(), nil
+	case strings.EqualFold(sse, s3SSEKMS):
+		kms, err := encrypt.NewSSEKMS(os.Getenv(envS3SSEKMSKeyID), nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to configure SSE-KMS")
+		}
+
+		return kms, nil
+	default:
+		return nil, errors.Errorf("%s value \"%s\" should be %s or %s", envS3SSE, sse, s3SSEAES256, s3SSEKMS)
+	}
+}
+
+func (d *s3Storage) Name() string {
+	if d.prefix == "" {
+		return "s3://" + d.bucket
+	}
+
+	return "s3://" + d.bucket + "/" + d.prefix
+}
+
+func (d *s3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	root := ""
+	if d.prefix != "" {
+		root = d.prefix + "/"
+	}
+
+	// keys are returned in lexical order so no further sorting is required
+	for obj := range d.client.ListObjects(ctx, d.bucket, minio.ListObjectsOptions{
+		Prefix:    root + prefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, errors.Wrap(obj.Err, "failed to list objects")
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:     strings.TrimPrefix(obj.Key, root),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+	}
+
+	return objects, nil
+}
+
+// Put uploads a single object. minio switches to a multipart upload for
+// anything larger than the part size, so large bundles and LFS archives are
+// streamed rather than buffered.
+func (d *s3Storage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := d.client.PutObject(ctx, d.bucket, storageKey(d.prefix, key), r, size, minio.PutObjectOptions{
+		ContentType:          "application/octet-stream",
+		ServerSideEncryption: d.sse,
+		PartSize:             d.partSize,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (d *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := d.client.GetObject(ctx, d.bucket, storageKey(d.prefix, key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return obj, nil
+}
+
+func (d *s3Storage) Delete(ctx context.Context, key string) error {
+	if err := d.client.RemoveObject(ctx, d.bucket, storageKey(d.prefix, key), minio.RemoveObjectOptions{}); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (d *s3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := d.client.StatObject(ctx, d.bucket, storageKey(d.prefix, key), minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return ObjectInfo{}, errors.WithMessage(fs.ErrNotExist, key)
+		}
+
+		return ObjectInfo{}, errors.WithStack(err)
+	}
+
+	return ObjectInfo{Key: key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (d *s3Storage) Close() error {
+	return nil
+}
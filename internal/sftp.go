@@ -0,0 +1,276 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"gitlab.com/tozd/go/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	envSFTPURL                  = "SOBA_SFTP_URL"
+	envSFTPPassword             = "SOBA_SFTP_PASSWORD" // nolint:gosec
+	envSFTPPrivateKey           = "SOBA_SFTP_PRIVATE_KEY"
+	envSFTPPrivateKeyPassphrase = "SOBA_SFTP_PRIVATE_KEY_PASSPHRASE" // nolint:gosec
+	envSFTPKnownHosts           = "SOBA_SFTP_KNOWN_HOSTS"
+
+	defaultSFTPPort = "22"
+)
+
+// sftpStorage keeps the backup tree in a directory on an SFTP server.
+// The connection is opened on first use and held until Close so a run only
+// authenticates once.
+type sftpStorage struct {
+	url    *url.URL
+	root   string
+	config *ssh.ClientConfig
+
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func newSFTPStorage(rawURL string) (*sftpStorage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse SFTP URL")
+	}
+
+	if u.Scheme != "sftp" || u.Host == "" || u.User == nil {
+		return nil, errors.Errorf("%s must be of the form sftp://user@host[:port]/path", envSFTPURL)
+	}
+
+	hostKeyCallback, err := sftpHostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := sftpAuthMethods()
+	if err != nil {
+		return nil, err
+	}
+
+	root := u.Path
+	if root == "" {
+		root = "."
+	}
+
+	return &sftpStorage{
+		url:  u,
+		root: root,
+		config: &ssh.ClientConfig{
+			User:            u.User.Username(),
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         defaultHTTPClientRequestTimeout,
+		},
+	}, nil
+}
+
+// sftpHostKeyCallback verifies the server against a known_hosts file; there
+// is deliberately no option to skip host key verification.
+func sftpHostKeyCallback() (ssh.HostKeyCallback, error) {
+	knownHostsPath := os.Getenv(envSFTPKnownHosts)
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to locate known_hosts; set %s", envSFTPKnownHosts)
+		}
+
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load known_hosts file %q", knownHostsPath)
+	}
+
+	return callback, nil
+}
+
+func sftpAuthMethods() ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if key, _ := GetEnvOrFile(envSFTPPrivateKey); key != "" {
+		var (
+			signer ssh.Signer
+			err    error
+		)
+
+		if passphrase, _ := GetEnvOrFile(envSFTPPrivateKeyPassphrase); passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(key), []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(key))
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse SFTP private key")
+		}
+
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if password, _ := GetEnvOrFile(envSFTPPassword); password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.Errorf("either %s or %s must be set", envSFTPPrivateKey, envSFTPPassword)
+	}
+
+	return methods, nil
+}
+
+func (d *sftpStorage) Name() string {
+	return "sftp://" + d.url.User.Username() + "@" + d.url.Host + d.url.Path
+}
+
+func (d *sftpStorage) connect() (*sftp.Client, error) {
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	addr := d.url.Host
+	if d.url.Port() == "" {
+		addr = net.JoinHostPort(d.url.Hostname(), defaultSFTPPort)
+	}
+
+	conn, err := ssh.Dial("tcp", addr, d.config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", addr)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, errors.Wrap(err, "failed to start SFTP session")
+	}
+
+	d.conn = conn
+	d.client = client
+
+	return client, nil
+}
+
+func (d *sftpStorage) List(_ context.Context, prefix string) ([]ObjectInfo, error) {
+	client, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = client.Stat(d.root); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, errors.WithStack(err)
+	}
+
+	return listRemoteTree(d.root, prefix, client.ReadDir)
+}
+
+// Put writes to a temporary name and renames it into place so an
+// interrupted upload never leaves a truncated bundle under its final name.
+func (d *sftpStorage) Put(_ context.Context, key string, r io.Reader, _ int64) error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+
+	target := path.Join(d.root, key)
+	partial := target + partialUploadSuffix
+
+	if err = client.MkdirAll(path.Dir(target)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	dst, err := client.Create(partial)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err = io.Copy(dst, r); err != nil {
+		_ = dst.Close()
+		_ = client.Remove(partial)
+
+		return errors.WithStack(err)
+	}
+
+	if err = dst.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = client.PosixRename(partial, target); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (d *sftpStorage) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	client, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := client.Open(path.Join(d.root, key))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return f, nil
+}
+
+func (d *sftpStorage) Delete(_ context.Context, key string) error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+
+	if err = client.Remove(path.Join(d.root, key)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (d *sftpStorage) Stat(_ context.Context, key string) (ObjectInfo, error) {
+	client, err := d.connect()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := client.Stat(path.Join(d.root, key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ObjectInfo{}, errors.WithMessage(fs.ErrNotExist, key)
+		}
+
+		return ObjectInfo{}, errors.WithStack(err)
+	}
+
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (d *sftpStorage) Close() error {
+	if d.client == nil {
+		return nil
+	}
+
+	_ = d.client.Close()
+	err := d.conn.Close()
+
+	d.client = nil
+	d.conn = nil
+
+	return errors.WithStack(err)
+}
@@ -33,7 +33,7 @@ func Sourcehut(backupDir string) *ProviderBackupResults {
 		APIURL:               os.Getenv(envSourcehutAPIURL),
 		DiffRemoteMethod:     os.Getenv(envSourcehutCompare),
 		PersonalAccessToken:  ghToken,
-		BackupsToRetain:      getBackupsToRetain(envSourcehutBackups),
+		BackupsToRetain:      providerBackupsToRetain(envSourcehutBackups),
 		LogLevel:             getLogLevel(),
 		BackupLFS:            envTrue(envSourcehutBackupLFS),
 		EncryptionPassphrase: bundlePassphrase,
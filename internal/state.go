@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const stateFileMode = 0o600
+
+// statePath returns the path of a file in soba's state directory within the
+// backup directory.
+func statePath(backupDir string, name ...string) string {
+	return filepath.Join(append([]string{backupDir, stateDIRName}, name...)...)
+}
+
+// writeStateJSON atomically writes v as indented JSON to a file in the state
+// directory.
+func writeStateJSON(backupDir, name string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	p := statePath(backupDir, name)
+
+	if err = os.MkdirAll(filepath.Dir(p), storageDirMode); err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp := p + partialUploadSuffix
+
+	if err = os.WriteFile(tmp, b, stateFileMode); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = os.Rename(tmp, p); err != nil {
+		_ = os.Remove(tmp)
+
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// readStateJSON reads a file written by writeStateJSON into v, returning
+// false if it does not exist.
+func readStateJSON(backupDir, name string, v any) (bool, error) {
+	b, err := os.ReadFile(statePath(backupDir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, errors.WithStack(err)
+	}
+
+	if err = json.Unmarshal(b, v); err != nil {
+		return false, errors.Wrapf(err, "failed to parse %s", name)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const storageDirMode = 0o700
+
+// Storage is a tree of backup files addressed by slash separated keys
+// relative to its root, e.g. github.com/owner/repo/repo.20240101000000.bundle.
+// The local backup directory and every offsite destination implement it so
+// listing, retention and verification behave the same wherever backups live.
+type Storage interface {
+	Name() string
+	// List returns every file whose key starts with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// Stat returns an error wrapping fs.ErrNotExist if key does not exist.
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	Close() error
+}
+
+// ObjectInfo describes a single file in a Storage.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// openStorage returns the Storage for a location given as a local path or a
+// URI: s3://bucket/prefix, sftp://user@host/path or an http(s) WebDAV URL.
+// Remote storages take their credentials from the same environment variables
+// used for destinations.
+func openStorage(location string) (Storage, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" || filepath.VolumeName(location) != "" {
+		return newLocalStorage(location), nil
+	}
+
+	switch u.Scheme {
+	case destinationS3:
+		return newS3Storage(u.Host, strings.Trim(u.Path, "/"))
+	case destinationSFTP:
+		return newSFTPStorage(location)
+	case "http", "https":
+		return newWebDAVStorage(location)
+	default:
+		return nil, errors.Errorf("unsupported storage location %q", location)
+	}
+}
+
+// localStorage is a Storage backed by a directory on the local filesystem.
+// Directories listed in exclude (such as the working directory) are never
+// listed.
+type localStorage struct {
+	root    string
+	exclude []string
+}
+
+func newLocalStorage(root string, exclude ...string) *localStorage {
+	s := &localStorage{root: root}
+
+	for _, e := range exclude {
+		if abs, err := filepath.Abs(e); err == nil {
+			s.exclude = append(s.exclude, abs)
+		}
+	}
+
+	return s
+}
+
+func (s *localStorage) Name() string {
+	return s.root
+}
+
+func (s *localStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *localStorage) List(_ context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+
+		if d.IsDir() {
+			if abs, aErr := filepath.Abs(p); aErr == nil && slices.Contains(s.exclude, abs) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, rErr := filepath.Rel(s.root, p)
+		if rErr != nil {
+			return rErr
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, iErr := d.Info()
+		if iErr != nil {
+			return iErr
+		}
+
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return objects, nil
+}
+
+// Put writes to a temporary file in the target directory and renames it into
+// place, so readers never observe a partially written file.
+func (s *localStorage) Put(_ context.Context, key string, r io.Reader, _ int64) error {
+	target := s.path(key)
+
+	if err := os.MkdirAll(filepath.Dir(target), storageDirMode); err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*"+partialUploadSuffix)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+
+		return errors.WithStack(err)
+	}
+
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+
+		return errors.WithStack(err)
+	}
+
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+
+		return errors.WithStack(err)
+	}
+
+	if err = os.Rename(tmp.Name(), target); err != nil {
+		_ = os.Remove(tmp.Name())
+
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (s *localStorage) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return f, nil
+}
+
+func (s *localStorage) Delete(_ context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (s *localStorage) Stat(_ context.Context, key string) (ObjectInfo, error) {
+	info, err := os.Stat(s.path(key))
+	if err != nil {
+		return ObjectInfo{}, errors.WithStack(err)
+	}
+
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *localStorage) Close() error {
+	return nil
+}
+
+// listRemoteTree recursively lists a slash separated directory tree using
+// readDir, returning the files whose key relative to root starts with
+// prefix.
+func listRemoteTree(root, prefix string, readDir func(string) ([]os.FileInfo, error)) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	var walk func(dir, rel string) error
+
+	walk = func(dir, rel string) error {
+		entries, err := readDir(dir)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", dir)
+		}
+
+		for _, e := range entries {
+			key := path.Join(rel, e.Name())
+
+			if e.IsDir() {
+				// only descend into directories that can hold matching keys
+				if strings.HasPrefix(key+"/", prefix) || strings.HasPrefix(prefix, key+"/") {
+					if err = walk(path.Join(dir, e.Name()), key); err != nil {
+						return err
+					}
+				}
+
+				continue
+			}
+
+			if strings.HasPrefix(key, prefix) {
+				objects = append(objects, ObjectInfo{Key: key, Size: e.Size(), ModTime: e.ModTime()})
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(root, ""); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	return objects, nil
+}
+
+// storageKey joins an optional prefix to a backup-relative key.
+func storageKey(prefix, key string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return key
+	}
+
+	return prefix + "/" + key
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalStorage(t *testing.T) {
+	root := t.TempDir()
+	s := newLocalStorage(root, filepath.Join(root, workingDIRName))
+
+	key := "github.com/owner/repo/repo.20240101000000.bundle"
+	require.NoError(t, s.Put(t.Context(), key, strings.NewReader("bundle"), 6))
+	writeBackupFile(t, root, "gitlab.com/group/project/project.20240101000000.bundle", "project")
+	writeBackupFile(t, root, workingDIRName+"/clone/HEAD", "transient")
+
+	objects, err := s.List(t.Context(), "")
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	require.Equal(t, key, objects[0].Key)
+	require.EqualValues(t, 6, objects[0].Size)
+
+	objects, err = s.List(t.Context(), "gitlab.com/")
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+
+	// no temporary files are left behind by Put
+	entries, err := os.ReadDir(filepath.Join(root, "github.com/owner/repo"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	r, err := s.Get(t.Context(), key)
+	require.NoError(t, err)
+
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, "bundle", string(b))
+
+	info, err := s.Stat(t.Context(), key)
+	require.NoError(t, err)
+	require.EqualValues(t, 6, info.Size)
+
+	require.NoError(t, s.Delete(t.Context(), key))
+
+	_, err = s.Stat(t.Context(), key)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestOpenStorage(t *testing.T) {
+	s, err := openStorage(t.TempDir())
+	require.NoError(t, err)
+	require.IsType(t, &localStorage{}, s)
+
+	t.Setenv(envS3Endpoint, "localhost:9000")
+	t.Setenv(envS3AccessKeyID, "key")
+	t.Setenv(envS3SecretAccessKey, "secret")
+
+	s, err = openStorage("s3://backups/soba/")
+	require.NoError(t, err)
+	require.Equal(t, "s3://backups/soba", s.Name())
+
+	s, err = openStorage("https://dav.example.com/remote.php/dav/files/soba/")
+	require.NoError(t, err)
+	require.Equal(t, "webdav://dav.example.com/remote.php/dav/files/soba/", s.Name())
+
+	_, err = openStorage("ftp://backup.example.com/soba")
+	require.Error(t, err)
+}
+
+func TestCommandStorage(t *testing.T) {
+	backupDir := t.TempDir()
+	t.Setenv(envGitBackupDir, backupDir)
+
+	s, err := commandStorage("")
+	require.NoError(t, err)
+	require.Equal(t, backupDir, s.Name())
+
+	mirror := t.TempDir()
+
+	s, err = commandStorage(mirror)
+	require.NoError(t, err)
+	require.Equal(t, mirror, s.Name())
+
+	t.Setenv(envGitBackupDir, "")
+
+	_, err = commandStorage("")
+	require.Error(t, err)
+}
+
+func TestStorageKey(t *testing.T) {
+	require.Equal(t, "a/b.bundle", storageKey("", "a/b.bundle"))
+	require.Equal(t, "soba/a/b.bundle", storageKey("/soba/", "a/b.bundle"))
+}
@@ -0,0 +1,348 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envSobaBackupSubmodules = "SOBA_BACKUP_SUBMODULES"
+
+	// submodulesDIRName holds the backups of submodule remotes, by their
+	// <host>/<path>, in the backup directory.
+	submodulesDIRName = "submodules"
+
+	// submodulesState maps each repository directory to the submodule URLs
+	// in its latest backup, so unchanged repositories need not be read.
+	submodulesState = "submodules.json"
+)
+
+// submoduleSchemes are the URL schemes submodule remotes are cloned over,
+// besides scp-like SSH URLs such as git@host:path.
+var submoduleSchemes = []string{"https", "http", "ssh", "git"}
+
+// SubmoduleResult reports the submodule remotes backed up during a run, and
+// those that could not be as warnings, since the repositories referring to
+// them were backed up.
+type SubmoduleResult struct {
+	BackedUp int      `json:"backed_up"`
+	Warnings []string `json:"warnings,omitempty"`
+	Error    errors.E `json:"error,omitempty"`
+}
+
+// warned reports whether any submodule could not be backed up.
+func (r *SubmoduleResult) warned() bool {
+	return r != nil && len(r.Warnings) > 0
+}
+
+// submoduleBackup backs up the remotes of the submodules referred to by the
+// latest backup of each repository, once per run however many repositories
+// refer to them.
+type submoduleBackup struct {
+	stateDir string
+	storage  *localStorage
+	// urls are the submodule URLs of each repository directory
+	urls map[string][]string
+	// done are the submodule backup directories handled during the run
+	done   map[string]bool
+	result *SubmoduleResult
+}
+
+// newSubmoduleBackup returns a submoduleBackup writing to backupDir, the
+// directory providers write to, and keeping its state in stateDir. Nothing
+// is backed up unless SOBA_BACKUP_SUBMODULES is set.
+func newSubmoduleBackup(stateDir, backupDir string) *submoduleBackup {
+	b := &submoduleBackup{
+		stateDir: stateDir,
+		storage:  newLocalStorage(backupDir, resolveWorkingDir(backupDir)),
+		urls:     make(map[string][]string),
+		done:     make(map[string]bool),
+	}
+
+	if !envTrue(envSobaBackupSubmodules) {
+		return b
+	}
+
+	b.result = &SubmoduleResult{}
+
+	if _, err := readStateJSON(stateDir, submodulesState, &b.urls); err != nil {
+		b.result.Error = errors.WithStack(err)
+	}
+
+	return b
+}
+
+// backup reads the submodules of each repository backed up since the
+// provider run started, then backs up the remote of every submodule known,
+// rotating its backups by the provider's retention.
+func (b *submoduleBackup) backup(ctx context.Context, run providerRun) {
+	if b.result == nil {
+		return
+	}
+
+	objects, err := b.storage.List(ctx, "")
+	if err != nil {
+		b.result.Error = errors.Wrap(err, "failed to list backups")
+
+		return
+	}
+
+	modified := make(map[string]time.Time, len(objects))
+	for _, o := range objects {
+		modified[o.Key] = o.ModTime
+	}
+
+	sets := groupBackupSets(objects)
+
+	for dir, dirSets := range sets {
+		if !isSuperprojectDir(dir) {
+			continue
+		}
+
+		key := latestBundleKey(dirSets[0])
+		if key == "" || modified[key].Before(run.started) {
+			continue
+		}
+
+		urls, rErr := readSubmoduleURLs(ctx, b.storage, key)
+		if rErr != nil {
+			b.warn(dir, "", rErr)
+
+			continue
+		}
+
+		b.urls[dir] = urls
+	}
+
+	// forget repositories no longer backed up
+	for dir := range b.urls {
+		if _, ok := sets[dir]; !ok {
+			delete(b.urls, dir)
+		}
+	}
+
+	dirs := make([]string, 0, len(b.urls))
+	for dir := range b.urls {
+		dirs = append(dirs, dir)
+	}
+
+	slices.Sort(dirs)
+
+	for _, dir := range dirs {
+		for _, rawURL := range b.urls[dir] {
+			b.backupRemote(ctx, sets, dir, rawURL, run.backupsEnvVar)
+		}
+	}
+
+	if err = writeStateJSON(b.stateDir, submodulesState, b.urls); err != nil {
+		b.result.Error = errors.WithStack(err)
+	}
+}
+
+// backupRemote backs up a submodule's remote unless it was already handled
+// during the run or is backed up by a provider.
+func (b *submoduleBackup) backupRemote(ctx context.Context, sets map[string][]*backupSet, dir, rawURL, backupsEnvVar string) {
+	cloneURL, repo, err := submoduleRemote(dir, rawURL)
+	if err != nil {
+		b.warn(dir, rawURL, err)
+
+		return
+	}
+
+	target := path.Join(submodulesDIRName, repo)
+	if b.done[target] {
+		return
+	}
+
+	b.done[target] = true
+
+	if _, ok := sets[repo]; ok {
+		return
+	}
+
+	found, err := backupGitRepo(ctx, b.storage, gitRemote{}, cloneURL, target, backupsEnvVar)
+
+	switch {
+	case err != nil:
+		b.warn(dir, rawURL, err)
+	case found:
+		b.result.BackedUp++
+	}
+}
+
+// warn records a submodule that could not be backed up.
+func (b *submoduleBackup) warn(dir, rawURL string, err error) {
+	warning := dir
+	if rawURL != "" {
+		warning += ": submodule " + redactURL(rawURL)
+	}
+
+	warning += ": " + err.Error()
+
+	logger.Printf("warning: %s", warning)
+
+	b.result.Warnings = append(b.result.Warnings, warning)
+}
+
+// isSuperprojectDir reports whether the submodules of the repository backed
+// up in dir are to be read. Submodule remotes' own submodules are not.
+func isSuperprojectDir(dir string) bool {
+	for _, name := range []string{submodulesDIRName, archiveDIRName, stateDIRName} {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// latestBundleKey returns the key of the bundle in a backup set, if any.
+func latestBundleKey(set *backupSet) string {
+	for _, suffix := range []string{bundleExtension, bundleExtension + ageSuffix} {
+		if key := set.key(suffix); slices.Contains(set.keys, key) {
+			return key
+		}
+	}
+
+	return ""
+}
+
+// readSubmoduleURLs returns the URLs of the submodules in .gitmodules at
+// the head of a bundle, decrypting it first if needed.
+func readSubmoduleURLs(ctx context.Context, s *localStorage, key string) ([]string, error) {
+	workingDir := resolveWorkingDir(s.root)
+
+	if err := os.MkdirAll(workingDir, workingDIRMode); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	tmp, err := os.MkdirTemp(workingDir, "submodules-")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() { _ = os.RemoveAll(tmp) }()
+
+	bundle := filepath.Join(s.root, filepath.FromSlash(key))
+
+	if strings.HasSuffix(key, ageSuffix) {
+		bundle = filepath.Join(tmp, path.Base(strings.TrimSuffix(key, ageSuffix)))
+
+		if err = decryptBundle(ctx, s, key, bundle); err != nil {
+			return nil, err
+		}
+	}
+
+	clone := filepath.Join(tmp, "clone")
+
+	if out, cErr := runRemoteGit(ctx, gitRemote{}, "clone", "--bare", "--quiet", bundle, clone); cErr != nil {
+		return nil, errors.Errorf("failed to read bundle: %s", strings.TrimSpace(out))
+	}
+
+	// a repository without submodules has no .gitmodules
+	if _, cErr := runRemoteGit(ctx, gitRemote{}, "-C", clone, "cat-file", "-e", "HEAD:.gitmodules"); cErr != nil {
+		return nil, nil
+	}
+
+	out, err := runRemoteGit(ctx, gitRemote{}, "-C", clone, "config", "--blob", "HEAD:.gitmodules",
+		"--get-regexp", `^submodule\..*\.url$`)
+	if err != nil {
+		return nil, nil
+	}
+
+	var urls []string
+
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if _, u, ok := strings.Cut(line, " "); ok && !slices.Contains(urls, u) {
+			urls = append(urls, u)
+		}
+	}
+
+	return urls, nil
+}
+
+// decryptBundle writes the plaintext of an encrypted bundle to dst.
+func decryptBundle(ctx context.Context, s *localStorage, key, dst string) error {
+	ring, err := loadKeyring(envVarBundlePassphrase)
+	if err != nil {
+		return errors.WithMessage(err, "can not read encrypted bundle")
+	}
+
+	f, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	r, _, err := ring.decrypt(f)
+	if err != nil {
+		return errors.WithMessage(err, "can not read encrypted bundle")
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err = io.Copy(out, r); err != nil {
+		_ = out.Close()
+
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(out.Close())
+}
+
+// submoduleRemote returns the URL to clone a submodule from and the
+// <host>/<path> its remote is backed up to. A relative URL is resolved
+// against the repository's own backup path, e.g. ../lib.git of
+// github.com/owner/app is github.com/owner/lib. Only network remotes are
+// followed, other than for local repositories, so a repository can not have
+// files from the backup host stored with its backups.
+func submoduleRemote(dir, rawURL string) (string, string, error) {
+	localDir, isLocal := strings.CutPrefix(dir, localDomain+"/")
+
+	if strings.HasPrefix(rawURL, "./") || strings.HasPrefix(rawURL, "../") {
+		if isLocal {
+			p := path.Join("/"+localDir, rawURL)
+
+			return filepath.FromSlash(p), localRepoPath(p), nil
+		}
+
+		host, p, _ := strings.Cut(dir, "/")
+		rawURL = "https://" + host + path.Join("/"+p, rawURL)
+	}
+
+	if u, err := url.Parse(rawURL); err == nil && u.Scheme == "file" {
+		rawURL = u.Path
+	}
+
+	if filepath.IsAbs(rawURL) {
+		if !isLocal {
+			return "", "", errors.New("local paths are only followed for local repositories")
+		}
+
+		return rawURL, localRepoPath(rawURL), nil
+	}
+
+	// transport helpers, e.g. ext::command, are never followed
+	if strings.Contains(rawURL, "::") {
+		return "", "", errors.New("unsupported submodule URL")
+	}
+
+	if scheme, _, ok := strings.Cut(rawURL, "://"); ok && !slices.Contains(submoduleSchemes, strings.ToLower(scheme)) {
+		return "", "", errors.Errorf("unsupported submodule URL scheme %q", scheme)
+	}
+
+	repo, err := genericRepoPath(rawURL)
+
+	return rawURL, repo, err
+}
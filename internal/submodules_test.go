@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubmoduleRemote(t *testing.T) {
+	for _, tc := range []struct {
+		dir, rawURL, cloneURL, repo string
+	}{
+		{"github.com/owner/app", "https://github.com/other/lib.git", "https://github.com/other/lib.git", "github.com/other/lib"},
+		{"github.com/owner/app", "git@github.com:other/lib.git", "git@github.com:other/lib.git", "github.com/other/lib"},
+		{"github.com/owner/app", "../lib.git", "https://github.com/owner/lib.git", "github.com/owner/lib"},
+		{"github.com/owner/app", "./nested/lib", "https://github.com/owner/app/nested/lib", "github.com/owner/app/nested/lib"},
+		{"local/srv/git/app", "../lib.git", "/srv/git/lib.git", "local/srv/git/lib"},
+		{"local/srv/git/app", "file:///srv/git/lib.git", "/srv/git/lib.git", "local/srv/git/lib"},
+		{"local/srv/git/app", "/srv/git/lib.git", "/srv/git/lib.git", "local/srv/git/lib"},
+		{"github.com/owner/app", "ssh://git@github.com/other/lib.git", "ssh://git@github.com/other/lib.git", "github.com/other/lib"},
+	} {
+		cloneURL, repo, err := submoduleRemote(tc.dir, tc.rawURL)
+		require.NoError(t, err, tc.rawURL)
+		require.Equal(t, tc.cloneURL, cloneURL, tc.rawURL)
+		require.Equal(t, tc.repo, repo, tc.rawURL)
+	}
+
+	// only network remotes are followed for repositories that are not local
+	for _, rawURL := range []string{
+		"lib", "/srv/git/lib.git", "file:///srv/git/lib.git", "ext::sh -c touch% /tmp/pwned", "ftp://example.com/lib.git",
+	} {
+		_, _, err := submoduleRemote("github.com/owner/app", rawURL)
+		require.Error(t, err, rawURL)
+	}
+}
+
+func TestIsSuperprojectDir(t *testing.T) {
+	require.True(t, isSuperprojectDir("github.com/owner/app"))
+	require.True(t, isSuperprojectDir("github.com/owner/app.wiki"))
+	require.False(t, isSuperprojectDir("submodules/github.com/owner/lib"))
+	require.False(t, isSuperprojectDir("archive/github.com/owner/old"))
+	require.False(t, isSuperprojectDir(".soba"))
+}
+
+func TestSubmoduleBackup(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	repos := t.TempDir()
+	lib := filepath.Join(repos, "lib")
+	app := filepath.Join(repos, "app")
+
+	runGit(t, "", "init", "-q", lib)
+	gitCommit(t, lib, "lib")
+
+	runGit(t, "", "init", "-q", app)
+	writeFixtureFile(t, filepath.Join(app, ".gitmodules"), "[submodule \"lib\"]\n\tpath = lib\n\turl = "+lib+
+		"\n[submodule \"gone\"]\n\tpath = gone\n\turl = https://127.0.0.1:1/gone.git\n")
+	runGit(t, app, "add", ".gitmodules")
+	gitCommit(t, app, "app")
+
+	t.Setenv(envSobaBackupSubmodules, "true")
+	t.Setenv(envGenericBackups, "2")
+
+	backupDir := t.TempDir()
+	started := time.Now().Add(-time.Second)
+
+	found, err := backupGitRepo(t.Context(), newLocalStorage(backupDir, resolveWorkingDir(backupDir)), gitRemote{},
+		app, localRepoPath(app), envGenericBackups)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	submodules := newSubmoduleBackup(backupDir, backupDir)
+	submodules.backup(t.Context(), providerRun{backupsEnvVar: envGenericBackups, started: started})
+
+	require.NoError(t, submodules.result.Error)
+	require.Equal(t, 1, submodules.result.BackedUp)
+	require.Len(t, submodules.result.Warnings, 1)
+	require.Contains(t, submodules.result.Warnings[0], localRepoPath(app)+": submodule https://127.0.0.1:1/gone.git")
+
+	objects, err := newLocalStorage(backupDir, resolveWorkingDir(backupDir)).List(t.Context(), "")
+	require.NoError(t, err)
+	require.Len(t, groupBackupSets(objects)["submodules/"+localRepoPath(lib)], 1)
+
+	// the next run backs up the remotes of unchanged repositories from state
+	submodules = newSubmoduleBackup(backupDir, backupDir)
+	submodules.backup(t.Context(), providerRun{backupsEnvVar: envGenericBackups, started: time.Now()})
+
+	require.Equal(t, 1, submodules.result.BackedUp)
+	require.Len(t, submodules.result.Warnings, 1)
+
+	// nothing is done unless enabled
+	t.Setenv(envSobaBackupSubmodules, "")
+
+	submodules = newSubmoduleBackup(backupDir, backupDir)
+	submodules.backup(t.Context(), providerRun{started: started})
+	require.Nil(t, submodules.result)
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"aead.dev/minisign"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	problemMissing      = "missing"
+	problemModified     = "modified"
+	problemUnexpected   = "unexpected"
+	problemUnsigned     = "unsigned"
+	problemBadSignature = "bad signature"
+)
+
+// VerifyReport lists every problem found checking backups against their
+// signed checksums.
+type VerifyReport struct {
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Verified   int               `json:"verified"`
+	Problems   []ChecksumProblem `json:"problems,omitempty"`
+}
+
+// ChecksumProblem is a file, or directory, that does not match its signed
+// checksums.
+type ChecksumProblem struct {
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	location := flags.String("storage", "", "verify a copy elsewhere, e.g. s3://bucket/prefix, instead of "+envGitBackupDir)
+
+	flags.Usage = func() {
+		_, _ = io.WriteString(flags.Output(), "usage: soba verify [-storage LOCATION]\n\n"+
+			"Checks every backup under "+envGitBackupDir+" against the "+checksumsName+" file in its directory,\n"+
+			"after verifying its signature with "+envSobaSigningPublicKey+".\n\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+
+		return errors.WithStack(err)
+	}
+
+	if value, _ := GetEnvOrFile(envSobaSigningPublicKey); value == "" {
+		return errors.Errorf("environment variable %s must be set", envSobaSigningPublicKey)
+	}
+
+	key, err := signingPublicKey()
+	if err != nil {
+		return err
+	}
+
+	s, err := commandStorage(*location)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = s.Close() }()
+
+	report, err := verifyChecksums(context.Background(), s, key)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range report.Problems {
+		fmt.Printf("%s\t%s\t%s\n", p.Problem, p.Key, p.Detail)
+	}
+
+	// the report is kept with the backup directory, when there is one
+	if backupDir, bErr := commandBackupDir(); bErr == nil {
+		name := "verify-report-" + report.StartedAt.Format(timeStampFormat) + ".json"
+		if err = writeStateJSON(backupDir, name, report); err != nil {
+			return err
+		}
+
+		logger.Printf("verify: %d files verified in %s, %d problems; report written to %s",
+			report.Verified, s.Name(), len(report.Problems), statePath(backupDir, name))
+	} else {
+		logger.Printf("verify: %d files verified in %s, %d problems", report.Verified, s.Name(), len(report.Problems))
+	}
+
+	if len(report.Problems) > 0 {
+		return errors.Errorf("found %d problems verifying backups", len(report.Problems))
+	}
+
+	return nil
+}
+
+// verifyChecksums checks each repository directory against its signed
+// checksums, reporting files that are missing, modified or not listed.
+func verifyChecksums(ctx context.Context, s Storage, key minisign.PublicKey) (*VerifyReport, error) {
+	report := &VerifyReport{StartedAt: time.Now().UTC()}
+
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list backups")
+	}
+
+	dirs := groupRepoFiles(objects)
+
+	names := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+
+	sort.Strings(names)
+
+	for _, dir := range names {
+		report.Problems = append(report.Problems, verifyDir(ctx, s, key, dir, dirs[dir], report)...)
+	}
+
+	report.FinishedAt = time.Now().UTC()
+
+	return report, nil
+}
+
+func verifyDir(ctx context.Context, s Storage, key minisign.PublicKey, dir string, files *repoFiles, report *VerifyReport) []ChecksumProblem {
+	if !files.checksums {
+		if len(files.backups) == 0 {
+			return nil
+		}
+
+		return []ChecksumProblem{{Key: dir, Problem: problemUnsigned}}
+	}
+
+	sums, _, err := readSignedChecksums(ctx, s, dir, key)
+	if err != nil {
+		return []ChecksumProblem{{Key: path.Join(dir, checksumsName), Problem: problemBadSignature, Detail: err.Error()}}
+	}
+
+	var problems []ChecksumProblem
+
+	for _, o := range files.backups {
+		name := strings.TrimPrefix(o.Key, dir+"/")
+
+		want, ok := sums[name]
+		if !ok {
+			problems = append(problems, ChecksumProblem{Key: o.Key, Problem: problemUnexpected})
+
+			continue
+		}
+
+		delete(sums, name)
+
+		got, sErr := storageChecksum(ctx, s, o.Key, sha256.New())
+		if sErr != nil {
+			problems = append(problems, ChecksumProblem{Key: o.Key, Problem: problemModified, Detail: sErr.Error()})
+
+			continue
+		}
+
+		if hex.EncodeToString(got) != want {
+			problems = append(problems, ChecksumProblem{Key: o.Key, Problem: problemModified})
+
+			continue
+		}
+
+		report.Verified++
+	}
+
+	for _, key := range files.others {
+		problems = append(problems, ChecksumProblem{Key: key, Problem: problemUnexpected})
+	}
+
+	missing := make([]string, 0, len(sums))
+	for name := range sums {
+		missing = append(missing, name)
+	}
+
+	sort.Strings(missing)
+
+	for _, name := range missing {
+		problems = append(problems, ChecksumProblem{Key: path.Join(dir, name), Problem: problemMissing})
+	}
+
+	return problems
+}
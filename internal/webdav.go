@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+
+	"github.com/studio-b12/gowebdav"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envWebDAVURL      = "SOBA_WEBDAV_URL"
+	envWebDAVUser     = "SOBA_WEBDAV_USER"
+	envWebDAVPassword = "SOBA_WEBDAV_PASSWORD" // nolint:gosec
+)
+
+// webDAVStorage keeps the backup tree in a WebDAV collection such as a
+// Nextcloud or ownCloud folder.
+type webDAVStorage struct {
+	name   string
+	client *gowebdav.Client
+}
+
+func newWebDAVStorage(rawURL string) (*webDAVStorage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse WebDAV URL")
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("%s must be an http or https URL", envWebDAVURL)
+	}
+
+	user, _ := GetEnvOrFile(envWebDAVUser)
+	password, _ := GetEnvOrFile(envWebDAVPassword)
+
+	client := gowebdav.NewClient(rawURL, user, password)
+	client.SetTimeout(defaultHTTPClientRequestTimeout)
+
+	return &webDAVStorage{
+		name:   "webdav://" + u.Host + u.Path,
+		client: client,
+	}, nil
+}
+
+func (d *webDAVStorage) Name() string {
+	return d.name
+}
+
+func (d *webDAVStorage) List(_ context.Context, prefix string) ([]ObjectInfo, error) {
+	if _, err := d.client.Stat("/"); err != nil {
+		if gowebdav.IsErrNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, errors.WithStack(err)
+	}
+
+	return listRemoteTree("/", prefix, d.client.ReadDir)
+}
+
+// Put uploads to a temporary name and moves it into place once complete.
+func (d *webDAVStorage) Put(_ context.Context, key string, r io.Reader, _ int64) error {
+	target := path.Join("/", key)
+	partial := target + partialUploadSuffix
+
+	if err := d.client.MkdirAll(path.Dir(target), storageDirMode); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := d.client.WriteStream(partial, r, storageDirMode); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := d.client.Rename(partial, target, true); err != nil {
+		_ = d.client.Remove(partial)
+
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (d *webDAVStorage) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	r, err := d.client.ReadStream(path.Join("/", key))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return r, nil
+}
+
+func (d *webDAVStorage) Delete(_ context.Context, key string) error {
+	if err := d.client.Remove(path.Join("/", key)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (d *webDAVStorage) Stat(_ context.Context, key string) (ObjectInfo, error) {
+	info, err := d.client.Stat(path.Join("/", key))
+	if err != nil {
+		if gowebdav.IsErrNotFound(err) {
+			return ObjectInfo{}, errors.WithMessage(fs.ErrNotExist, key)
+		}
+
+		return ObjectInfo{}, errors.WithStack(err)
+	}
+
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (d *webDAVStorage) Close() error {
+	return nil
+}
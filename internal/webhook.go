@@ -141,5 +141,55 @@ func getBackupsStats(br BackupResults) (ok, failed int) {
 		}
 	}
 
+	// an offsite copy that could not be updated is a failure even though the
+	// local backups succeeded
+	for _, d := range br.Destinations {
+		if d.Error != nil {
+			failed++
+		}
+	}
+
+	for _, m := range br.Mirrors {
+		if m.Error != nil {
+			failed++
+		}
+	}
+
+	if br.Signing != nil && br.Signing.Error != nil {
+		failed++
+	}
+
+	if br.Obfuscation != nil && br.Obfuscation.Error != nil {
+		failed++
+	}
+
+	if br.Keyring != nil && br.Keyring.Error != nil {
+		failed++
+	}
+
+	if br.Encryption != nil && br.Encryption.Error != nil {
+		failed++
+	}
+
+	if br.Immutable != nil && br.Immutable.Error != nil {
+		failed++
+	}
+
+	if br.Retention != nil && br.Retention.Error != nil {
+		failed++
+	}
+
+	if br.Quota != nil && br.Quota.Error != nil {
+		failed++
+	}
+
+	if br.MissingUpstream != nil && br.MissingUpstream.Error != nil {
+		failed++
+	}
+
+	if br.Submodules != nil && br.Submodules.Error != nil {
+		failed++
+	}
+
 	return ok, failed
 }
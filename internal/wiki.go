@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	envGitHubBackupWikis      = "GITHUB_BACKUP_WIKIS"
+	envGitLabBackupWikis      = "GITLAB_BACKUP_WIKIS"
+	envGiteaBackupWikis       = "GITEA_BACKUP_WIKIS"
+	envAzureDevOpsBackupWikis = "AZURE_DEVOPS_BACKUP_WIKIS"
+
+	wikiSuffix = ".wiki"
+
+	// the statuses githosts reports for a repository
+	repoStatusOK     = "ok"
+	repoStatusFailed = "failed"
+)
+
+// wikiSource describes where a provider's wikis are cloned from and where
+// their backups are stored.
+type wikiSource struct {
+	gitRemote
+	// domain is the directory in the backup directory the provider's
+	// repositories are stored under, e.g. github.com
+	domain string
+	// wiki returns the path of a repository's wiki relative to baseURL, and
+	// to domain, or false if the repository can not have one
+	wiki          func(repo string) (remote, local string, ok bool)
+	backupsEnvVar string
+}
+
+// siblingWiki is the wiki layout of GitHub, GitLab and Gitea, where the wiki
+// of owner/repo is the repository owner/repo.wiki.
+func siblingWiki(repo string) (string, string, bool) {
+	repo = strings.Trim(repo, "/")
+	if repo == "" || strings.HasSuffix(repo, wikiSuffix) {
+		return "", "", false
+	}
+
+	return repo + wikiSuffix, repo + wikiSuffix, true
+}
+
+// azureDevOpsWiki returns the project wiki for a repository reported as
+// org/project/repo. Azure DevOps wikis belong to a project rather than a
+// repository, so the wiki is stored alongside the project's repositories.
+func azureDevOpsWiki(repo string) (string, string, bool) {
+	org, rest, _ := strings.Cut(strings.Trim(repo, "/"), "/")
+
+	project, name, _ := strings.Cut(rest, "/")
+	if org == "" || project == "" || name == "" {
+		return "", "", false
+	}
+
+	return path.Join(org, project, "_git", project+wikiSuffix), path.Join(org, project, project+wikiSuffix), true
+}
+
+// wikiBaseURL returns the web address a provider serves git from, derived
+// from its API URL, e.g. https://api.github.com becomes https://github.com
+// and https://gitlab.example.com/api/v4 becomes https://gitlab.example.com.
+// The second value is the host name backups are stored under.
+func wikiBaseURL(apiURL, defaultURL string) (string, string) {
+	u, err := url.Parse(apiURL)
+	if apiURL == "" || err != nil || u.Host == "" {
+		u, _ = url.Parse(defaultURL)
+	}
+
+	if u.Host == "" {
+		return "", ""
+	}
+
+	u.Host = strings.TrimPrefix(u.Host, "api.")
+
+	return u.Scheme + "://" + u.Host, u.Hostname()
+}
+
+func gitHubWikiSource(token string) wikiSource {
+	baseURL, domain := wikiBaseURL(os.Getenv(envGitHubAPIURL), "https://api.github.com")
+
+	return wikiSource{
+		gitRemote: gitRemote{baseURL: baseURL, username: "x-access-token", password: token},
+		domain:    domain, wiki: siblingWiki, backupsEnvVar: envGitHubBackups,
+	}
+}
+
+func gitLabWikiSource(token string) wikiSource {
+	baseURL, domain := wikiBaseURL(os.Getenv(envGitLabAPIURL), "https://gitlab.com/api/v4")
+
+	return wikiSource{
+		gitRemote: gitRemote{baseURL: baseURL, username: "oauth2", password: token},
+		domain:    domain, wiki: siblingWiki, backupsEnvVar: envGitLabBackups,
+	}
+}
+
+func giteaWikiSource(token string) wikiSource {
+	baseURL, domain := wikiBaseURL(os.Getenv(envGiteaAPIURL), "")
+
+	return wikiSource{
+		gitRemote: gitRemote{baseURL: baseURL, username: "oauth2", password: token},
+		domain:    domain, wiki: siblingWiki, backupsEnvVar: envGiteaBackups,
+	}
+}
+
+func azureDevOpsWikiSource(user, pat string) wikiSource {
+	return wikiSource{
+		gitRemote: gitRemote{baseURL: "https://dev.azure.com", username: user, password: pat},
+		domain:    "dev.azure.com", wiki: azureDevOpsWiki, backupsEnvVar: envAzureDevOpsBackups,
+	}
+}
+
+// backupWikis backs up the wiki of each repository backed up successfully,
+// adding a result for each wiki found. A wiki is stored as a repository of
+// its own next to the repository, e.g. owner/repo.wiki, so it is encrypted,
+// compared and rotated like any other backup.
+func backupWikis(backupDir string, source wikiSource, results *githosts.ProviderBackupResult) {
+	if source.baseURL == "" {
+		return
+	}
+
+	ctx := context.Background()
+	storage := newLocalStorage(backupDir, resolveWorkingDir(backupDir))
+	seen := make(map[string]bool)
+
+	var wikis []githosts.RepoBackupResults
+
+	for _, r := range results.BackupResults {
+		if r.Error != nil {
+			continue
+		}
+
+		remote, local, ok := source.wiki(strings.TrimPrefix(listedRepoPath(r.Repo), source.domain+"/"))
+		if !ok || seen[local] {
+			continue
+		}
+
+		seen[local] = true
+
+		found, err := backupGitRepo(ctx, storage, source.gitRemote, source.baseURL+"/"+remote+".git",
+			path.Join(source.domain, local), source.backupsEnvVar)
+
+		switch {
+		case errors.Is(err, errRepoNotFound):
+			// the wiki has no pages
+		case err != nil:
+			logger.Printf("failed to back up wiki %s: %s", local, err)
+
+			wikis = append(wikis, githosts.RepoBackupResults{Repo: local, Status: repoStatusFailed, Error: errors.WithStack(err)})
+		case found:
+			wikis = append(wikis, githosts.RepoBackupResults{Repo: local, Status: repoStatusOK})
+		}
+	}
+
+	if len(wikis) > 0 {
+		logger.Printf("backed up %d wikis", len(wikis))
+	}
+
+	results.BackupResults = append(results.BackupResults, wikis...)
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonhadfield/githosts-utils/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func gitCommit(t *testing.T, dir, message string) {
+	t.Helper()
+
+	cmd := exec.CommandContext(t.Context(), "git", "-C", dir, "commit", "--allow-empty", "-q", "-m", message)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=soba", "GIT_AUTHOR_EMAIL=soba@example.com",
+		"GIT_COMMITTER_NAME=soba", "GIT_COMMITTER_EMAIL=soba@example.com")
+
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+func TestBackupWikis(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	remote := t.TempDir()
+	wiki := filepath.Join(remote, "owner", "repo.wiki.git")
+
+	out, err := exec.CommandContext(t.Context(), "git", "init", "-q", wiki).CombinedOutput()
+	require.NoError(t, err, string(out))
+	gitCommit(t, wiki, "Home")
+
+	t.Setenv(envGitHubBackups, "1")
+
+	backupDir := t.TempDir()
+	source := wikiSource{
+		gitRemote: gitRemote{baseURL: "file://" + remote}, domain: "example.com", wiki: siblingWiki,
+		backupsEnvVar: envGitHubBackups,
+	}
+	results := githosts.ProviderBackupResult{BackupResults: []githosts.RepoBackupResults{
+		{Repo: "owner/repo", Status: repoStatusOK},
+		{Repo: "owner/nowiki", Status: repoStatusOK},
+	}}
+
+	backupWikis(backupDir, source, &results)
+	require.Len(t, results.BackupResults, 3)
+	require.Equal(t, githosts.RepoBackupResults{Repo: "owner/repo.wiki", Status: repoStatusOK}, results.BackupResults[2])
+
+	list := func() []string {
+		objects, lErr := newLocalStorage(backupDir, resolveWorkingDir(backupDir)).List(t.Context(), "")
+		require.NoError(t, lErr)
+
+		var keys []string
+		for _, o := range objects {
+			keys = append(keys, o.Key)
+		}
+
+		return keys
+	}
+
+	first := list()
+	require.Len(t, first, 2)
+	require.Regexp(t, `^example.com/owner/repo.wiki/repo.wiki.\d{14}.bundle$`, first[0])
+	require.Regexp(t, `^example.com/owner/repo.wiki/repo.wiki.\d{14}.refs$`, first[1])
+
+	// an unchanged wiki is not backed up again
+	time.Sleep(time.Second)
+
+	results.BackupResults = results.BackupResults[:2]
+	backupWikis(backupDir, source, &results)
+	require.Len(t, results.BackupResults, 3)
+	require.Equal(t, first, list())
+
+	// a changed wiki replaces the previous backup, keeping GITHUB_BACKUPS
+	gitCommit(t, wiki, "Runbook")
+
+	backupWikis(backupDir, source, &results)
+
+	second := list()
+	require.Len(t, second, 2)
+	require.NotEqual(t, first, second)
+}
+
+func TestWikiPaths(t *testing.T) {
+	baseURL, domain := wikiBaseURL("", "https://api.github.com")
+	require.Equal(t, "https://github.com", baseURL)
+	require.Equal(t, "github.com", domain)
+
+	baseURL, domain = wikiBaseURL("https://gitlab.example.com:8443/api/v4", "https://gitlab.com/api/v4")
+	require.Equal(t, "https://gitlab.example.com:8443", baseURL)
+	require.Equal(t, "gitlab.example.com", domain)
+
+	remote, local, ok := azureDevOpsWiki("org/project/repo")
+	require.True(t, ok)
+	require.Equal(t, "org/project/_git/project.wiki", remote)
+	require.Equal(t, "org/project/project.wiki", local)
+
+	_, _, ok = siblingWiki("owner/repo.wiki")
+	require.False(t, ok)
+}
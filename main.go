@@ -25,7 +25,15 @@ func main() {
 		logger.Println("version", version)
 	}
 
-	if err := internal.Run(); err != nil {
+	var err error
+
+	if len(os.Args) > 1 {
+		err = internal.RunCommand(os.Args[1:])
+	} else {
+		err = internal.Run()
+	}
+
+	if err != nil {
 		logger.Fatal(err)
 	}
 }